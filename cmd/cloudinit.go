@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+// cloudInitFiles are the paths of files containing additional cloud-init
+// data for a VM.
+type cloudInitFiles struct {
+	userData      string
+	vendorData    string
+	networkConfig string
+}
+
+func addCloudInitFlags(cmd *cobra.Command, files *cloudInitFiles) {
+	cmd.Flags().StringVar(&files.userData, "user-data", "", "cloud-config file which is merged with the cloud-config generated by virter")
+	cmd.Flags().StringVar(&files.vendorData, "vendor-data", "", "file containing cloud-init vendor data")
+	cmd.Flags().StringVar(&files.networkConfig, "network-config", "", "file containing cloud-init network configuration")
+}
+
+// load reads the files which are set.
+func (f cloudInitFiles) load() (virter.CloudInitData, error) {
+	var data virter.CloudInitData
+	var err error
+
+	data.UserData, err = readOptionalFile(f.userData)
+	if err != nil {
+		return virter.CloudInitData{}, err
+	}
+
+	data.VendorData, err = readOptionalFile(f.vendorData)
+	if err != nil {
+		return virter.CloudInitData{}, err
+	}
+
+	data.NetworkConfig, err = readOptionalFile(f.networkConfig)
+	if err != nil {
+		return virter.CloudInitData{}, err
+	}
+
+	return data, nil
+}
+
+func readOptionalFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read '%s': %w", path, err)
+	}
+
+	return content, nil
+}
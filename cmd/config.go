@@ -21,6 +21,21 @@ import (
 // configuration file.
 // The default config file also contains some inline documentation for each option.
 const defaultConfigTemplate = `[libvirt]
+# uri is the libvirt connection URI. Besides local unix sockets, remote hosts
+# can be reached via the "ssh", "tcp" and "tls" transports, for example
+# "qemu+ssh://user@host/system". VMs on remote hosts are reached by tunneling
+# through an SSH connection to the host.
+# Unprivileged users can connect to their own session daemon with
+# "qemu:///session". VMs are then attached with user-mode networking instead
+# of the configured network and their SSH ports are forwarded to 127.0.0.1.
+# Default value: "{{ get "libvirt.uri" }}"
+uri = "{{ get "libvirt.uri" }}"
+
+# session_ssh_port_base is added to the ID of a VM to determine the port on
+# 127.0.0.1 which is forwarded to its SSH port for session connections.
+# Default value: {{ get "libvirt.session_ssh_port_base" }}
+session_ssh_port_base = {{ get "libvirt.session_ssh_port_base" }}
+
 # pool is the libvirt pool that virter should use.
 # The user is responsible for ensuring that this pool exists and is active.
 # Default value: "{{ get "libvirt.pool" }}"
@@ -31,6 +46,55 @@ pool = "{{ get "libvirt.pool" }}"
 # Default value: "{{ get "libvirt.network" }}"
 network = "{{ get "libvirt.network" }}"
 
+# dns_domain is the domain used for the FQDN of the VMs if the libvirt network
+# does not define one. If it is empty, no FQDN is set.
+# Default value: "{{ get "libvirt.dns_domain" }}"
+dns_domain = "{{ get "libvirt.dns_domain" }}"
+
+# id_range limits the IDs which are chosen automatically for new VMs, for
+# example "100-199". Different users or CI jobs on one network can use
+# disjoint ranges. If it is empty, any free ID may be chosen.
+# Default value: "{{ get "libvirt.id_range" }}"
+id_range = "{{ get "libvirt.id_range" }}"
+
+# id_lock_file is locked while an ID is chosen for a new VM, so that virter
+# processes running at the same time on this host do not choose the same ID.
+# If it is empty, no lock is used.
+# Default value: "{{ get "libvirt.id_lock_file" }}"
+id_lock_file = "{{ get "libvirt.id_lock_file" }}"
+
+# mac_prefix is the OUI from which the MAC addresses of the VMs are derived,
+# together with the VM ID and the index of the interface. This way, an ID is
+# always paired with the same MAC address and IP. If it is empty, libvirt
+# generates random MAC addresses.
+# Default value: "{{ get "libvirt.mac_prefix" }}"
+mac_prefix = "{{ get "libvirt.mac_prefix" }}"
+
+# dhcp_release enables releasing the DHCP leases of removed VMs using the
+# dhcp_release utility. This is only needed when mac_prefix is empty.
+# Default value: {{ get "libvirt.dhcp_release" }}
+dhcp_release = {{ get "libvirt.dhcp_release" }}
+
+# bridge is an existing bridge on the libvirt host. If it is set, the first
+# interface of the VMs is attached to this bridge instead of the libvirt
+# network. The DHCP server on the bridge is managed outside libvirt and must
+# have static leases for the VMs.
+# Default value: "{{ get "libvirt.bridge" }}"
+bridge = "{{ get "libvirt.bridge" }}"
+
+# bridge_network is the network of the bridge in CIDR notation, for example
+# "192.168.1.0/24". The ID of a VM is added to the network address to
+# determine its IP.
+# Default value: "{{ get "libvirt.bridge_network" }}"
+bridge_network = "{{ get "libvirt.bridge_network" }}"
+
+# bridge_leases is the path of a file containing the static leases of the DHCP
+# server on the bridge. Each line is either in the dnsmasq dhcp-hostsfile
+# format "mac,ip[,name]" or in the /etc/ethers format "mac ip". The MAC
+# address of a VM is taken from the lease for its IP.
+# Default value: "{{ get "libvirt.bridge_leases" }}"
+bridge_leases = "{{ get "libvirt.bridge_leases" }}"
+
 [time]
 # ssh_ping_count is the number of times virter will try to connect to a VM's
 # ssh port after starting it.
@@ -42,6 +106,12 @@ ssh_ping_count = {{ get "time.ssh_ping_count" }}
 # Default value: "{{ get "time.ssh_ping_period" }}"
 ssh_ping_period = "{{ get "time.ssh_ping_period" }}"
 
+# cloud_init_timeout is how long virter will wait for cloud-init to finish in
+# a VM after its ssh port is reachable, before provisioning it or when
+# --wait-cloud-init is given.
+# Default value: "{{ get "time.cloud_init_timeout" }}"
+cloud_init_timeout = "{{ get "time.cloud_init_timeout" }}"
+
 # shutdown_timeout is how long virter will wait for a VM to shut down.
 # If a shutdown operation exceeds this timeout, an error will be produced.
 # Default value: "{{ get "time.shutdown_timeout" }}"
@@ -82,10 +152,21 @@ user_public_key = "{{ get "auth.user_public_key" }}"
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
+	viper.SetDefault("libvirt.uri", "qemu:///system")
+	viper.SetDefault("libvirt.session_ssh_port_base", 22000)
 	viper.SetDefault("libvirt.pool", "default")
 	viper.SetDefault("libvirt.network", "default")
+	viper.SetDefault("libvirt.dns_domain", "test")
+	viper.SetDefault("libvirt.id_range", "")
+	viper.SetDefault("libvirt.id_lock_file", filepath.Join(os.TempDir(), "virter-id.lock"))
+	viper.SetDefault("libvirt.mac_prefix", "52:54:00")
+	viper.SetDefault("libvirt.dhcp_release", false)
+	viper.SetDefault("libvirt.bridge", "")
+	viper.SetDefault("libvirt.bridge_network", "")
+	viper.SetDefault("libvirt.bridge_leases", "")
 	viper.SetDefault("time.ssh_ping_count", 60)
 	viper.SetDefault("time.ssh_ping_period", time.Second)
+	viper.SetDefault("time.cloud_init_timeout", 10*time.Minute)
 	viper.SetDefault("time.shutdown_timeout", 20*time.Second)
 	viper.SetDefault("time.docker_timeout", 30*time.Minute)
 
@@ -47,8 +47,10 @@ func parseArgMap(str string) (map[string]string, error) {
 	return result, nil
 }
 
-func fillDefaultValues(p map[string]string) (map[string]string, error) {
-	t := reflect.TypeOf(DiskArg{})
+// fillDefaultValues checks the required parameters and fills in the default
+// values according to the struct tags of arg.
+func fillDefaultValues(p map[string]string, arg interface{}) (map[string]string, error) {
+	t := reflect.TypeOf(arg)
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
 		key := field.Tag.Get("key")
@@ -78,7 +80,7 @@ func (d *DiskArg) Set(str string) error {
 		return fmt.Errorf("failed to parse disk specification: %w", err)
 	}
 
-	params, err = fillDefaultValues(params)
+	params, err = fillDefaultValues(params, DiskArg{})
 	if err != nil {
 		return fmt.Errorf("failed to parse disk specification: %w", err)
 	}
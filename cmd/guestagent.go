@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/pkg/libvirtagent"
+)
+
+// guestAgentConnection sends guest agent commands over a separate libvirt
+// connection, which is only opened when it is first needed.
+type guestAgentConnection struct {
+	uri    libvirtURI
+	mu     sync.Mutex
+	client *libvirtagent.Client
+	// tunnel holds the SSH connection for "qemu+ssh" URIs
+	tunnel virter.Tunnel
+}
+
+func (g *guestAgentConnection) connect() (*libvirtagent.Client, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.client != nil {
+		return g.client, nil
+	}
+
+	c, tunnel, err := dialLibvirt(g.uri)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial libvirt for guest agent commands: %w", err)
+	}
+
+	name := "qemu:///system"
+	if g.uri.session {
+		name = "qemu:///session"
+	}
+
+	client, err := libvirtagent.Connect(c, name)
+	if err != nil {
+		c.Close()
+		closeTunnel(tunnel)
+		return nil, fmt.Errorf("failed to connect to libvirt for guest agent commands: %w", err)
+	}
+
+	g.client = client
+	g.tunnel = tunnel
+	return client, nil
+}
+
+func (g *guestAgentConnection) QEMUDomainAgentCommand(dom libvirt.Domain, cmd string, timeout int32, flags uint32) (string, error) {
+	client, err := g.connect()
+	if err != nil {
+		return "", err
+	}
+
+	return client.QEMUDomainAgentCommand(dom, cmd, timeout, flags)
+}
+
+// Close closes the connection if it was opened.
+func (g *guestAgentConnection) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.client == nil {
+		return nil
+	}
+
+	err := g.client.Close()
+	if tunnelErr := closeTunnel(g.tunnel); err == nil {
+		err = tunnelErr
+	}
+	g.client = nil
+	g.tunnel = nil
+	return err
+}
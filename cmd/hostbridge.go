@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/spf13/viper"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+// hostBridgeConfig returns the configured host bridge, or nil if VMs should
+// be attached to the libvirt network.
+func hostBridgeConfig() (*virter.HostBridge, error) {
+	name := viper.GetString("libvirt.bridge")
+	if name == "" {
+		return nil, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(viper.GetString("libvirt.bridge_network"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bridge network: %w", err)
+	}
+
+	leasesPath := viper.GetString("libvirt.bridge_leases")
+	if leasesPath == "" {
+		return nil, fmt.Errorf("bridge '%s' configured without static leases", name)
+	}
+
+	f, err := os.Open(leasesPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open static leases: %w", err)
+	}
+	defer f.Close()
+
+	leases, err := virter.ParseStaticLeases(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse static leases '%s': %w", leasesPath, err)
+	}
+
+	return &virter.HostBridge{
+		Name:    name,
+		Network: *ipNet,
+		Leases:  leases,
+	}, nil
+}
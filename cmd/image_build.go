@@ -24,6 +24,12 @@ func imageBuildCommand() *cobra.Command {
 
 	var vcpus uint
 
+	var labelStrings []string
+	var labels map[string]string
+
+	var ciFiles cloudInitFiles
+	var cloudInit virter.CloudInitData
+
 	buildCmd := &cobra.Command{
 		Use:   "build base_image new_image",
 		Short: "Build an image",
@@ -33,6 +39,17 @@ step, and then committing the resulting volume.`,
 		PreRun: func(cmd *cobra.Command, args []string) {
 			memKiB = uint64(mem.Value / unit.DefaultUnits["K"])
 			bootCapacityKiB = uint64(bootCapacity.Value / unit.DefaultUnits["K"])
+
+			var err error
+			labels, err = virter.ParseLabels(labelStrings)
+			if err != nil {
+				log.Fatalf("Invalid label: %v", err)
+			}
+
+			cloudInit, err = ciFiles.load()
+			if err != nil {
+				log.Fatalf("Invalid cloud-init data: %v", err)
+			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			baseImageName := args[0]
@@ -68,17 +85,21 @@ step, and then committing the resulting volume.`,
 			}
 
 			vmConfig := virter.VMConfig{
-				ImageName:       baseImageName,
-				Name:            newImageName,
-				MemoryKiB:       memKiB,
-				BootCapacityKiB: bootCapacityKiB,
-				VCPUs:           vcpus,
-				ID:              vmID,
-				SSHPublicKeys:   publicKeys,
-				SSHPrivateKey:   privateKey,
-				WaitSSH:         true,
-				SSHPingCount:    viper.GetInt("time.ssh_ping_count"),
-				SSHPingPeriod:   viper.GetDuration("time.ssh_ping_period"),
+				ImageName:        baseImageName,
+				Name:             newImageName,
+				MemoryKiB:        memKiB,
+				BootCapacityKiB:  bootCapacityKiB,
+				VCPUs:            vcpus,
+				ID:               vmID,
+				SSHPublicKeys:    publicKeys,
+				SSHPrivateKey:    privateKey,
+				WaitSSH:          true,
+				SSHPingCount:     viper.GetInt("time.ssh_ping_count"),
+				SSHPingPeriod:    viper.GetDuration("time.ssh_ping_period"),
+				WaitCloudInit:    true,
+				CloudInitTimeout: viper.GetDuration("time.cloud_init_timeout"),
+				Labels:           labels,
+				CloudInit:        cloudInit,
 			}
 
 			dockerContainerConfig := virter.DockerContainerConfig{
@@ -133,6 +154,8 @@ step, and then committing the resulting volume.`,
 	buildCmd.Flags().VarP(mem, "memory", "m", "Set amount of memory for the VM")
 	bootCapacity = u.MustNewValue(0, unit.None)
 	buildCmd.Flags().VarP(bootCapacity, "bootcap", "", "Capacity of the boot volume (default is the capacity of the base image, at least 10G)")
+	buildCmd.Flags().StringArrayVar(&labelStrings, "label", []string{}, `Add a label to the VM used for building. Format: "key=value". Can be specified multiple times`)
+	addCloudInitFlags(buildCmd, &ciFiles)
 
 	return buildCmd
 }
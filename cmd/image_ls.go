@@ -2,38 +2,159 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
 )
 
 var listAvailable bool
 
+type availableImage struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Pulled bool   `json:"pulled"`
+}
+
 func imageLsCommand() *cobra.Command {
+	var listAll bool
+	var output string
+
 	lsCmd := &cobra.Command{
 		Use:   "ls",
 		Short: "List images",
-		Long:  `List all images available locally.`,
-		Args:  cobra.NoArgs,
+		Long: `List all images available locally. With --all, volumes
+belonging to VMs are listed as well.`,
+		Args: cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if err := checkOutputFormat(output); err != nil {
+				log.Fatal(err)
+			}
+		},
 		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			vols, err := v.VolumeList()
+			if err != nil {
+				log.Fatalf("Error listing images: %v", err)
+			}
+
 			if listAvailable {
-				reg := loadRegistry()
-				entries, err := reg.List()
+				images, err := listAvailableImages(vols)
 				if err != nil {
 					log.Fatalf("Error listing images: %v", err)
 				}
 
-				for name, entry := range entries {
-					fmt.Printf("%s: %s\n", name, entry.URL)
+				if output == outputFormatJSON {
+					if err := printJSON(images); err != nil {
+						log.Fatal(err)
+					}
+					return
 				}
+
+				w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+				fmt.Fprintln(w, "NAME\tPULLED\tURL")
+				for _, img := range images {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", img.Name, yesNo(img.Pulled), img.URL)
+				}
+				w.Flush()
+				return
+			}
+
+			if !listAll {
+				vols = filterImages(vols)
+			}
+
+			if output == outputFormatJSON {
+				if err := printJSON(vols); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			if listAll {
+				fmt.Fprintln(w, "NAME\tKIND\tVM\tCAPACITY\tALLOCATION\tFORMAT\tCREATED")
 			} else {
-				log.Fatalf("Listing locally available image files is not supported yet")
+				fmt.Fprintln(w, "NAME\tCAPACITY\tALLOCATION\tFORMAT\tCREATED")
 			}
+			for _, vol := range vols {
+				if listAll {
+					fmt.Fprintf(w, "%s\t%s\t%s\t", vol.Name, vol.Kind, vol.VM)
+				} else {
+					fmt.Fprintf(w, "%s\t", vol.Name)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+					formatBytes(vol.CapacityB), formatBytes(vol.AllocationB),
+					vol.Format, formatTime(vol.Created))
+			}
+			w.Flush()
 		},
 	}
 
 	lsCmd.Flags().BoolVar(&listAvailable, "available", false, "List all images available from image registries")
+	lsCmd.Flags().BoolVarP(&listAll, "all", "a", false, "Also list volumes belonging to VMs")
+	lsCmd.Flags().StringVarP(&output, "output", "o", outputFormatTable, `Output format, one of "table" or "json"`)
 
 	return lsCmd
 }
+
+func filterImages(vols []virter.VolumeInfo) []virter.VolumeInfo {
+	images := []virter.VolumeInfo{}
+	for _, vol := range vols {
+		if vol.Kind == virter.VolumeKindImage {
+			images = append(images, vol)
+		}
+	}
+	return images
+}
+
+func listAvailableImages(vols []virter.VolumeInfo) ([]availableImage, error) {
+	reg := loadRegistry()
+	entries, err := reg.List()
+	if err != nil {
+		return nil, err
+	}
+
+	pulled := make(map[string]bool)
+	for _, vol := range filterImages(vols) {
+		pulled[vol.Name] = true
+	}
+
+	images := []availableImage{}
+	for name, entry := range entries {
+		images = append(images, availableImage{
+			Name:   name,
+			URL:    entry.URL,
+			Pulled: pulled[name],
+		})
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+
+	return images, nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
@@ -1,30 +1,434 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/digitalocean/go-libvirt"
+	homedir "github.com/mitchellh/go-homedir"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 
 	"github.com/LINBIT/virter/internal/virter"
 )
 
-// VirterConnect connects to a local libvirt instance
+const (
+	libvirtDefaultSocket = "/var/run/libvirt/libvirt-sock"
+	libvirtDialTimeout   = 2 * time.Second
+)
+
+// libvirtURI is a parsed libvirt connection URI such as
+// "qemu+ssh://user@host/system?keyfile=/path/to/key".
+type libvirtURI struct {
+	transport string
+	user      string
+	host      string
+	port      string
+	socket    string
+	keyfile   string
+	pkipath   string
+	noVerify  bool
+	// session is set for unprivileged per-user daemons (qemu:///session)
+	session bool
+}
+
+// parseLibvirtURI parses a libvirt connection URI. The transports "unix",
+// "tcp", "tls" and "ssh" are supported for the system daemon, see
+// https://libvirt.org/uri.html#remote-uris. The session daemon of the current
+// user is only supported via the "unix" transport.
+func parseLibvirtURI(s string) (libvirtURI, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return libvirtURI{}, fmt.Errorf("invalid libvirt URI '%s': %w", s, err)
+	}
+
+	driver, transport := u.Scheme, ""
+	for i, c := range u.Scheme {
+		if c == '+' {
+			driver, transport = u.Scheme[:i], u.Scheme[i+1:]
+			break
+		}
+	}
+
+	if driver != "qemu" {
+		return libvirtURI{}, fmt.Errorf("unsupported libvirt driver '%s', only 'qemu' is supported", driver)
+	}
+
+	if u.Path != "/system" && u.Path != "/session" {
+		return libvirtURI{}, fmt.Errorf("unsupported libvirt URI path '%s', only '/system' and '/session' are supported", u.Path)
+	}
+
+	// like libvirt, default to TLS for remote hosts
+	if transport == "" {
+		transport = "unix"
+		if u.Host != "" {
+			transport = "tls"
+		}
+	}
+
+	query := u.Query()
+	result := libvirtURI{
+		transport: transport,
+		host:      u.Hostname(),
+		port:      u.Port(),
+		socket:    query.Get("socket"),
+		keyfile:   query.Get("keyfile"),
+		pkipath:   query.Get("pkipath"),
+		noVerify:  query.Get("no_verify") == "1",
+		session:   u.Path == "/session",
+	}
+
+	if u.User != nil {
+		result.user = u.User.Username()
+	}
+
+	switch transport {
+	case "unix":
+		if result.host != "" {
+			return libvirtURI{}, fmt.Errorf("unix transport does not support a host")
+		}
+		if result.socket == "" && result.session {
+			result.socket, err = libvirtSessionSocket()
+			if err != nil {
+				return libvirtURI{}, err
+			}
+		}
+		if result.socket == "" {
+			result.socket = libvirtDefaultSocket
+		}
+	case "ssh":
+		if result.port == "" {
+			result.port = "22"
+		}
+		if result.socket == "" {
+			result.socket = libvirtDefaultSocket
+		}
+	case "tcp":
+		if result.port == "" {
+			result.port = "16509"
+		}
+	case "tls":
+		if result.port == "" {
+			result.port = "16514"
+		}
+	default:
+		return libvirtURI{}, fmt.Errorf("unsupported libvirt transport '%s'", transport)
+	}
+
+	if transport != "unix" && result.host == "" {
+		return libvirtURI{}, fmt.Errorf("%s transport requires a host", transport)
+	}
+
+	if transport != "unix" && result.session {
+		return libvirtURI{}, fmt.Errorf("%s transport does not support session connections", transport)
+	}
+
+	return result, nil
+}
+
+// libvirtSessionSocket returns the path of the socket of the libvirt session
+// daemon of the current user.
+func libvirtSessionSocket() (string, error) {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, "libvirt", "libvirt-sock"), nil
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine home directory: %w", err)
+	}
+
+	return filepath.Join(home, ".cache", "libvirt", "libvirt-sock"), nil
+}
+
+// remote returns whether the libvirt host is not the local machine.
+func (u libvirtURI) remote() bool {
+	return u.transport != "unix"
+}
+
+func (u libvirtURI) hostPort() string {
+	return net.JoinHostPort(u.host, u.port)
+}
+
+// VirterConnect connects to the libvirt instance given by the "libvirt.uri"
+// setting
 func VirterConnect() (*virter.Virter, error) {
-	c, err := net.DialTimeout("unix", "/var/run/libvirt/libvirt-sock", 2*time.Second)
+	uri, err := parseLibvirtURI(viper.GetString("libvirt.uri"))
+	if err != nil {
+		return nil, err
+	}
+
+	c, tunnel, err := dialLibvirt(uri)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial libvirt: %w", err)
 	}
 
 	l := libvirt.New(c)
 	if err := l.Connect(); err != nil {
+		closeTunnel(tunnel)
 		return nil, fmt.Errorf("failed to connect to libvirt socket: %w", err)
 	}
 
 	pool := viper.GetString("libvirt.pool")
 	network := viper.GetString("libvirt.network")
 
-	return virter.New(l, pool, network), nil
+	v := virter.New(l, pool, network)
+	v.SetDNSDomain(viper.GetString("libvirt.dns_domain"))
+	v.SetDHCPRelease(viper.GetBool("libvirt.dhcp_release"))
+	v.SetIDLockFile(viper.GetString("libvirt.id_lock_file"))
+	v.SetGuestAgent(&guestAgentConnection{uri: uri})
+
+	if idRange := viper.GetString("libvirt.id_range"); idRange != "" {
+		r, err := parseIDRange(idRange)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.SetIDRange(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if macPrefix := viper.GetString("libvirt.mac_prefix"); macPrefix != "" {
+		prefix, err := parseMACPrefix(macPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.SetMACPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	if tunnel != nil {
+		v.SetTunnel(tunnel)
+	}
+	if uri.session {
+		// session daemons cannot manage the DHCP reservations of networks
+		v.UseUserNetwork(viper.GetUint("libvirt.session_ssh_port_base"))
+	}
+
+	bridge, err := hostBridgeConfig()
+	if err != nil {
+		return nil, err
+	}
+	if bridge != nil {
+		if uri.session {
+			return nil, fmt.Errorf("host bridges are not supported for session connections")
+		}
+		v.UseHostBridge(*bridge)
+	}
+
+	return v, nil
+}
+
+// dialLibvirt opens a connection to the libvirt daemon. For remote hosts,
+// it also returns a tunnel to reach the VMs through the libvirt host.
+func dialLibvirt(uri libvirtURI) (net.Conn, virter.Tunnel, error) {
+	switch uri.transport {
+	case "unix":
+		c, err := net.DialTimeout("unix", uri.socket, libvirtDialTimeout)
+		return c, nil, err
+	case "tcp":
+		c, err := net.DialTimeout("tcp", uri.hostPort(), libvirtDialTimeout)
+		return c, newSSHTunnel(sshConnector(uri, "22")), err
+	case "tls":
+		config, err := libvirtTLSConfig(uri)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialer := &net.Dialer{Timeout: libvirtDialTimeout}
+		c, err := tls.DialWithDialer(dialer, "tcp", uri.hostPort(), config)
+		return c, newSSHTunnel(sshConnector(uri, "22")), err
+	case "ssh":
+		client, err := sshConnector(uri, uri.port)()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		log.Debugf("Dialing libvirt socket '%s' on %s", uri.socket, uri.host)
+		c, err := client.Dial("unix", uri.socket)
+		if err != nil {
+			client.Close()
+			return nil, nil, fmt.Errorf("could not dial libvirt socket on '%s': %w", uri.host, err)
+		}
+
+		// reuse the connection for reaching the VMs; closing the tunnel
+		// closes the connection
+		tunnel := newSSHTunnel(func() (*ssh.Client, error) { return client, nil })
+		tunnel.client = client
+		return c, tunnel, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported libvirt transport '%s'", uri.transport)
+}
+
+// libvirtTLSConfig loads the certificates from the locations libvirt uses
+// by default, or from the directory given by the "pkipath" parameter.
+func libvirtTLSConfig(uri libvirtURI) (*tls.Config, error) {
+	caPath := "/etc/pki/CA/cacert.pem"
+	certPath := "/etc/pki/libvirt/clientcert.pem"
+	keyPath := "/etc/pki/libvirt/private/clientkey.pem"
+	if uri.pkipath != "" {
+		caPath = filepath.Join(uri.pkipath, "cacert.pem")
+		certPath = filepath.Join(uri.pkipath, "clientcert.pem")
+		keyPath = filepath.Join(uri.pkipath, "clientkey.pem")
+	}
+
+	ca, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("failed to parse CA certificate from '%s'", caPath)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+
+	return &tls.Config{
+		ServerName:         uri.host,
+		RootCAs:            pool,
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: uri.noVerify,
+	}, nil
+}
+
+// sshConnector returns a function which opens an SSH connection to the
+// libvirt host on the given port.
+func sshConnector(uri libvirtURI, port string) func() (*ssh.Client, error) {
+	return func() (*ssh.Client, error) {
+		config, err := libvirtSSHConfig(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		hostPort := net.JoinHostPort(uri.host, port)
+		log.Debugf("Connecting to %s@%s via SSH", config.User, hostPort)
+		client, err := ssh.Dial("tcp", hostPort, config)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to '%s' via SSH: %w", hostPort, err)
+		}
+
+		return client, nil
+	}
+}
+
+// libvirtSSHConfig authenticates with the SSH agent, the key from the
+// "keyfile" parameter and the default keys of the user. Host keys are
+// checked against the user's known_hosts unless "no_verify" is set.
+func libvirtSSHConfig(uri libvirtURI) (*ssh.ClientConfig, error) {
+	username := uri.user
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("could not determine current user: %w", err)
+		}
+		username = u.Username
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, fmt.Errorf("could not determine home directory: %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			log.Debugf("Could not connect to SSH agent: %v", err)
+		} else {
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	keyfiles := []string{uri.keyfile}
+	if uri.keyfile == "" {
+		keyfiles = []string{
+			filepath.Join(home, ".ssh", "id_rsa"),
+			filepath.Join(home, ".ssh", "id_ecdsa"),
+			filepath.Join(home, ".ssh", "id_ed25519"),
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, keyfile := range keyfiles {
+		key, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			if uri.keyfile != "" {
+				return nil, fmt.Errorf("failed to load SSH key from '%s': %w", keyfile, err)
+			}
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			log.Debugf("Could not use SSH key '%s': %v", keyfile, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	hostKeyCallback := ssh.InsecureIgnoreHostKey()
+	if !uri.noVerify {
+		hostKeyCallback, err = knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts: %w", err)
+		}
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         libvirtDialTimeout,
+	}, nil
+}
+
+// parseMACPrefix parses a MAC address prefix such as "52:54:00".
+func parseMACPrefix(s string) (net.HardwareAddr, error) {
+	// net.ParseMAC only accepts complete addresses
+	mac, err := net.ParseMAC(s + ":00:00:00")
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC prefix '%s'", s)
+	}
+
+	return mac[:3], nil
+}
+
+// parseIDRange parses an ID range such as "100-199".
+func parseIDRange(s string) (virter.IDRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return virter.IDRange{}, fmt.Errorf("invalid ID range '%s'", s)
+	}
+
+	first, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 0)
+	if err != nil {
+		return virter.IDRange{}, fmt.Errorf("invalid ID range '%s': %w", s, err)
+	}
+
+	last, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 0)
+	if err != nil {
+		return virter.IDRange{}, fmt.Errorf("invalid ID range '%s': %w", s, err)
+	}
+
+	return virter.IDRange{First: uint(first), Last: uint(last)}, nil
 }
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func TestParseLibvirtURI(t *testing.T) {
+	cases := []struct {
+		input       string
+		expect      libvirtURI
+		expectError bool
+	}{
+		{
+			input:  "qemu:///system",
+			expect: libvirtURI{transport: "unix", socket: libvirtDefaultSocket},
+		}, {
+			input:  "qemu+unix:///system?socket=/tmp/libvirt-sock",
+			expect: libvirtURI{transport: "unix", socket: "/tmp/libvirt-sock"},
+		}, {
+			input:  "qemu+tcp://lab/system",
+			expect: libvirtURI{transport: "tcp", host: "lab", port: "16509"},
+		}, {
+			input:  "qemu://lab/system?pkipath=/tmp/pki",
+			expect: libvirtURI{transport: "tls", host: "lab", port: "16514", pkipath: "/tmp/pki"},
+		}, {
+			input: "qemu+ssh://alice@lab:2222/system?keyfile=/tmp/key&no_verify=1",
+			expect: libvirtURI{
+				transport: "ssh",
+				user:      "alice",
+				host:      "lab",
+				port:      "2222",
+				socket:    libvirtDefaultSocket,
+				keyfile:   "/tmp/key",
+				noVerify:  true,
+			},
+		}, {
+			input:  "qemu:///session?socket=/tmp/libvirt-sock",
+			expect: libvirtURI{transport: "unix", socket: "/tmp/libvirt-sock", session: true},
+		}, {
+			input:       "qemu+ssh://lab/session",
+			expectError: true,
+		}, {
+			input:       "xen:///system",
+			expectError: true,
+		}, {
+			input:       "qemu:///embed",
+			expectError: true,
+		}, {
+			input:       "qemu+ssh:///system",
+			expectError: true,
+		}, {
+			input:       "qemu+unix://lab/system",
+			expectError: true,
+		}, {
+			input:       "qemu+ext://lab/system",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := parseLibvirtURI(c.input)
+		if !c.expectError && err != nil {
+			t.Errorf("on input '%s':", c.input)
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c.expectError && err == nil {
+			t.Errorf("on input '%s':", c.input)
+			t.Fatal("expected error, got nil")
+		}
+
+		if !reflect.DeepEqual(actual, c.expect) {
+			t.Errorf("on input '%s':", c.input)
+			t.Errorf("expected: %+v", c.expect)
+			t.Errorf("actual: %+v", actual)
+		}
+	}
+}
+
+func TestParseLibvirtURISessionSocket(t *testing.T) {
+	old, ok := os.LookupEnv("XDG_RUNTIME_DIR")
+	if ok {
+		defer os.Setenv("XDG_RUNTIME_DIR", old)
+	} else {
+		defer os.Unsetenv("XDG_RUNTIME_DIR")
+	}
+	os.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+
+	actual, err := parseLibvirtURI("qemu:///session")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expect := "/run/user/1000/libvirt/libvirt-sock"
+	if actual.socket != expect {
+		t.Errorf("expected socket '%s', got '%s'", expect, actual.socket)
+	}
+}
+
+func TestParseMACPrefix(t *testing.T) {
+	actual, err := parseMACPrefix("52:54:00")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual.String() != "52:54:00" {
+		t.Errorf("expected prefix '52:54:00', got '%s'", actual.String())
+	}
+
+	for _, input := range []string{"52:54", "52:54:00:00", "52:54:00:00:00", "invalid"} {
+		if _, err := parseMACPrefix(input); err == nil {
+			t.Errorf("on input '%s': expected error, got nil", input)
+		}
+	}
+}
+
+func TestParseIDRange(t *testing.T) {
+	actual, err := parseIDRange("100-199")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual != (virter.IDRange{First: 100, Last: 199}) {
+		t.Errorf("unexpected ID range %+v", actual)
+	}
+
+	for _, input := range []string{"100", "100-", "a-b", "1-2-3"} {
+		if _, err := parseIDRange(input); err == nil {
+			t.Errorf("on input '%s': expected error, got nil", input)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func networkCommand() *cobra.Command {
+	networkCmd := &cobra.Command{
+		Use:   "network",
+		Short: "Network related subcommands",
+		Long:  `Network related subcommands.`,
+	}
+
+	networkCmd.AddCommand(networkAddCommand())
+	networkCmd.AddCommand(networkLsCommand())
+	networkCmd.AddCommand(networkRmCommand())
+
+	return networkCmd
+}
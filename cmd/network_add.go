@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func networkAddCommand() *cobra.Command {
+	var cidr string
+	var dhcpStart string
+	var dhcpEnd string
+	var domain string
+	var isolated bool
+
+	addCmd := &cobra.Command{
+		Use:   "add name",
+		Short: "Add a network",
+		Long: `Add a libvirt network with DHCP. By default, traffic from the network
+is forwarded to the outside using NAT. VMs can be attached to the network
+with "vm run --nic".`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			config, err := networkConfig(args[0], cidr, dhcpStart, dhcpEnd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			config.DNSDomain = domain
+			config.Isolated = isolated
+
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			err = v.NetworkAdd(config)
+			if err != nil {
+				log.Fatalf("Error adding network: %v", err)
+			}
+		},
+	}
+
+	addCmd.Flags().StringVar(&cidr, "cidr", "", `address of the host in the network, e.g. "192.168.130.1/24" (required)`)
+	addCmd.MarkFlagRequired("cidr")
+	addCmd.Flags().StringVar(&dhcpStart, "dhcp-start", "", "first address handed out by DHCP (default is the address after the host address)")
+	addCmd.Flags().StringVar(&dhcpEnd, "dhcp-end", "", "last address handed out by DHCP (default is the last address in the network)")
+	addCmd.Flags().StringVar(&domain, "domain", "", "DNS domain of the network")
+	addCmd.Flags().BoolVar(&isolated, "isolated", false, "do not forward traffic from the network to the outside")
+
+	return addCmd
+}
+
+func networkConfig(name string, cidr string, dhcpStart string, dhcpEnd string) (virter.NetworkConfig, error) {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return virter.NetworkConfig{}, fmt.Errorf("invalid network address: %w", err)
+	}
+
+	config := virter.NetworkConfig{
+		Name:    name,
+		Address: net.IPNet{IP: ip, Mask: ipNet.Mask},
+	}
+
+	if dhcpStart != "" {
+		config.DHCPStart = net.ParseIP(dhcpStart)
+		if config.DHCPStart == nil {
+			return virter.NetworkConfig{}, fmt.Errorf("invalid DHCP start address '%s'", dhcpStart)
+		}
+	}
+
+	if dhcpEnd != "" {
+		config.DHCPEnd = net.ParseIP(dhcpEnd)
+		if config.DHCPEnd == nil {
+			return virter.NetworkConfig{}, fmt.Errorf("invalid DHCP end address '%s'", dhcpEnd)
+		}
+	}
+
+	return config, nil
+}
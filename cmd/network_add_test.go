@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNetworkConfig(t *testing.T) {
+	cases := []struct {
+		cidr        string
+		dhcpStart   string
+		dhcpEnd     string
+		expectIP    string
+		expectStart string
+		expectError bool
+	}{
+		{
+			cidr:     "192.168.130.1/24",
+			expectIP: "192.168.130.1",
+		}, {
+			cidr:        "192.168.130.1/24",
+			dhcpStart:   "192.168.130.100",
+			dhcpEnd:     "192.168.130.200",
+			expectIP:    "192.168.130.1",
+			expectStart: "192.168.130.100",
+		}, {
+			cidr:        "192.168.130.1",
+			expectError: true,
+		}, {
+			cidr:        "192.168.130.1/24",
+			dhcpStart:   "invalid",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		config, err := networkConfig("net", c.cidr, c.dhcpStart, c.dhcpEnd)
+		if !c.expectError && err != nil {
+			t.Errorf("on input '%s':", c.cidr)
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c.expectError && err == nil {
+			t.Errorf("on input '%s':", c.cidr)
+			t.Fatal("expected error, got nil")
+		}
+		if c.expectError {
+			continue
+		}
+
+		if !config.Address.IP.Equal(net.ParseIP(c.expectIP)) {
+			t.Errorf("on input '%s':", c.cidr)
+			t.Fatalf("unexpected address %v", config.Address.IP)
+		}
+		if c.expectStart != "" && !config.DHCPStart.Equal(net.ParseIP(c.expectStart)) {
+			t.Errorf("on input '%s':", c.cidr)
+			t.Fatalf("unexpected DHCP start %v", config.DHCPStart)
+		}
+	}
+}
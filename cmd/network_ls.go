@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func networkLsCommand() *cobra.Command {
+	var output string
+	var reservations bool
+
+	lsCmd := &cobra.Command{
+		Use:   "ls [name...]",
+		Short: "List networks",
+		Long: `List libvirt networks. With --reservations, the DHCP reservations
+in the networks are listed instead, together with the VM IDs they belong to.`,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if err := checkOutputFormat(output); err != nil {
+				log.Fatal(err)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			networks, err := v.NetworkList()
+			if err != nil {
+				log.Fatalf("Error listing networks: %v", err)
+			}
+
+			networks, err = filterNetworks(networks, args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			if output == outputFormatJSON {
+				if err := printJSON(networks); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			if reservations {
+				fmt.Fprintln(w, "NETWORK\tID\tIP\tMAC\tVM")
+				for _, n := range networks {
+					for _, r := range n.Reservations {
+						fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", n.Name, r.ID, r.IP, r.MAC, r.VM)
+					}
+				}
+			} else {
+				fmt.Fprintln(w, "NAME\tSTATE\tFORWARD\tBRIDGE\tADDRESSES\tDOMAIN\tRESERVATIONS")
+				for _, n := range networks {
+					state := "inactive"
+					if n.Active {
+						state = "active"
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", n.Name, state, n.Forward, n.Bridge,
+						strings.Join(n.Addresses, ","), n.Domain, len(n.Reservations))
+				}
+			}
+			w.Flush()
+		},
+	}
+
+	lsCmd.Flags().BoolVarP(&reservations, "reservations", "r", false, "list the DHCP reservations in the networks")
+	lsCmd.Flags().StringVarP(&output, "output", "o", outputFormatTable, `Output format, one of "table" or "json"`)
+
+	return lsCmd
+}
+
+// filterNetworks returns the networks with the given names. If no names are
+// given, all networks are returned.
+func filterNetworks(networks []virter.NetworkInfo, names []string) ([]virter.NetworkInfo, error) {
+	if len(names) == 0 {
+		return networks, nil
+	}
+
+	byName := make(map[string]virter.NetworkInfo, len(networks))
+	for _, n := range networks {
+		byName[n.Name] = n
+	}
+
+	result := make([]virter.NetworkInfo, 0, len(names))
+	for _, name := range names {
+		n, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("network '%s' not found", name)
+		}
+		result = append(result, n)
+	}
+
+	return result, nil
+}
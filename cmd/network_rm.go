@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func networkRmCommand() *cobra.Command {
+	rmCmd := &cobra.Command{
+		Use:   "rm name...",
+		Short: "Remove networks",
+		Long: `Stop and remove one or multiple libvirt networks. Networks which
+VMs are attached to cannot be removed.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			var errs error
+			for _, name := range args {
+				err := v.NetworkRm(name)
+				if err != nil {
+					errs = multierror.Append(errs, fmt.Errorf("failed to remove network '%s': %w", name, err))
+				}
+			}
+			if errs != nil {
+				log.Fatal(errs)
+			}
+		},
+	}
+
+	return rmCmd
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// NICArg represents a network interface that can be passed to virter via a
+// command line argument.
+type NICArg struct {
+	Network string `key:"network" required:"true"`
+	Model   string `key:"model" default:"virtio"`
+	MAC     string `key:"mac" default:""`
+}
+
+func (n *NICArg) GetNetwork() string { return n.Network }
+func (n *NICArg) GetModel() string   { return n.Model }
+func (n *NICArg) GetMAC() string     { return n.MAC }
+
+// Set implements flag.Value.Set.
+func (n *NICArg) Set(str string) error {
+	if len(str) == 0 {
+		return fmt.Errorf("invalid empty network interface specification")
+	}
+
+	params, err := parseArgMap(str)
+	if err != nil {
+		return fmt.Errorf("failed to parse network interface specification: %w", err)
+	}
+
+	params, err = fillDefaultValues(params, NICArg{})
+	if err != nil {
+		return fmt.Errorf("failed to parse network interface specification: %w", err)
+	}
+
+	for k, v := range params {
+		switch k {
+		case "network":
+			n.Network = v
+		case "model":
+			n.Model = v
+		case "mac":
+			n.MAC = v
+		default:
+			log.Debugf("ignoring unknown network interface key: %v", k)
+		}
+	}
+	return nil
+}
+
+// Type implements pflag.Value.Type.
+func (n *NICArg) Type() string { return "nic" }
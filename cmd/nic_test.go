@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestNICArgSet(t *testing.T) {
+	cases := []struct {
+		input       string
+		expect      NICArg
+		expectError bool
+	}{
+		{
+			input:  "network=replication",
+			expect: NICArg{Network: "replication", Model: "virtio"},
+		}, {
+			input:  "network=replication,model=e1000,mac=52:54:00:00:00:01",
+			expect: NICArg{Network: "replication", Model: "e1000", MAC: "52:54:00:00:00:01"},
+		}, {
+			input:       "model=e1000",
+			expectError: true,
+		}, {
+			input:       "",
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		var actual NICArg
+		err := actual.Set(c.input)
+		if !c.expectError && err != nil {
+			t.Errorf("on input '%s':", c.input)
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c.expectError && err == nil {
+			t.Errorf("on input '%s':", c.input)
+			t.Fatal("expected error, got nil")
+		}
+
+		if !c.expectError && actual != c.expect {
+			t.Errorf("on input '%s':", c.input)
+			t.Errorf("expected: %+v", c.expect)
+			t.Errorf("actual: %+v", actual)
+		}
+	}
+}
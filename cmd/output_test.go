@@ -0,0 +1,23 @@
+package cmd
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	cases := []struct {
+		input  uint64
+		expect string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{10 * 1024 * 1024 * 1024, "10.0 GiB"},
+	}
+
+	for _, c := range cases {
+		actual := formatBytes(c.input)
+		if actual != c.expect {
+			t.Errorf("formatBytes(%d): expected '%s', got '%s'", c.input, c.expect, actual)
+		}
+	}
+}
@@ -7,6 +7,9 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/LINBIT/virter/internal/virter"
 )
 
 // potentially injected by makefile
@@ -42,16 +45,23 @@ and resetting, for a stable test environment.`,
 	configName := filepath.Join(configPath(), "virter.toml")
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", fmt.Sprintf("config file (default is %v)", configName))
 	rootCmd.PersistentFlags().StringVarP(&logLevel, "loglevel", "l", defaultLogLevel, "Log level")
+	rootCmd.PersistentFlags().String("connect", "", `libvirt connection URI, e.g. "qemu+ssh://user@host/system" (default from config "libvirt.uri")`)
+	viper.BindPFlag("libvirt.uri", rootCmd.PersistentFlags().Lookup("connect"))
 
 	rootCmd.AddCommand(versionCommand())
 	rootCmd.AddCommand(imageCommand())
 	rootCmd.AddCommand(vmCommand())
+	rootCmd.AddCommand(networkCommand())
 	rootCmd.AddCommand(registryCommand())
 	return rootCmd
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately
 func Execute() {
+	if version != "" {
+		virter.Version = version
+	}
+
 	cobra.OnInitialize(initConfig, initSSHFromConfig)
 
 	if err := rootCommand().Execute(); err != nil {
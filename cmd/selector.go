@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+// selectVMs returns the VM names given as arguments together with the names
+// of all VMs matching the label selector, if one is set.
+func selectVMs(v *virter.Virter, args []string, selector string) ([]string, error) {
+	vmNames := append([]string{}, args...)
+	if selector == "" {
+		return vmNames, nil
+	}
+
+	s, err := virter.ParseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, err := v.VMSelect(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select VMs: %w", err)
+	}
+
+	if len(selected) == 0 {
+		log.Warnf("Selector '%s' does not match any VM", selector)
+	} else {
+		log.Debugf("Selector '%s' matches VMs: %v", selector, selected)
+	}
+
+	seen := make(map[string]bool, len(vmNames))
+	for _, name := range vmNames {
+		seen[name] = true
+	}
+	for _, name := range selected {
+		if !seen[name] {
+			vmNames = append(vmNames, name)
+			seen[name] = true
+		}
+	}
+
+	return vmNames, nil
+}
+
+// addSelectorFlag adds the -L/--selector flag. The shorthand -l, as used by
+// kubectl, is already taken by the global --loglevel flag.
+func addSelectorFlag(cmd *cobra.Command, selector *string) {
+	cmd.Flags().StringVarP(selector, "selector", "L", "", `Select VMs by label, e.g. "role=controller,zone!=a" (-l is --loglevel)`)
+}
+
+// requireVMsOrSelector returns a cobra.PositionalArgs which requires at least
+// one argument unless a selector is set.
+func requireVMsOrSelector(selector *string) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 && *selector == "" {
+			return fmt.Errorf("requires at least one VM name or a selector")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+// sshTunnel forwards local ports through an SSH connection to the libvirt
+// host, so that VMs on a remote host can be reached.
+type sshTunnel struct {
+	connect  func() (*ssh.Client, error)
+	mu       sync.Mutex
+	client   *ssh.Client
+	forwards map[string]string
+}
+
+// newSSHTunnel returns a tunnel which opens the SSH connection using connect
+// when the first port is forwarded.
+func newSSHTunnel(connect func() (*ssh.Client, error)) *sshTunnel {
+	return &sshTunnel{
+		connect:  connect,
+		forwards: make(map[string]string),
+	}
+}
+
+// Forward implements virter.Tunnel
+func (t *sshTunnel) Forward(hostPort string) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if addr, ok := t.forwards[hostPort]; ok {
+		return addr, nil
+	}
+
+	if t.client == nil {
+		client, err := t.connect()
+		if err != nil {
+			return "", fmt.Errorf("could not connect to libvirt host: %w", err)
+		}
+		t.client = client
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("could not listen for forwarding to '%s': %w", hostPort, err)
+	}
+
+	addr := listener.Addr().String()
+	log.Debugf("Forwarding %s to %s on the libvirt host", addr, hostPort)
+	go t.serve(listener, hostPort)
+
+	t.forwards[hostPort] = addr
+	return addr, nil
+}
+
+// Close closes the SSH connection if it was opened.
+func (t *sshTunnel) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client == nil {
+		return nil
+	}
+
+	err := t.client.Close()
+	t.client = nil
+	return err
+}
+
+// closeTunnel closes the connection of a tunnel returned by dialLibvirt.
+func closeTunnel(tunnel virter.Tunnel) error {
+	if closer, ok := tunnel.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (t *sshTunnel) serve(listener net.Listener, hostPort string) {
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer local.Close()
+
+			remote, err := t.client.Dial("tcp", hostPort)
+			if err != nil {
+				log.Debugf("Could not forward to '%s': %v", hostPort, err)
+				return
+			}
+			defer remote.Close()
+
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(remote, local)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(local, remote)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"sync"
 
 	"github.com/docker/docker/client"
+	"github.com/hashicorp/go-multierror"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
@@ -24,13 +26,41 @@ func vmCommand() *cobra.Command {
 
 	vmCmd.AddCommand(vmCommitCommand())
 	vmCmd.AddCommand(vmExecCommand())
+	vmCmd.AddCommand(vmInspectCommand())
+	vmCmd.AddCommand(vmLsCommand())
+	vmCmd.AddCommand(vmRebootCommand())
 	vmCmd.AddCommand(vmRmCommand())
 	vmCmd.AddCommand(vmRunCommand())
+	vmCmd.AddCommand(vmSnapshotCommand())
 	vmCmd.AddCommand(vmSSHCommand())
+	vmCmd.AddCommand(vmStartCommand())
+	vmCmd.AddCommand(vmStopCommand())
 	vmCmd.AddCommand(vmCpCommand())
 	return vmCmd
 }
 
+// forEachVM calls f for all given VMs concurrently and collects the errors.
+func forEachVM(vmNames []string, f func(vmName string) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs error
+
+	for _, vmName := range vmNames {
+		wg.Add(1)
+		go func(vmName string) {
+			defer wg.Done()
+			if err := f(vmName); err != nil {
+				mu.Lock()
+				errs = multierror.Append(errs, err)
+				mu.Unlock()
+			}
+		}(vmName)
+	}
+
+	wg.Wait()
+	return errs
+}
+
 func dockerConnect() (*client.Client, error) {
 	docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+
 	"github.com/LINBIT/virter/pkg/netcopy"
 
 	log "github.com/sirupsen/logrus"
@@ -9,11 +11,14 @@ import (
 )
 
 func vmCpCommand() *cobra.Command {
+	var selector string
+
 	sshCmd := &cobra.Command{
 		Use:   "cp [HOST:]SRC... [HOST:]DEST",
 		Short: "Copy files and directories from and to VM",
-		Long:  `Copy files and directories from and to VM`,
-		Args:  cobra.MinimumNArgs(2),
+		Long: `Copy files and directories from and to VM. If a selector is
+given, the local sources are copied to DEST on every selected VM.`,
+		Args: cobra.MinimumNArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 			v, err := VirterConnect()
 			if err != nil {
@@ -26,10 +31,36 @@ func vmCpCommand() *cobra.Command {
 
 			copier := netcopy.NewRsyncNetworkCopier(getPrivateKeyPath())
 
-			if err := v.VMExecCopy(context.TODO(), copier, sourceSpec, destSpec); err != nil {
+			if selector == "" {
+				if err := v.VMExecCopy(context.TODO(), copier, sourceSpec, destSpec); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			dest := netcopy.ParseHostPath(destSpec)
+			if !dest.Local() {
+				log.Fatal("DEST must not contain a host when using a selector")
+			}
+
+			vmNames, err := selectVMs(v, nil, selector)
+			if err != nil {
 				log.Fatal(err)
 			}
+			if len(vmNames) == 0 {
+				log.Fatalf("No VMs match selector '%s'", selector)
+			}
+
+			for _, vmName := range vmNames {
+				vmDest := fmt.Sprintf("%s:%s", vmName, dest.Path)
+				if err := v.VMExecCopy(context.TODO(), copier, sourceSpec, vmDest); err != nil {
+					log.Fatal(err)
+				}
+			}
 		},
 	}
+
+	addSelectorFlag(sshCmd, &selector)
+
 	return sshCmd
 }
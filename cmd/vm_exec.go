@@ -10,23 +10,50 @@ import (
 	"github.com/LINBIT/virter/pkg/netcopy"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 func vmExecCommand() *cobra.Command {
 	var provisionFile string
 	var provisionOverrides []string
+	var selector string
+	var transport string
 
 	execCmd := &cobra.Command{
-		Use:   "exec vm_name [vm_name...]",
+		Use:   "exec [vm_name...]",
 		Short: "Run a Docker container against a VM",
-		Long:  `Run a Docker container on the host with a connection to a VM.`,
-		Args:  cobra.MinimumNArgs(1),
+		Long: `Run a Docker container on the host with a connection to a VM.
+The virtual machines can be given by name or selected by their labels.
+
+Shell steps are run via SSH by default. With "--transport agent", they are
+run by the QEMU guest agent instead, which works when SSH is not (yet)
+usable. This requires VMs started with "--guest-agent".`,
+		Args: requireVMsOrSelector(&selector),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if transport != shellTransportSSH && transport != shellTransportAgent {
+				log.Fatalf("Invalid transport '%s', must be '%s' or '%s'", transport, shellTransportSSH, shellTransportAgent)
+			}
+		},
 		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			vmNames, err := selectVMs(v, args, selector)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(vmNames) == 0 {
+				log.Fatalf("No VMs match selector '%s'", selector)
+			}
+
 			provOpt := virter.ProvisionOption{
 				FilePath:  provisionFile,
 				Overrides: provisionOverrides,
 			}
-			if err := execProvision(provOpt, args); err != nil {
+			if err := execProvision(v, provOpt, vmNames, transport); err != nil {
 				log.Fatal(err)
 			}
 		},
@@ -34,44 +61,51 @@ func vmExecCommand() *cobra.Command {
 
 	execCmd.Flags().StringVarP(&provisionFile, "provision", "p", "", "name of toml file containing provisioning steps")
 	execCmd.Flags().StringSliceVarP(&provisionOverrides, "set", "s", []string{}, "set/override provisioning steps")
+	execCmd.Flags().StringVar(&transport, "transport", shellTransportSSH, `transport for shell steps, "ssh" or "agent"`)
+	addSelectorFlag(execCmd, &selector)
 
 	return execCmd
 }
 
-func execProvision(provOpt virter.ProvisionOption, vmNames []string) error {
+// transports for running shell steps
+const (
+	shellTransportSSH   = "ssh"
+	shellTransportAgent = "agent"
+)
+
+func execProvision(v *virter.Virter, provOpt virter.ProvisionOption, vmNames []string, shellTransport string) error {
 	pc, err := virter.NewProvisionConfig(provOpt)
 	if err != nil {
 		return err
 	}
-	v, err := VirterConnect()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer v.ForceDisconnect()
 
-	for _, s := range pc.Steps {
-		if s.Docker != nil {
-			if err := execDocker(v, s.Docker, vmNames); err != nil {
-				return err
-			}
-		} else if s.Shell != nil {
-			if err := execShell(v, s.Shell, vmNames); err != nil {
-				return err
-			}
-		} else if s.Rsync != nil {
-			if err := execRsync(v, s.Rsync, vmNames); err != nil {
-				return err
-			}
-		}
-	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	registerSignals(ctx, cancel)
+
+	return v.Provision(ctx, pc, vmNames, func(ctx context.Context, s virter.ProvisionStep, vmNames []string) error {
+		return execProvisionStep(ctx, v, s, vmNames, shellTransport)
+	})
+}
 
+func execProvisionStep(ctx context.Context, v *virter.Virter, s virter.ProvisionStep, vmNames []string, shellTransport string) error {
+	if s.Docker != nil {
+		return execDocker(ctx, v, s.Docker, vmNames)
+	} else if s.Shell != nil {
+		return execShell(ctx, v, s.Shell, vmNames, shellTransport)
+	} else if s.Rsync != nil {
+		return execRsync(ctx, v, s.Rsync, vmNames)
+	} else if s.Ansible != nil {
+		return execAnsible(ctx, v, s.Ansible, vmNames)
+	} else if s.Fetch != nil {
+		return execFetch(ctx, v, s.Fetch, vmNames)
+	}
 	return nil
 }
 
-func execDocker(v *virter.Virter, s *virter.ProvisionDockerStep, vmNames []string) error {
-	ctx, cancel := dockerContext()
+func execDocker(ctx context.Context, v *virter.Virter, s *virter.ProvisionDockerStep, vmNames []string) error {
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("time.docker_timeout"))
 	defer cancel()
-	registerSignals(ctx, cancel)
 
 	docker, err := dockerConnect()
 	if err != nil {
@@ -93,17 +127,36 @@ func execDocker(v *virter.Virter, s *virter.ProvisionDockerStep, vmNames []strin
 	return v.VMExecDocker(ctx, docker, vmNames, dockerContainerConfig, privateKey)
 }
 
-func execShell(v *virter.Virter, s *virter.ProvisionShellStep, vmNames []string) error {
+func execShell(ctx context.Context, v *virter.Virter, s *virter.ProvisionShellStep, vmNames []string, transport string) error {
+	if transport == shellTransportAgent {
+		return v.VMExecShellAgent(ctx, vmNames, s)
+	}
+
+	privateKey, err := loadPrivateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return v.VMExecShell(ctx, vmNames, privateKey, s)
+}
+
+func execAnsible(ctx context.Context, v *virter.Virter, s *virter.ProvisionAnsibleStep, vmNames []string) error {
 	privateKey, err := loadPrivateKey()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return v.VMExecShell(context.TODO(), vmNames, privateKey, s)
+	return v.VMExecAnsible(ctx, vmNames, privateKey, s)
+}
+
+func execRsync(ctx context.Context, v *virter.Virter, s *virter.ProvisionRsyncStep, vmNames []string) error {
+	privateKeyPath := getPrivateKeyPath()
+	copier := netcopy.NewRsyncNetworkCopier(privateKeyPath)
+	return v.VMExecRsync(ctx, copier, vmNames, s)
 }
 
-func execRsync(v *virter.Virter, s *virter.ProvisionRsyncStep, vmNames []string) error {
+func execFetch(ctx context.Context, v *virter.Virter, s *virter.ProvisionFetchStep, vmNames []string) error {
 	privateKeyPath := getPrivateKeyPath()
 	copier := netcopy.NewRsyncNetworkCopier(privateKeyPath)
-	return v.VMExecRsync(context.TODO(), copier, vmNames, s)
+	return v.VMExecFetch(ctx, copier, vmNames, s)
 }
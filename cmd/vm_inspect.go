@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func vmInspectCommand() *cobra.Command {
+	inspectCmd := &cobra.Command{
+		Use:   "inspect vm_name",
+		Short: "Show details of a virtual machine",
+		Long: `Show the information virter recorded when creating a virtual
+machine and the addresses of its network interfaces, in JSON format.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			meta, err := v.VMInspect(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			interfaces, err := v.VMInterfaces(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			info := struct {
+				*virter.VMMetadata
+				Interfaces []virter.VMInterface `json:"interfaces"`
+			}{meta, interfaces}
+
+			if err := printJSON(info); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	return inspectCmd
+}
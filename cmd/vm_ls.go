@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func vmLsCommand() *cobra.Command {
+	var output string
+	var selector string
+
+	lsCmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List virtual machines",
+		Long:  `List all virtual machines that were created by virter.`,
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if err := checkOutputFormat(output); err != nil {
+				log.Fatal(err)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			vms, err := v.VMList()
+			if err != nil {
+				log.Fatalf("Error listing VMs: %v", err)
+			}
+
+			if selector != "" {
+				s, err := virter.ParseLabelSelector(selector)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				selected := []virter.VMInfo{}
+				for _, vm := range vms {
+					if s.Matches(vm.Labels) {
+						selected = append(selected, vm)
+					}
+				}
+				vms = selected
+			}
+
+			if output == outputFormatJSON {
+				if err := printJSON(vms); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tID\tIP\tIMAGE\tSTATE\tLABELS")
+			for _, vm := range vms {
+				state := "shut off"
+				if vm.Running {
+					state = "running"
+				}
+				ip := vm.IP
+				if vm.SSHPort != 0 {
+					ip = net.JoinHostPort(vm.IP, strconv.Itoa(int(vm.SSHPort)))
+				} else if len(vm.IPs) > 0 {
+					ip = strings.Join(vm.IPs, ",")
+				}
+				fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", vm.Name, vm.ID, ip, vm.Image, state, formatLabels(vm.Labels))
+			}
+			w.Flush()
+		},
+	}
+
+	addSelectorFlag(lsCmd, &selector)
+	lsCmd.Flags().StringVarP(&output, "output", "o", outputFormatTable, `Output format, one of "table" or "json"`)
+
+	return lsCmd
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func vmRebootCommand() *cobra.Command {
+	var selector string
+
+	rebootCmd := &cobra.Command{
+		Use:   "reboot [vm_name...]",
+		Short: "Reboot virtual machines",
+		Long:  `Reboot one or multiple running virtual machines.`,
+		Args:  requireVMsOrSelector(&selector),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			vmNames, err := selectVMs(v, args, selector)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			err = forEachVM(vmNames, func(vmName string) error {
+				if err := v.VMReboot(vmName); err != nil {
+					return fmt.Errorf("failed to reboot VM '%s': %w", vmName, err)
+				}
+				return nil
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	addSelectorFlag(rebootCmd, &selector)
+
+	return rebootCmd
+}
@@ -23,11 +23,14 @@ func rmMultiple(v *virter.Virter, vms []string) error {
 }
 
 func vmRmCommand() *cobra.Command {
+	var selector string
+
 	rmCmd := &cobra.Command{
-		Use:   "rm vm_name [vm_name...]",
+		Use:   "rm [vm_name...]",
 		Short: "Remove virtual machines",
-		Long:  `Remove one or multiple virtual machines including all data.`,
-		Args:  cobra.MinimumNArgs(1),
+		Long: `Remove one or multiple virtual machines including all data.
+The virtual machines can be given by name or selected by their labels.`,
+		Args: requireVMsOrSelector(&selector),
 		Run: func(cmd *cobra.Command, args []string) {
 			v, err := VirterConnect()
 			if err != nil {
@@ -35,12 +38,19 @@ func vmRmCommand() *cobra.Command {
 			}
 			defer v.ForceDisconnect()
 
-			err = rmMultiple(v, args)
+			vmNames, err := selectVMs(v, args, selector)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			err = rmMultiple(v, vmNames)
 			if err != nil {
 				log.Fatal(err)
 			}
 		},
 	}
 
+	addSelectorFlag(rmCmd, &selector)
+
 	return rmCmd
 }
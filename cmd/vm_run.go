@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
@@ -82,11 +84,40 @@ func pullIfNotExists(v *virter.Virter, imageName string) error {
 	return nil
 }
 
+// vmRunNameAndID returns the name and ID of the i-th VM started by vm run. If
+// the ID is chosen automatically, it is 0 and the name is empty unless it is
+// set explicitly; the VM is then named after the prefix and its ID.
+func vmRunNameAndID(vmName, imageName string, countSet bool, vmID, i uint) (string, string, uint) {
+	var id uint
+	if vmID != 0 {
+		id = vmID + i
+	}
+
+	if vmName != "" && !countSet {
+		// use the supplied name if --count is the default (1)
+		return vmName, "", id
+	}
+
+	// if the name is not set, use image name + id, if the count is set
+	// explicitly, use the supplied name + id
+	prefix := imageName
+	if vmName != "" {
+		prefix = vmName
+	}
+
+	if id == 0 {
+		return "", prefix, 0
+	}
+	return fmt.Sprintf("%s-%d", prefix, id), "", id
+}
+
 func vmRunCommand() *cobra.Command {
 	var vmName string
 	var vmID uint
 	var count uint
 	var waitSSH bool
+	var waitCloudInit bool
+	var guestAgent bool
 
 	var mem *unit.Value
 	var memKiB uint64
@@ -101,9 +132,18 @@ func vmRunCommand() *cobra.Command {
 	var diskStrings []string
 	var disks []virter.Disk
 
+	var nicStrings []string
+	var nics []virter.NIC
+
 	var provisionFile string
 	var provisionOverrides []string
 
+	var labelStrings []string
+	var labels map[string]string
+
+	var ciFiles cloudInitFiles
+	var cloudInit virter.CloudInitData
+
 	runCmd := &cobra.Command{
 		Use:   "run image",
 		Short: "Start a virtual machine with a given image",
@@ -121,6 +161,26 @@ func vmRunCommand() *cobra.Command {
 				}
 				disks = append(disks, &d)
 			}
+
+			for _, s := range nicStrings {
+				var n NICArg
+				err := n.Set(s)
+				if err != nil {
+					log.Fatalf("Invalid network interface: %v", err)
+				}
+				nics = append(nics, &n)
+			}
+
+			var err error
+			labels, err = virter.ParseLabels(labelStrings)
+			if err != nil {
+				log.Fatalf("Invalid label: %v", err)
+			}
+
+			cloudInit, err = ciFiles.load()
+			if err != nil {
+				log.Fatalf("Invalid cloud-init data: %v", err)
+			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
 			v, err := VirterConnect()
@@ -155,64 +215,85 @@ func vmRunCommand() *cobra.Command {
 			provision := provisionFile != "" || len(provisionOverrides) > 0
 
 			// if we want to run some provisioning steps later,
-			// it doesn't make sense not to wait for SSH.
+			// it doesn't make sense not to wait for SSH and for
+			// cloud-init to finish setting up the VM.
 			if provision {
 				waitSSH = true
+				waitCloudInit = true
 			}
 
-			var g errgroup.Group
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			registerSignals(ctx, cancel)
+
+			// the first failure cancels the creation of the other VMs
+			g, gctx := errgroup.WithContext(ctx)
 			var i uint
 
 			// save the VM names in case we want to provision later
 			vmNames := make([]string, count)
+
+			// remember the VMs that were started successfully so that
+			// they can be removed if another one fails
+			var startedMu sync.Mutex
+			var started []string
+
 			for i = 0; i < count; i++ {
 				i := i
-				id := vmID + i
+				thisVMName, namePrefix, id := vmRunNameAndID(vmName, imageName, cmd.Flags().Changed("count"), vmID, i)
 				g.Go(func() error {
-					var thisVMName string
-					if vmName == "" {
-						// if the name is not set, use image name + id
-						thisVMName = fmt.Sprintf("%s-%d", imageName, id)
-					} else if !cmd.Flags().Changed("count") {
-						// if it is set, use the supplied name if
-						// --count is the default (1)
-						thisVMName = vmName
-					} else {
-						// if the count is set explicitly, use the
-						// supplied name and the id
-						thisVMName = fmt.Sprintf("%s-%d", vmName, id)
+					consoleName := thisVMName
+					if consoleName == "" {
+						// the ID and thus the name are not known yet
+						consoleName = fmt.Sprintf("%s-count-%d", namePrefix, i)
 					}
-					vmNames[i] = thisVMName
-
-					consolePath, err := createConsoleFile(consoleDir, thisVMName)
+					consolePath, err := createConsoleFile(consoleDir, consoleName)
 					if err != nil {
-						log.Fatalf("Error while creating console file: %v", err)
+						return fmt.Errorf("Error while creating console file: %w", err)
 					}
 
 					c := virter.VMConfig{
-						ImageName:       imageName,
-						Name:            thisVMName,
-						MemoryKiB:       memKiB,
-						BootCapacityKiB: bootCapacityKiB,
-						VCPUs:           vcpus,
-						ID:              id,
-						SSHPublicKeys:   publicKeys,
-						SSHPrivateKey:   privateKey,
-						WaitSSH:         waitSSH,
-						SSHPingCount:    viper.GetInt("time.ssh_ping_count"),
-						SSHPingPeriod:   viper.GetDuration("time.ssh_ping_period"),
-						ConsolePath:     consolePath,
-						Disks:           disks,
+						ImageName:        imageName,
+						Name:             thisVMName,
+						NamePrefix:       namePrefix,
+						MemoryKiB:        memKiB,
+						BootCapacityKiB:  bootCapacityKiB,
+						VCPUs:            vcpus,
+						ID:               id,
+						SSHPublicKeys:    publicKeys,
+						SSHPrivateKey:    privateKey,
+						WaitSSH:          waitSSH,
+						SSHPingCount:     viper.GetInt("time.ssh_ping_count"),
+						SSHPingPeriod:    viper.GetDuration("time.ssh_ping_period"),
+						WaitCloudInit:    waitCloudInit,
+						CloudInitTimeout: viper.GetDuration("time.cloud_init_timeout"),
+						ConsolePath:      consolePath,
+						GuestAgent:       guestAgent,
+						Disks:            disks,
+						ExtraNICs:        nics,
+						Labels:           labels,
+						CloudInit:        cloudInit,
 					}
 
-					err = v.VMRun(SSHClientBuilder{}, c)
+					thisVMName, err = v.VMRunAutoName(gctx, SSHClientBuilder{}, c)
 					if err != nil {
-						return fmt.Errorf("Failed to start VM %d: %w", id, err)
+						return fmt.Errorf("Failed to start VM %d: %w", i, err)
 					}
+					vmNames[i] = thisVMName
+
+					startedMu.Lock()
+					started = append(started, thisVMName)
+					startedMu.Unlock()
 					return nil
 				})
 			}
 			if err := g.Wait(); err != nil {
+				if len(started) > 0 {
+					log.Warnf("Removing VMs started by this invocation: %v", started)
+					if rmErr := rmMultiple(v, started); rmErr != nil {
+						log.Errorf("Failed to remove VMs: %v", rmErr)
+					}
+				}
 				log.Fatal(err)
 			}
 
@@ -221,7 +302,7 @@ func vmRunCommand() *cobra.Command {
 					FilePath:  provisionFile,
 					Overrides: provisionOverrides,
 				}
-				if err := execProvision(provOpt, vmNames); err != nil {
+				if err := execProvision(v, provOpt, vmNames, shellTransportSSH); err != nil {
 					log.Fatal(err)
 				}
 			}
@@ -229,10 +310,11 @@ func vmRunCommand() *cobra.Command {
 	}
 
 	runCmd.Flags().StringVarP(&vmName, "name", "n", "", "name of new VM")
-	runCmd.Flags().UintVarP(&vmID, "id", "", 0, "ID for VM which determines the IP address")
-	runCmd.MarkFlagRequired("id")
+	runCmd.Flags().UintVarP(&vmID, "id", "", 0, "ID for VM which determines the IP address, chosen automatically if not set. With --count, the IDs of the VMs start at this ID")
 	runCmd.Flags().UintVar(&count, "count", 1, "Number of VMs to start")
 	runCmd.Flags().BoolVarP(&waitSSH, "wait-ssh", "w", false, "whether to wait for SSH port (default false)")
+	runCmd.Flags().BoolVar(&waitCloudInit, "wait-cloud-init", false, "whether to wait for cloud-init to finish after the SSH port is reachable, implies --wait-ssh (default false, true when provisioning)")
+	runCmd.Flags().BoolVar(&guestAgent, "guest-agent", false, "add a channel for the QEMU guest agent, which must be installed in the image (default false)")
 	u := unit.MustNewUnit(sizeUnits)
 	mem = u.MustNewValue(1*sizeUnits["G"], unit.None)
 	runCmd.Flags().VarP(mem, "memory", "m", "Set amount of memory for the VM")
@@ -248,8 +330,11 @@ func vmRunCommand() *cobra.Command {
 	// If this ever gets implemented in pflag , we will be able to solve this
 	// in a much smoother way.
 	runCmd.Flags().StringArrayVarP(&diskStrings, "disk", "d", []string{}, `Add a disk to the VM. Format: "name=disk1,size=100MiB,format=qcow2,bus=virtio". Can be specified multiple times`)
+	runCmd.Flags().StringArrayVar(&nicStrings, "nic", []string{}, `Add a network interface to the VM in addition to the one on the configured network. Format: "network=replication,model=virtio,mac=52:54:00:00:00:01". Can be specified multiple times`)
 	runCmd.Flags().StringVarP(&provisionFile, "provision", "p", "", "name of toml file containing provisioning steps")
 	runCmd.Flags().StringSliceVarP(&provisionOverrides, "set", "s", []string{}, "set/override provisioning steps")
+	runCmd.Flags().StringArrayVar(&labelStrings, "label", []string{}, `Add a label to the VM. Format: "key=value". Can be specified multiple times`)
+	addCloudInitFlags(runCmd, &ciFiles)
 
 	return runCmd
 }
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestVMRunNameAndID(t *testing.T) {
+	cases := []struct {
+		descr    string
+		vmName   string
+		countSet bool
+		vmID     uint
+		i        uint
+		name     string
+		prefix   string
+		id       uint
+	}{
+		{"name and id", "vm", false, 10, 0, "vm", "", 10},
+		{"name without id", "vm", false, 0, 0, "vm", "", 0},
+		{"no name", "", false, 10, 0, "img-10", "", 10},
+		{"no name without id", "", false, 0, 0, "", "img", 0},
+		{"count with id", "vm", true, 10, 1, "vm-11", "", 11},
+		{"count without id", "vm", true, 0, 0, "", "vm", 0},
+		{"count without id second VM", "vm", true, 0, 1, "", "vm", 0},
+		{"count without name and id", "", true, 0, 1, "", "img", 0},
+	}
+
+	for _, c := range cases {
+		name, prefix, id := vmRunNameAndID(c.vmName, "img", c.countSet, c.vmID, c.i)
+		if name != c.name || prefix != c.prefix || id != c.id {
+			t.Errorf("%s: expected name '%s', prefix '%s', ID %d, got '%s', '%s', %d",
+				c.descr, c.name, c.prefix, c.id, name, prefix, id)
+		}
+	}
+}
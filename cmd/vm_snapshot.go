@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func vmSnapshotCommand() *cobra.Command {
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Virtual machine snapshot related subcommands",
+		Long:  `Virtual machine snapshot related subcommands.`,
+	}
+
+	snapshotCmd.AddCommand(vmSnapshotCreateCommand())
+	snapshotCmd.AddCommand(vmSnapshotLsCommand())
+	snapshotCmd.AddCommand(vmSnapshotRevertCommand())
+	snapshotCmd.AddCommand(vmSnapshotRmCommand())
+	return snapshotCmd
+}
+
+// requireSnapshotAndVMsOrSelector returns a cobra.PositionalArgs which
+// requires a snapshot name followed by at least one VM name unless a
+// selector is set.
+func requireSnapshotAndVMsOrSelector(selector *string) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("requires a snapshot name")
+		}
+		return requireVMsOrSelector(selector)(cmd, args[1:])
+	}
+}
+
+// snapshotMultiple runs a snapshot operation on all given VMs concurrently.
+func snapshotMultiple(args []string, selector string, verb string, f func(v *virter.Virter, vmName, snapshotName string) error) {
+	v, err := VirterConnect()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer v.ForceDisconnect()
+
+	snapshotName := args[0]
+	vmNames, err := selectVMs(v, args[1:], selector)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = forEachVM(vmNames, func(vmName string) error {
+		if err := f(v, vmName, snapshotName); err != nil {
+			return fmt.Errorf("failed to %s snapshot '%s' of VM '%s': %w", verb, snapshotName, vmName, err)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func vmSnapshotCreateCommand() *cobra.Command {
+	var selector string
+	var opts virter.SnapshotOptions
+
+	createCmd := &cobra.Command{
+		Use:   "create snapshot_name [vm_name...]",
+		Short: "Take a snapshot of virtual machines",
+		Long: `Take a snapshot of the boot volume and the additional disks of one or
+multiple virtual machines. Internal snapshots are stored inside the volumes
+and include the memory state if the VM is running. External snapshots store
+the changes made after the snapshot in new overlay files.`,
+		Args: requireSnapshotAndVMsOrSelector(&selector),
+		Run: func(cmd *cobra.Command, args []string) {
+			snapshotMultiple(args, selector, "create", func(v *virter.Virter, vmName, snapshotName string) error {
+				return v.VMSnapshotCreate(vmName, snapshotName, opts)
+			})
+		},
+	}
+
+	addSelectorFlag(createCmd, &selector)
+	createCmd.Flags().BoolVar(&opts.External, "external", false, "Create an external disk-only snapshot using overlay files")
+	createCmd.Flags().BoolVar(&opts.Memory, "memory", false, "Include the memory state of the running VM")
+
+	return createCmd
+}
+
+func vmSnapshotLsCommand() *cobra.Command {
+	var output string
+
+	lsCmd := &cobra.Command{
+		Use:   "ls vm_name",
+		Short: "List snapshots of a virtual machine",
+		Long:  `List the snapshots of a virtual machine, oldest first.`,
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if err := checkOutputFormat(output); err != nil {
+				log.Fatal(err)
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			snapshots, err := v.VMSnapshotList(args[0])
+			if err != nil {
+				log.Fatalf("Error listing snapshots: %v", err)
+			}
+
+			if output == outputFormatJSON {
+				if err := printJSON(snapshots); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tPARENT\tCREATED\tSTATE\tTYPE\tMEMORY")
+			for _, s := range snapshots {
+				kind := "internal"
+				if s.External {
+					kind = "external"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Name, s.Parent, formatTime(s.Created), s.State, kind, yesNo(s.Memory))
+			}
+			w.Flush()
+		},
+	}
+
+	lsCmd.Flags().StringVarP(&output, "output", "o", outputFormatTable, `Output format, one of "table" or "json"`)
+
+	return lsCmd
+}
+
+func vmSnapshotRevertCommand() *cobra.Command {
+	var selector string
+
+	revertCmd := &cobra.Command{
+		Use:     "revert snapshot_name [vm_name...]",
+		Aliases: []string{"restore"},
+		Short:   "Revert virtual machines to a snapshot",
+		Long: `Revert one or multiple virtual machines to an internal snapshot. A VM
+that was running when the snapshot was taken is running again afterwards.`,
+		Args: requireSnapshotAndVMsOrSelector(&selector),
+		Run: func(cmd *cobra.Command, args []string) {
+			snapshotMultiple(args, selector, "revert to", func(v *virter.Virter, vmName, snapshotName string) error {
+				return v.VMSnapshotRevert(vmName, snapshotName)
+			})
+		},
+	}
+
+	addSelectorFlag(revertCmd, &selector)
+
+	return revertCmd
+}
+
+func vmSnapshotRmCommand() *cobra.Command {
+	var selector string
+
+	rmCmd := &cobra.Command{
+		Use:   "rm snapshot_name [vm_name...]",
+		Short: "Remove a snapshot of virtual machines",
+		Long: `Remove an internal snapshot of one or multiple virtual machines.
+External snapshots are removed together with the VM.`,
+		Args: requireSnapshotAndVMsOrSelector(&selector),
+		Run: func(cmd *cobra.Command, args []string) {
+			snapshotMultiple(args, selector, "remove", func(v *virter.Virter, vmName, snapshotName string) error {
+				return v.VMSnapshotRm(vmName, snapshotName)
+			})
+		},
+	}
+
+	addSelectorFlag(rmCmd, &selector)
+
+	return rmCmd
+}
@@ -8,11 +8,20 @@ import (
 )
 
 func vmSSHCommand() *cobra.Command {
+	var selector string
+
 	sshCmd := &cobra.Command{
-		Use:   "ssh vm_name",
+		Use:   "ssh [vm_name]",
 		Short: "Run an interactive ssh shell in a VM",
-		Long:  `Run an interactive ssh shell in a VM.`,
-		Args:  cobra.ExactArgs(1),
+		Long: `Run an interactive ssh shell in a VM. The VM can be given by
+name or selected by its labels, in which case the selector must match
+exactly one VM.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if selector != "" {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			v, err := VirterConnect()
 			if err != nil {
@@ -20,15 +29,26 @@ func vmSSHCommand() *cobra.Command {
 			}
 			defer v.ForceDisconnect()
 
+			vmNames, err := selectVMs(v, args, selector)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(vmNames) != 1 {
+				log.Fatalf("Selector '%s' must match exactly one VM, matched %d", selector, len(vmNames))
+			}
+
 			privateKey, err := loadPrivateKey()
 			if err != nil {
 				log.Fatal(err)
 			}
 
-			if err := v.VMSSHSession(context.TODO(), args[0], privateKey); err != nil {
+			if err := v.VMSSHSession(context.TODO(), vmNames[0], privateKey); err != nil {
 				log.Fatal(err)
 			}
 		},
 	}
+
+	addSelectorFlag(sshCmd, &selector)
+
 	return sshCmd
 }
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/LINBIT/virter/internal/virter"
+)
+
+func vmStartCommand() *cobra.Command {
+	var selector string
+	var waitSSH bool
+
+	startCmd := &cobra.Command{
+		Use:   "start [vm_name...]",
+		Short: "Start stopped virtual machines",
+		Long:  `Start one or multiple virtual machines that were stopped.`,
+		Args:  requireVMsOrSelector(&selector),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			vmNames, err := selectVMs(v, args, selector)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			var privateKey []byte
+			if waitSSH {
+				privateKey, err = loadPrivateKey()
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			registerSignals(ctx, cancel)
+
+			err = forEachVM(vmNames, func(vmName string) error {
+				c := virter.VMConfig{
+					Name:          vmName,
+					SSHPrivateKey: privateKey,
+					WaitSSH:       waitSSH,
+					SSHPingCount:  viper.GetInt("time.ssh_ping_count"),
+					SSHPingPeriod: viper.GetDuration("time.ssh_ping_period"),
+				}
+
+				if err := v.VMStart(ctx, SSHClientBuilder{}, c); err != nil {
+					return fmt.Errorf("failed to start VM '%s': %w", vmName, err)
+				}
+				return nil
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	addSelectorFlag(startCmd, &selector)
+	startCmd.Flags().BoolVarP(&waitSSH, "wait-ssh", "w", false, "whether to wait for SSH port (default false)")
+
+	return startCmd
+}
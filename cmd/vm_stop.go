@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/LINBIT/virter/pkg/actualtime"
+)
+
+func vmStopCommand() *cobra.Command {
+	var selector string
+
+	stopCmd := &cobra.Command{
+		Use:   "stop [vm_name...]",
+		Short: "Stop virtual machines",
+		Long: `Shut down one or multiple virtual machines. A virtual machine that
+does not shut down within the configured shutdown timeout is forcefully
+stopped.`,
+		Args: requireVMsOrSelector(&selector),
+		Run: func(cmd *cobra.Command, args []string) {
+			v, err := VirterConnect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer v.ForceDisconnect()
+
+			vmNames, err := selectVMs(v, args, selector)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			shutdownTimeout := viper.GetDuration("time.shutdown_timeout")
+
+			err = forEachVM(vmNames, func(vmName string) error {
+				if err := v.VMStop(actualtime.ActualTime{}, vmName, shutdownTimeout); err != nil {
+					return fmt.Errorf("failed to stop VM '%s': %w", vmName, err)
+				}
+				return nil
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	addSelectorFlag(stopCmd, &selector)
+
+	return stopCmd
+}
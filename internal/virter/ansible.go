@@ -0,0 +1,182 @@
+package virter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// ansibleSSHArgs disable host key checking, because the host keys of the VMs
+// change whenever a VM is recreated
+const ansibleSSHArgs = "-o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
+
+// ansibleInventory generates a YAML inventory containing the VMs, which are
+// reached at the given SSH addresses, in the group "all" and in the groups of
+// the step.
+func ansibleInventory(vmNames []string, hostPorts []string, sshPrivateKeyPath string, step *ProvisionAnsibleStep) ([]byte, error) {
+	hosts := map[string]map[string]interface{}{}
+	for i, vmName := range vmNames {
+		host, port, err := net.SplitHostPort(hostPorts[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSH address '%s' of VM '%s': %w", hostPorts[i], vmName, err)
+		}
+
+		vars := map[string]interface{}{}
+		for k, v := range step.HostVars[vmName] {
+			vars[k] = v
+		}
+		vars["ansible_host"] = host
+		vars["ansible_port"] = port
+		vars["ansible_user"] = "root"
+		vars["ansible_ssh_private_key_file"] = sshPrivateKeyPath
+		vars["ansible_ssh_common_args"] = ansibleSSHArgs
+		hosts[vmName] = vars
+	}
+
+	children := map[string]interface{}{}
+	for group, members := range step.Groups {
+		groupHosts := map[string]interface{}{}
+		for _, vmName := range members {
+			// the same file may be used for different sets of VMs
+			if _, ok := hosts[vmName]; !ok {
+				log.Debugf("Ignoring VM '%s' in Ansible group '%s', it is not provisioned", vmName, group)
+				continue
+			}
+			groupHosts[vmName] = nil
+		}
+		children[group] = map[string]interface{}{"hosts": groupHosts}
+	}
+
+	all := map[string]interface{}{"hosts": hosts}
+	if len(children) > 0 {
+		all["children"] = children
+	}
+
+	inventory, err := yaml.Marshal(map[string]interface{}{"all": all})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode Ansible inventory: %w", err)
+	}
+
+	return inventory, nil
+}
+
+// ansibleArgs returns the arguments for ansible-playbook.
+func ansibleArgs(step *ProvisionAnsibleStep, inventoryPath, extraVarsPath string) []string {
+	args := []string{"--inventory", inventoryPath}
+	if len(step.ExtraVars) > 0 {
+		args = append(args, "--extra-vars", "@"+extraVarsPath)
+	}
+	args = append(args, step.Args...)
+	return append(args, step.Playbook)
+}
+
+// VMExecAnsible runs an Ansible playbook on the host against some VMs.
+func (v *Virter) VMExecAnsible(ctx context.Context, vmNames []string, sshPrivateKey []byte, step *ProvisionAnsibleStep) error {
+	if step.Playbook == "" {
+		return fmt.Errorf("no Ansible playbook given")
+	}
+
+	hostPorts, err := v.getSSHAddresses(vmNames)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "virter-ansible-")
+	if err != nil {
+		return fmt.Errorf("could not create directory for Ansible: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "id_rsa")
+	err = ioutil.WriteFile(keyPath, sshPrivateKey, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write SSH key for Ansible: %w", err)
+	}
+
+	inventory, err := ansibleInventory(vmNames, hostPorts, keyPath, step)
+	if err != nil {
+		return err
+	}
+
+	inventoryPath := filepath.Join(dir, "inventory.yml")
+	err = ioutil.WriteFile(inventoryPath, inventory, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write Ansible inventory: %w", err)
+	}
+
+	extraVars, err := json.Marshal(step.ExtraVars)
+	if err != nil {
+		return fmt.Errorf("could not encode Ansible extra vars: %w", err)
+	}
+
+	extraVarsPath := filepath.Join(dir, "extra-vars.json")
+	err = ioutil.WriteFile(extraVarsPath, extraVars, 0600)
+	if err != nil {
+		return fmt.Errorf("could not write Ansible extra vars: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "ansible-playbook", ansibleArgs(step, inventoryPath, extraVarsPath)...)
+	cmd.Env = append(os.Environ(), EnvmapToSlice(step.Env)...)
+
+	outp, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	errp, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Provisioning via Ansible: %s on %v", step.Playbook, vmNames)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not run ansible-playbook: %w", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go ansibleLogLines(&wg, vmNames, false, outp)
+	go ansibleLogLines(&wg, vmNames, true, errp)
+	wg.Wait()
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("ansible-playbook failed: %w", err)
+	}
+
+	return nil
+}
+
+// ansibleLogLines logs the output of ansible-playbook like logLines. Lines
+// with the result of a task for a host, such as "ok: [vm]", are attributed to
+// that VM.
+func ansibleLogLines(wg *sync.WaitGroup, vmNames []string, stderr bool, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		message := strings.TrimRight(scanner.Text(), " \t\r\n")
+		logStdoutStderr(ansibleHost(message, vmNames), message, stderr)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Ansible: Error reading: %v", err)
+	}
+}
+
+func ansibleHost(line string, vmNames []string) string {
+	for _, vmName := range vmNames {
+		if strings.Contains(line, ": ["+vmName+"]") {
+			return vmName
+		}
+	}
+	return "Ansible"
+}
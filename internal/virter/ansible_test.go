@@ -0,0 +1,100 @@
+package virter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestAnsibleInventory(t *testing.T) {
+	step := &ProvisionAnsibleStep{
+		Playbook: "site.yml",
+		Groups: map[string][]string{
+			"controller": {"vm-1"},
+			"satellites": {"vm-2", "vm-3"},
+		},
+		HostVars: map[string]map[string]string{
+			"vm-1": {"node_id": "0"},
+		},
+	}
+
+	inventory, err := ansibleInventory([]string{"vm-1", "vm-2"}, []string{"192.168.122.2:22", "127.0.0.1:22002"}, "/tmp/key", step)
+	assert.NoError(t, err)
+
+	var parsed struct {
+		All struct {
+			Hosts    map[string]map[string]string `yaml:"hosts"`
+			Children map[string]struct {
+				Hosts map[string]interface{} `yaml:"hosts"`
+			} `yaml:"children"`
+		} `yaml:"all"`
+	}
+	err = yaml.Unmarshal(inventory, &parsed)
+	assert.NoError(t, err)
+
+	assert.Len(t, parsed.All.Hosts, 2)
+	assert.Equal(t, "192.168.122.2", parsed.All.Hosts["vm-1"]["ansible_host"])
+	assert.Equal(t, "22", parsed.All.Hosts["vm-1"]["ansible_port"])
+	assert.Equal(t, "0", parsed.All.Hosts["vm-1"]["node_id"])
+	assert.Equal(t, "/tmp/key", parsed.All.Hosts["vm-1"]["ansible_ssh_private_key_file"])
+	assert.Equal(t, "127.0.0.1", parsed.All.Hosts["vm-2"]["ansible_host"])
+	assert.Equal(t, "22002", parsed.All.Hosts["vm-2"]["ansible_port"])
+
+	assert.Contains(t, parsed.All.Children["controller"].Hosts, "vm-1")
+	// VMs which are not provisioned are left out
+	assert.Len(t, parsed.All.Children["satellites"].Hosts, 1)
+	assert.Contains(t, parsed.All.Children["satellites"].Hosts, "vm-2")
+}
+
+func TestAnsibleArgs(t *testing.T) {
+	step := &ProvisionAnsibleStep{
+		Playbook: "site.yml",
+		Args:     []string{"--diff"},
+	}
+	assert.Equal(t, []string{"--inventory", "inv", "--diff", "site.yml"}, ansibleArgs(step, "inv", "vars"))
+
+	step.ExtraVars = map[string]string{"foo": "bar"}
+	assert.Equal(t, []string{"--inventory", "inv", "--extra-vars", "@vars", "--diff", "site.yml"}, ansibleArgs(step, "inv", "vars"))
+}
+
+func TestAnsibleHost(t *testing.T) {
+	vmNames := []string{"vm-1", "vm-10"}
+	assert.Equal(t, "vm-1", ansibleHost("ok: [vm-1]", vmNames))
+	assert.Equal(t, "vm-10", ansibleHost("fatal: [vm-10]: FAILED! => {}", vmNames))
+	assert.Equal(t, "Ansible", ansibleHost("TASK [vm-1] ****", vmNames))
+}
+
+func TestNewProvisionConfigAnsible(t *testing.T) {
+	input := `
+[values]
+Version = "1.0"
+Other = "x"
+
+[env]
+FOO = "bar"
+
+[[steps]]
+[steps.ansible]
+playbook = "playbooks/{{.Version}}.yml"
+[steps.ansible.extra_vars]
+Other = "y"
+[steps.ansible.groups]
+controller = ["vm-1"]
+[steps.ansible.host_vars.vm-1]
+node_id = "0"
+`
+
+	pc, err := newProvisionConfigReader(strings.NewReader(input), ProvisionOption{})
+	assert.NoError(t, err)
+
+	step := pc.Steps[0].Ansible
+	if assert.NotNil(t, step) {
+		assert.Equal(t, "playbooks/1.0.yml", step.Playbook)
+		assert.Equal(t, map[string]string{"FOO": "bar"}, step.Env)
+		assert.Equal(t, map[string]string{"Version": "1.0", "Other": "y"}, step.ExtraVars)
+		assert.Equal(t, []string{"vm-1"}, step.Groups["controller"])
+		assert.Equal(t, "0", step.HostVars["vm-1"]["node_id"])
+	}
+}
@@ -2,17 +2,21 @@ package virter
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 
 	libvirt "github.com/digitalocean/go-libvirt"
 	"github.com/kdomanski/iso9660"
+	"gopkg.in/yaml.v2"
 )
 
 const templateMetaData = `instance-id: {{ .VMName }}
 local-hostname: {{ .VMName }}
 `
 
-const templateUserData = `#cloud-config
+const cloudConfigHeader = "#cloud-config"
+
+const templateUserData = cloudConfigHeader + `
 disable_root: False
 ssh_authorized_keys:
 {{- range .SSHPublicKeys }}
@@ -20,7 +24,9 @@ ssh_authorized_keys:
 {{- end }}
 preserve_hostname: false
 hostname: {{ .VMName }}
-fqdn: {{ .VMName }}.test
+{{- if .FQDN }}
+fqdn: {{ .FQDN }}
+{{- end }}
 `
 
 func (v *Virter) metaData(vmName string) (string, error) {
@@ -31,16 +37,82 @@ func (v *Virter) metaData(vmName string) (string, error) {
 	return renderTemplate("meta-data", templateMetaData, templateData)
 }
 
-func (v *Virter) userData(vmName string, sshPublicKeys []string) (string, error) {
+func (v *Virter) userData(vmName string, fqdn string, sshPublicKeys []string, extraUserData []byte) (string, error) {
 	templateData := map[string]interface{}{
 		"VMName":        vmName,
+		"FQDN":          fqdn,
 		"SSHPublicKeys": sshPublicKeys,
 	}
 
-	return renderTemplate("user-data", templateUserData, templateData)
+	userData, err := renderTemplate("user-data", templateUserData, templateData)
+	if err != nil {
+		return "", err
+	}
+
+	if len(extraUserData) == 0 {
+		return userData, nil
+	}
+
+	return mergeCloudConfig(userData, extraUserData)
+}
+
+// mergeCloudConfig deep-merges the cloud-config document extra into base.
+// Mappings are merged recursively and lists are concatenated, so that the
+// SSH keys of base are kept. For all other values, extra takes precedence.
+func mergeCloudConfig(base string, extra []byte) (string, error) {
+	if !bytes.HasPrefix(extra, []byte(cloudConfigHeader)) {
+		return "", fmt.Errorf("user data must be a cloud-config document starting with '%s'", cloudConfigHeader)
+	}
+
+	var baseConfig map[interface{}]interface{}
+	if err := yaml.Unmarshal([]byte(base), &baseConfig); err != nil {
+		return "", fmt.Errorf("could not parse cloud-config: %w", err)
+	}
+
+	var extraConfig map[interface{}]interface{}
+	if err := yaml.Unmarshal(extra, &extraConfig); err != nil {
+		return "", fmt.Errorf("could not parse user data: %w", err)
+	}
+
+	merged, err := yaml.Marshal(mergeYAML(baseConfig, extraConfig))
+	if err != nil {
+		return "", fmt.Errorf("could not marshal merged cloud-config: %w", err)
+	}
+
+	return cloudConfigHeader + "\n" + string(merged), nil
 }
 
-func (v *Virter) createCIData(sp libvirt.StoragePool, vmConfig VMConfig) error {
+func mergeYAML(base, extra interface{}) interface{} {
+	switch extra := extra.(type) {
+	case map[interface{}]interface{}:
+		baseMap, ok := base.(map[interface{}]interface{})
+		if !ok {
+			return extra
+		}
+
+		result := make(map[interface{}]interface{}, len(baseMap)+len(extra))
+		for k, v := range baseMap {
+			result[k] = v
+		}
+		for k, v := range extra {
+			result[k] = mergeYAML(baseMap[k], v)
+		}
+		return result
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok {
+			return extra
+		}
+
+		result := make([]interface{}, 0, len(baseList)+len(extra))
+		result = append(result, baseList...)
+		return append(result, extra...)
+	}
+
+	return extra
+}
+
+func (v *Virter) createCIData(ctx context.Context, sp libvirt.StoragePool, vmConfig VMConfig, rb *rollback) error {
 	vmName := vmConfig.Name
 	sshPublicKeys := vmConfig.SSHPublicKeys
 
@@ -49,7 +121,12 @@ func (v *Virter) createCIData(sp libvirt.StoragePool, vmConfig VMConfig) error {
 		return err
 	}
 
-	userData, err := v.userData(vmName, sshPublicKeys)
+	fqdn, err := v.getFQDN(vmName)
+	if err != nil {
+		return err
+	}
+
+	userData, err := v.userData(vmName, fqdn, sshPublicKeys, vmConfig.CloudInit.UserData)
 	if err != nil {
 		return err
 	}
@@ -58,6 +135,13 @@ func (v *Virter) createCIData(sp libvirt.StoragePool, vmConfig VMConfig) error {
 		"meta-data": []byte(metaData),
 		"user-data": []byte(userData),
 	}
+	// cloud-init merges vendor data itself, with user data taking precedence
+	if len(vmConfig.CloudInit.VendorData) > 0 {
+		files["vendor-data"] = vmConfig.CloudInit.VendorData
+	}
+	if len(vmConfig.CloudInit.NetworkConfig) > 0 {
+		files["network-config"] = vmConfig.CloudInit.NetworkConfig
+	}
 
 	ciData, err := GenerateISO(files)
 	if err != nil {
@@ -73,8 +157,9 @@ func (v *Virter) createCIData(sp libvirt.StoragePool, vmConfig VMConfig) error {
 	if err != nil {
 		return fmt.Errorf("could not create cloud-init volume: %w", err)
 	}
+	v.rollbackVolume(rb, sv)
 
-	err = v.libvirt.StorageVolUpload(sv, bytes.NewReader(ciData), 0, 0, 0)
+	err = v.libvirt.StorageVolUpload(sv, newContextReader(ctx, bytes.NewReader(ciData)), 0, 0, 0)
 	if err != nil {
 		return fmt.Errorf("failed to transfer cloud-init data to libvirt: %w", err)
 	}
@@ -82,8 +167,10 @@ func (v *Virter) createCIData(sp libvirt.StoragePool, vmConfig VMConfig) error {
 	return nil
 }
 
+const ciDataVolumeSuffix = "-cidata"
+
 func ciDataVolumeName(vmName string) string {
-	return vmName + "-cidata"
+	return vmName + ciDataVolumeSuffix
 }
 
 // GenerateISO generates a "CD-ROM" filesystem
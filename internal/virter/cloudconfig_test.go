@@ -0,0 +1,77 @@
+package virter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestUserDataMerge(t *testing.T) {
+	v := &Virter{}
+
+	extra := []byte(`#cloud-config
+packages:
+  - drbd-utils
+ssh_authorized_keys:
+  - other-key
+write_files:
+  - path: /etc/motd
+    content: hello
+`)
+
+	userData, err := v.userData("some-vm", "some-vm.test", []string{"some-key"}, extra)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(userData, "#cloud-config\n"))
+
+	var config map[string]interface{}
+	err = yaml.Unmarshal([]byte(userData), &config)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"some-key", "other-key"}, config["ssh_authorized_keys"])
+	assert.Equal(t, []interface{}{"drbd-utils"}, config["packages"])
+	assert.Len(t, config["write_files"], 1)
+	assert.Equal(t, "some-vm", config["hostname"])
+	assert.Equal(t, "some-vm.test", config["fqdn"])
+	assert.Equal(t, false, config["disable_root"])
+}
+
+func TestUserDataNoFQDN(t *testing.T) {
+	v := &Virter{}
+
+	userData, err := v.userData("some-vm", "", []string{"some-key"}, nil)
+	assert.NoError(t, err)
+	assert.NotContains(t, userData, "fqdn")
+}
+
+func TestUserDataMergeInvalid(t *testing.T) {
+	v := &Virter{}
+
+	_, err := v.userData("some-vm", "some-vm.test", []string{"some-key"}, []byte("#!/bin/sh\necho hello\n"))
+	assert.Error(t, err)
+
+	_, err = v.userData("some-vm", "some-vm.test", []string{"some-key"}, []byte("#cloud-config\n- not a mapping\n"))
+	assert.Error(t, err)
+}
+
+func TestMergeYAML(t *testing.T) {
+	base := map[interface{}]interface{}{
+		"a": map[interface{}]interface{}{"x": 1, "y": 2},
+		"b": []interface{}{1},
+		"c": "base",
+	}
+	extra := map[interface{}]interface{}{
+		"a": map[interface{}]interface{}{"y": 3, "z": 4},
+		"b": []interface{}{2},
+		"c": "extra",
+		"d": true,
+	}
+
+	expect := map[interface{}]interface{}{
+		"a": map[interface{}]interface{}{"x": 1, "y": 3, "z": 4},
+		"b": []interface{}{1, 2},
+		"c": "extra",
+		"d": true,
+	}
+	assert.Equal(t, expect, mergeYAML(base, extra))
+}
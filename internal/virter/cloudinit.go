@@ -0,0 +1,166 @@
+package virter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// cloudInitWaitScript waits until cloud-init has finished and prints its
+// result. Older versions of cloud-init do not support "status --wait", so
+// the marker file written at the end of the boot is polled instead. Both
+// are limited to the given number of seconds, 0 meaning no limit. If no
+// result is available, a line starting with cloudInitNoResult is printed
+// instead, naming what is missing.
+const cloudInitWaitScript = `
+wait_seconds=%[1]d
+if cloud-init status --help 2>&1 | grep -q -- --wait; then
+	timeout "$wait_seconds" cloud-init status --wait > /dev/null
+	if [ $? -eq 124 ]; then
+		echo "%[2]s 'cloud-init status --wait' did not return within $wait_seconds seconds"
+		exit 0
+	fi
+else
+	i=0
+	while [ ! -e /var/lib/cloud/instance/boot-finished ]; do
+		if [ "$wait_seconds" -gt 0 ] && [ "$i" -ge "$wait_seconds" ]; then
+			echo "%[2]s /var/lib/cloud/instance/boot-finished did not appear within $wait_seconds seconds"
+			exit 0
+		fi
+		i=$((i + 1))
+		sleep 1
+	done
+fi
+if [ ! -e %[3]s ]; then
+	echo "%[2]s %[3]s does not exist"
+	exit 0
+fi
+cat %[3]s
+`
+
+const cloudInitNoResult = "virter-no-result:"
+
+const cloudInitResultFile = "/run/cloud-init/result.json"
+
+// cloudInitGracePeriod is added to the cloud-init timeout, so that the wait
+// script can report what is missing before the connection is closed.
+const cloudInitGracePeriod = 30 * time.Second
+
+// cloudInitLogScript prints the parts of the cloud-init logs which are
+// relevant for failures.
+const cloudInitLogScript = `
+grep -E 'WARNING|ERROR|Traceback' /var/log/cloud-init.log | tail -n 20
+tail -n 30 /var/log/cloud-init-output.log
+`
+
+type cloudInitResult struct {
+	V1 struct {
+		Errors []string `json:"errors"`
+	} `json:"v1"`
+}
+
+// waitCloudInit waits until cloud-init has finished in a VM and checks that
+// it did not report any errors.
+func (v *Virter) waitCloudInit(ctx context.Context, shellClientBuilder ShellClientBuilder, vmConfig VMConfig, hostPort string) error {
+	log.Print("Wait for cloud-init to finish")
+
+	sshConfig, err := getSSHClientConfig(vmConfig.SSHPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	if vmConfig.CloudInitTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, vmConfig.CloudInitTimeout+cloudInitGracePeriod)
+		defer cancel()
+	}
+
+	waitSeconds := int(math.Ceil(vmConfig.CloudInitTimeout.Seconds()))
+	script := fmt.Sprintf(cloudInitWaitScript, waitSeconds, cloudInitNoResult, cloudInitResultFile)
+	output, err := runShellScript(ctx, shellClientBuilder, hostPort, sshConfig, script)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out waiting for cloud-init after %v", vmConfig.CloudInitTimeout)
+		}
+		return fmt.Errorf("could not wait for cloud-init: %w", err)
+	}
+
+	if bytes.HasPrefix(output, []byte(cloudInitNoResult)) {
+		missing := strings.TrimSpace(strings.TrimPrefix(string(output), cloudInitNoResult))
+		return fmt.Errorf("cloud-init did not report a result: %s", missing)
+	}
+
+	var result cloudInitResult
+	if err := json.Unmarshal(output, &result); err != nil {
+		return fmt.Errorf("cloud-init did not report a result: could not parse %s: %w", cloudInitResultFile, err)
+	}
+
+	if len(result.V1.Errors) > 0 {
+		excerpt, err := runShellScript(ctx, shellClientBuilder, hostPort, sshConfig, cloudInitLogScript)
+		if err != nil {
+			log.Warnf("Could not read cloud-init logs: %v", err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(excerpt)), "\n") {
+			if line != "" {
+				log.Errorf("%s: cloud-init: %s", vmConfig.Name, line)
+			}
+		}
+
+		return fmt.Errorf("cloud-init failed: %s", strings.Join(result.V1.Errors, "; "))
+	}
+
+	log.Print("cloud-init finished")
+	return nil
+}
+
+// runShellScript runs a script in a VM and returns its standard output. The
+// connection is closed when the context is cancelled.
+func runShellScript(ctx context.Context, shellClientBuilder ShellClientBuilder, hostPort string, sshConfig ssh.ClientConfig, script string) ([]byte, error) {
+	sshClient := shellClientBuilder.NewShellClient(hostPort, sshConfig)
+	if err := sshClient.Dial(); err != nil {
+		return nil, err
+	}
+	defer sshClient.Close()
+
+	outp, err := sshClient.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(&stdout, outp)
+	}()
+
+	execDone := make(chan error, 1)
+	go func() {
+		execDone <- sshClient.ExecScript(script)
+	}()
+
+	select {
+	case err = <-execDone:
+	case <-ctx.Done():
+		sshClient.Close()
+		<-execDone
+		err = ctx.Err()
+	}
+	wg.Wait()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,106 @@
+package virter_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+)
+
+func waitCloudInitVMConfig() virter.VMConfig {
+	return virter.VMConfig{
+		ImageName:        imageName,
+		Name:             vmName,
+		ID:               vmID,
+		VCPUs:            1,
+		MemoryKiB:        1024,
+		SSHPublicKeys:    []string{sshPublicKey},
+		SSHPrivateKey:    []byte(sshPrivateKey),
+		WaitCloudInit:    true,
+		CloudInitTimeout: time.Minute,
+		SSHPingCount:     1,
+		SSHPingPeriod:    time.Second, // ignored
+	}
+}
+
+func TestVMRunWaitCloudInit(t *testing.T) {
+	shell := new(mocks.ShellClient)
+	shell.On("Dial").Return(nil)
+	shell.On("Close").Return(nil)
+	shell.On("StdoutPipe").Return(strings.NewReader(`{"v1": {"datasource": "DataSourceNoCloud", "errors": []}}`), nil)
+	shell.On("ExecScript", mock.MatchedBy(func(script string) bool {
+		return strings.Contains(script, "cloud-init status --wait")
+	})).Return(nil)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, waitCloudInitVMConfig())
+	assert.NoError(t, err)
+	assert.Contains(t, l.domains, vmName)
+
+	shell.AssertExpectations(t)
+}
+
+func TestVMRunWaitCloudInitFailed(t *testing.T) {
+	shell := new(mocks.ShellClient)
+	shell.On("Dial").Return(nil)
+	shell.On("Close").Return(nil)
+	shell.On("StdoutPipe").Return(strings.NewReader(`{"v1": {"errors": ["('scripts-user', RuntimeError('Runparts: 1 failures'))"]}}`), nil).Once()
+	shell.On("StdoutPipe").Return(strings.NewReader("ERROR: script failed\n"), nil).Once()
+	shell.On("ExecScript", mock.Anything).Return(nil)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, waitCloudInitVMConfig())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Runparts")
+	}
+
+	// the VM is removed again, like when SSH does not become reachable
+	assert.Empty(t, l.domains)
+
+	shell.AssertExpectations(t)
+}
+
+func TestVMRunWaitCloudInitNoResult(t *testing.T) {
+	cases := map[string]string{
+		"virter-no-result: /run/cloud-init/result.json does not exist\n": "/run/cloud-init/result.json does not exist",
+		"{not json": "could not parse /run/cloud-init/result.json",
+	}
+
+	for output, expected := range cases {
+		shell := new(mocks.ShellClient)
+		shell.On("Dial").Return(nil)
+		shell.On("Close").Return(nil)
+		shell.On("StdoutPipe").Return(strings.NewReader(output), nil)
+		shell.On("ExecScript", mock.Anything).Return(nil)
+
+		l := newFakeLibvirtConnection()
+
+		l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+		v := virter.New(l, poolName, networkName)
+
+		err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, waitCloudInitVMConfig())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "cloud-init did not report a result")
+			assert.Contains(t, err.Error(), expected)
+		}
+
+		assert.Empty(t, l.domains)
+	}
+}
@@ -0,0 +1,24 @@
+package virter
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader aborts reading from the underlying reader once the context
+// is done. This allows cancelling uploads to libvirt.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) *contextReader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
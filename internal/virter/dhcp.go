@@ -2,8 +2,10 @@ package virter
 
 import (
 	"fmt"
+	"math/big"
 	"net"
 	"os/exec"
+	"sort"
 
 	libvirt "github.com/digitalocean/go-libvirt"
 	log "github.com/sirupsen/logrus"
@@ -11,54 +13,226 @@ import (
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
 
-// addDHCPEntry adds a DHCP mapping from a MAC address to an IP generated from
-// the id. The same MAC address should always be paired with a given IP so that
-// DHCP entries do not need to be released between removing a VM and creating
-// another with the same ID.
-func (v *Virter) addDHCPEntry(mac string, id uint) (net.IP, error) {
-	network, err := v.libvirt.NetworkLookupByName(v.networkName)
+// networkRange is an address range of a libvirt network, corresponding to
+// an <ip> element of the network XML.
+type networkRange struct {
+	// index is the position of the <ip> element in the network XML
+	index int
+	ipNet net.IPNet
+	dhcp  *libvirtxml.NetworkDHCP
+}
+
+func (r networkRange) ipv6() bool {
+	return r.ipNet.IP.To4() == nil
+}
+
+// dhcpHost is a DHCP host entry together with the range it belongs to.
+type dhcpHost struct {
+	libvirtxml.NetworkDHCPHost
+	networkRange networkRange
+}
+
+// getNetworkRanges returns the address ranges of a network. The IPv4 ranges
+// come first, so that the first range is the one used for SSH and for
+// determining the ID of a VM from its IP.
+func getNetworkRanges(networkDescription *libvirtxml.Network) ([]networkRange, error) {
+	if len(networkDescription.IPs) < 1 {
+		return nil, fmt.Errorf("no IPs in network")
+	}
+
+	ranges := make([]networkRange, 0, len(networkDescription.IPs))
+	for i, ipDescription := range networkDescription.IPs {
+		ipNet, err := parseNetworkIP(ipDescription)
+		if err != nil {
+			return nil, err
+		}
+
+		ranges = append(ranges, networkRange{
+			index: i,
+			ipNet: ipNet,
+			dhcp:  ipDescription.DHCP,
+		})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return !ranges[i].ipv6() && ranges[j].ipv6()
+	})
+
+	return ranges, nil
+}
+
+func parseNetworkIP(ipDescription libvirtxml.NetworkIP) (net.IPNet, error) {
+	ipNet := net.IPNet{}
+
+	if ipDescription.Address == "" {
+		return ipNet, fmt.Errorf("could not find address in network XML")
+	}
+
+	ip := net.ParseIP(ipDescription.Address)
+	if ip == nil {
+		return ipNet, fmt.Errorf("could not parse network IP address")
+	}
+
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits = 8 * net.IPv4len
+	}
+
+	if ipDescription.Prefix != 0 {
+		ipNet.Mask = net.CIDRMask(int(ipDescription.Prefix), bits)
+	} else if ipDescription.Netmask != "" {
+		networkMaskIP := net.ParseIP(ipDescription.Netmask)
+		if networkMaskIP == nil {
+			return ipNet, fmt.Errorf("could not parse network mask IP address")
+		}
+
+		networkMaskIPv4 := networkMaskIP.To4()
+		if networkMaskIPv4 == nil {
+			return ipNet, fmt.Errorf("network mask is not IPv4 address")
+		}
+
+		ipNet.Mask = net.CIDRMask(int(cidr(networkMaskIPv4)), bits)
+	} else {
+		return ipNet, fmt.Errorf("could not find netmask or prefix in network XML")
+	}
+
+	if ipNet.Mask == nil {
+		return ipNet, fmt.Errorf("invalid prefix for network address %s", ipDescription.Address)
+	}
+
+	ipNet.IP = ip.Mask(ipNet.Mask)
+
+	return ipNet, nil
+}
+
+func (v *Virter) getNetworkRanges(network libvirt.Network) ([]networkRange, error) {
+	networkDescription, err := getNetworkDescription(v.libvirt, network)
 	if err != nil {
-		return nil, fmt.Errorf("could not get network: %w", err)
+		return nil, err
 	}
 
-	ipNet, err := v.getIPNet(network)
+	return getNetworkRanges(networkDescription)
+}
+
+// getDHCPRanges returns the address ranges of a network which have DHCP
+// enabled.
+func (v *Virter) getDHCPRanges(network libvirt.Network) ([]networkRange, error) {
+	ranges, err := v.getNetworkRanges(network)
 	if err != nil {
 		return nil, err
 	}
 
-	networkBaseIP := ipNet.IP.Mask(ipNet.Mask)
-	ip := addToIP(networkBaseIP, id)
+	dhcpRanges := []networkRange{}
+	for _, r := range ranges {
+		if r.dhcp != nil {
+			dhcpRanges = append(dhcpRanges, r)
+		}
+	}
 
-	if !ipNet.Contains(ip) {
-		return nil, fmt.Errorf("computed IP %v is not in network", ip)
+	if len(dhcpRanges) < 1 {
+		return nil, fmt.Errorf("no DHCP in network")
 	}
 
-	log.Printf("Add DHCP entry from %v to %v", mac, ip)
-	err = v.libvirt.NetworkUpdate(
+	return dhcpRanges, nil
+}
+
+// addDHCPEntry adds DHCP mappings for a VM to IPs generated from the id, one
+// in each DHCP range of the network. IPv4 entries are mapped from the MAC
+// address. DHCPv6 does not identify clients by MAC address, so IPv6 entries
+// are mapped from the VM name. The same MAC address should always be paired
+// with a given IP so that DHCP entries do not need to be released between
+// removing a VM and creating another with the same ID.
+//
+// The returned IPs start with the IPv4 addresses.
+func (v *Virter) addDHCPEntry(network libvirt.Network, vmName string, mac string, id uint) ([]net.IP, error) {
+	ranges, err := v.getDHCPRanges(network)
+	if err != nil {
+		return nil, err
+	}
+
+	var added []dhcpHost
+	for _, r := range ranges {
+		ip := addToIP(r.ipNet.IP, id)
+		if !r.ipNet.Contains(ip) {
+			v.rmDHCPHosts(network, added)
+			return nil, fmt.Errorf("computed IP %v is not in network", ip)
+		}
+
+		host := dhcpHost{networkRange: r}
+		host.IP = ip.String()
+		if r.ipv6() {
+			host.Name = vmName
+			log.Printf("Add DHCP entry from %v to %v", vmName, ip)
+		} else {
+			host.MAC = mac
+			log.Printf("Add DHCP entry from %v to %v", mac, ip)
+		}
+
+		err = v.updateDHCPHost(network, host, libvirt.NetworkUpdateCommandAddLast)
+		if err != nil {
+			v.rmDHCPHosts(network, added)
+			return nil, fmt.Errorf("could not add DHCP entry: %w", err)
+		}
+
+		added = append(added, host)
+	}
+
+	ips := make([]net.IP, len(added))
+	for i, host := range added {
+		ips[i] = net.ParseIP(host.IP)
+	}
+
+	return ips, nil
+}
+
+func (v *Virter) updateDHCPHost(network libvirt.Network, host dhcpHost, command libvirt.NetworkUpdateCommand) error {
+	hostXML, err := host.NetworkDHCPHost.Marshal()
+	if err != nil {
+		return fmt.Errorf("could not marshal DHCP host: %w", err)
+	}
+
+	return v.libvirt.NetworkUpdate(
 		network,
 		// the following 2 arguments are swapped; see
 		// https://github.com/digitalocean/go-libvirt/issues/87
 		uint32(libvirt.NetworkSectionIPDhcpHost),
-		uint32(libvirt.NetworkUpdateCommandAddLast),
-		-1,
-		fmt.Sprintf("<host mac='%s' ip='%v'/>", mac, ip),
+		uint32(command),
+		// the range has to be given explicitly if there are several
+		// with DHCP
+		int32(host.networkRange.index),
+		hostXML,
 		libvirt.NetworkUpdateAffectLive|libvirt.NetworkUpdateAffectConfig)
-	if err != nil {
-		return nil, fmt.Errorf("could not add DHCP entry: %w", err)
+}
+
+// ipToInt converts an IP address to an integer, using the 4 byte
+// representation for IPv4 addresses.
+func ipToInt(ip net.IP) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
 	}
 
-	return ip, nil
+	return new(big.Int).SetBytes(ip)
 }
 
 func addToIP(ip net.IP, addend uint) net.IP {
-	i := ip.To4()
-	v := uint(i[0])<<24 + uint(i[1])<<16 + uint(i[2])<<8 + uint(i[3])
-	v += addend
-	v0 := byte((v >> 24) & 0xFF)
-	v1 := byte((v >> 16) & 0xFF)
-	v2 := byte((v >> 8) & 0xFF)
-	v3 := byte(v & 0xFF)
-	return net.IPv4(v0, v1, v2, v3)
+	length := net.IPv6len
+	if ip.To4() != nil {
+		length = net.IPv4len
+	}
+
+	v := ipToInt(ip)
+	v.Add(v, new(big.Int).SetUint64(uint64(addend)))
+
+	result := make(net.IP, length)
+	b := v.Bytes()
+	if len(b) > length {
+		// overflow, keep the lower bytes like for fixed size integers
+		b = b[len(b)-length:]
+	}
+	copy(result[length-len(b):], b)
+
+	return result
 }
 
 // ipToID converts an IP address(with network) to a ID
@@ -67,84 +241,76 @@ func ipToID(ipnet net.IPNet, ip net.IP) (uint, error) {
 		return 0, fmt.Errorf("computed IP %v is not in network", ip)
 	}
 
-	si := ipnet.IP.To4()
-	sv := uint(si[0])<<24 + uint(si[1])<<16 + uint(si[2])<<8 + uint(si[3])
+	v := ipToInt(ip)
+	v.Sub(v, ipToInt(ipnet.IP))
 
-	i := ip.To4()
-	v := uint(i[0])<<24 + uint(i[1])<<16 + uint(i[2])<<8 + uint(i[3])
+	if !v.IsUint64() || v.Uint64() > uint64(^uint(0)) {
+		return 0, fmt.Errorf("IP %v is too far from network address %v", ip, ipnet.IP)
+	}
 
-	return v - sv, nil
+	return uint(v.Uint64()), nil
 }
 
+// getIPNet returns the first address range of a network.
 func (v *Virter) getIPNet(network libvirt.Network) (net.IPNet, error) {
-	ipNet := net.IPNet{}
-
-	networkDescription, err := getNetworkDescription(v.libvirt, network)
+	ranges, err := v.getNetworkRanges(network)
 	if err != nil {
-		return ipNet, err
-	}
-	if len(networkDescription.IPs) < 1 {
-		return ipNet, fmt.Errorf("no IPs in network")
-	}
-
-	ipDescription := networkDescription.IPs[0]
-	if ipDescription.Address == "" {
-		return ipNet, fmt.Errorf("could not find address in network XML")
-	}
-	if ipDescription.Netmask == "" {
-		return ipNet, fmt.Errorf("could not find netmask in network XML")
-	}
-
-	ipNet.IP = net.ParseIP(ipDescription.Address)
-	if ipNet.IP == nil {
-		return ipNet, fmt.Errorf("could not parse network IP address")
+		return net.IPNet{}, err
 	}
 
-	networkMaskIP := net.ParseIP(ipDescription.Netmask)
-	if networkMaskIP == nil {
-		return ipNet, fmt.Errorf("could not parse network mask IP address")
-	}
-
-	networkMaskIPv4 := networkMaskIP.To4()
-	if networkMaskIPv4 == nil {
-		return ipNet, fmt.Errorf("network mask is not IPv4 address")
-	}
-
-	ipNet.Mask = net.IPMask(networkMaskIPv4)
-
-	return ipNet, nil
+	return ranges[0].ipNet, nil
 }
 
+// rmDHCPEntry removes the DHCP and DNS entries of all interfaces of a
+// domain.
 func (v *Virter) rmDHCPEntry(domain libvirt.Domain) error {
-	mac, err := v.getMAC(domain)
+	ifaces, err := v.getDomainNetworkInterfaces(domain)
 	if err != nil {
 		return err
 	}
 
-	network, err := v.libvirt.NetworkLookupByName(v.networkName)
-	if err != nil {
-		return fmt.Errorf("could not get network: %w", err)
+	for _, iface := range ifaces {
+		network, err := v.libvirt.NetworkLookupByName(iface.network)
+		if err != nil {
+			return fmt.Errorf("could not get network '%s': %w", iface.network, err)
+		}
+
+		external, err := v.externalNetwork(network)
+		if err != nil {
+			return err
+		}
+		if external {
+			continue
+		}
+
+		err = v.rmInterfaceDHCPEntry(network, domain.Name, iface.mac)
+		if err != nil {
+			return err
+		}
 	}
 
-	ips, err := v.findIPs(network, mac)
+	return nil
+}
+
+func (v *Virter) rmInterfaceDHCPEntry(network libvirt.Network, vmName string, mac string) error {
+	hosts, err := v.findDHCPHosts(network, vmName, mac)
 	if err != nil {
 		return err
 	}
 
-	for _, ip := range ips {
-		log.Printf("Remove DHCP entry from %v to %v", mac, ip)
-		err = v.libvirt.NetworkUpdate(
-			network,
-			// the following 2 arguments are swapped; see
-			// https://github.com/digitalocean/go-libvirt/issues/87
-			uint32(libvirt.NetworkSectionIPDhcpHost),
-			uint32(libvirt.NetworkUpdateCommandDelete),
-			-1,
-			fmt.Sprintf("<host mac='%s' ip='%v'/>", mac, ip),
-			libvirt.NetworkUpdateAffectLive|libvirt.NetworkUpdateAffectConfig)
+	ips := make([]string, len(hosts))
+	for i, host := range hosts {
+		err = v.rmDHCPHost(network, host)
 		if err != nil {
-			return fmt.Errorf("could not remove DHCP entry: %w", err)
+			return err
 		}
+
+		err = v.rmDNSHost(network, host.IP)
+		if err != nil {
+			return err
+		}
+
+		ips[i] = host.IP
 	}
 
 	err = v.tryReleaseDHCP(mac, ips, network)
@@ -155,6 +321,25 @@ func (v *Virter) rmDHCPEntry(domain libvirt.Domain) error {
 	return nil
 }
 
+func (v *Virter) rmDHCPHost(network libvirt.Network, host dhcpHost) error {
+	log.Printf("Remove DHCP entry for %v", host.IP)
+	err := v.updateDHCPHost(network, host, libvirt.NetworkUpdateCommandDelete)
+	if err != nil {
+		return fmt.Errorf("could not remove DHCP entry: %w", err)
+	}
+
+	return nil
+}
+
+// rmDHCPHosts removes DHCP hosts, logging errors instead of returning them.
+func (v *Virter) rmDHCPHosts(network libvirt.Network, hosts []dhcpHost) {
+	for _, host := range hosts {
+		if err := v.rmDHCPHost(network, host); err != nil {
+			log.Warnf("Failed to remove DHCP entry for %v: %v", host.IP, err)
+		}
+	}
+}
+
 func (v *Virter) getMAC(domain libvirt.Domain) (string, error) {
 	domainDescription, err := getDomainDescription(v.libvirt, domain)
 	if err != nil {
@@ -179,46 +364,58 @@ func (v *Virter) getMAC(domain libvirt.Domain) (string, error) {
 	return macDescription.Address, nil
 }
 
-// getDHCPHosts returns a array of used dhcp entry hosts
-func (v *Virter) getDHCPHosts(network libvirt.Network) ([]libvirtxml.NetworkDHCPHost, error) {
-	hosts := []libvirtxml.NetworkDHCPHost{}
-
-	networkDescription, err := getNetworkDescription(v.libvirt, network)
+// getDHCPHosts returns the DHCP host entries of all ranges of a network
+func (v *Virter) getDHCPHosts(network libvirt.Network) ([]dhcpHost, error) {
+	ranges, err := v.getDHCPRanges(network)
 	if err != nil {
-		return hosts, err
-	}
-	if len(networkDescription.IPs) < 1 {
-		return hosts, fmt.Errorf("no IPs in network")
-	}
-
-	ipDescription := networkDescription.IPs[0]
-
-	dhcpDescription := ipDescription.DHCP
-	if dhcpDescription == nil {
-		return hosts, fmt.Errorf("no DHCP in network")
+		return nil, err
 	}
 
-	for _, host := range dhcpDescription.Hosts {
-		hosts = append(hosts, host)
+	hosts := []dhcpHost{}
+	for _, r := range ranges {
+		for _, host := range r.dhcp.Hosts {
+			hosts = append(hosts, dhcpHost{NetworkDHCPHost: host, networkRange: r})
+		}
 	}
 
 	return hosts, nil
 }
 
-func (v *Virter) findIPs(network libvirt.Network, mac string) ([]string, error) {
-	ips := []string{}
-
+// findDHCPHosts returns the DHCP host entries of a VM. IPv4 entries are
+// identified by the MAC address and IPv6 entries by the VM name.
+func (v *Virter) findDHCPHosts(network libvirt.Network, vmName string, mac string) ([]dhcpHost, error) {
 	hosts, err := v.getDHCPHosts(network)
 	if err != nil {
-		return ips, err
+		return nil, err
 	}
 
+	result := []dhcpHost{}
 	for _, host := range hosts {
-		if host.MAC == mac {
-			ips = append(ips, host.IP)
+		if host.networkRange.ipv6() {
+			if host.Name == vmName {
+				result = append(result, host)
+			}
+		} else if host.MAC == mac {
+			result = append(result, host)
 		}
 	}
 
+	return result, nil
+}
+
+// findIPs returns the IPs reserved for a VM, starting with the IPv4
+// addresses.
+func (v *Virter) findIPs(network libvirt.Network, vmName string, mac string) ([]string, error) {
+	hosts, err := v.findDHCPHosts(network, vmName, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, len(hosts))
+	for i, host := range hosts {
+		ips[i] = host.IP
+	}
+
 	return ips, nil
 }
 
@@ -231,40 +428,22 @@ func cidr(mask net.IP) uint {
 
 // getVMID returns wantedID if it is not 0 and free.
 // If wantedID is 0 getVMID searches for an unused ID and returns the first it can find
-// For searching it uses the set libvirt network and already reserverd DHCP entries
-func (v *Virter) getVMID(wantedID uint) (uint, error) {
-	network, err := v.libvirt.NetworkLookupByName(v.networkName)
-	if err != nil {
-		return 0, fmt.Errorf("could not get network: %w", err)
+// For searching it uses the given libvirt networks and already reserverd DHCP entries
+func (v *Virter) getVMID(wantedID uint, networkNames []string) (uint, error) {
+	if v.userNetwork() {
+		return v.getUserNetworkVMID(wantedID)
 	}
 
-	hosts, err := v.getDHCPHosts(network)
-	if err != nil {
-		return 0, err
-	}
-
-	networkDescription, err := getNetworkDescription(v.libvirt, network)
-	if err != nil {
-		return 0, err
+	if v.hostBridge != nil {
+		return v.getHostBridgeVMID(wantedID, networkNames)
 	}
 
-	// get the network mask of the libvirt network
-	_, ipNet, err := net.ParseCIDR(
-		fmt.Sprintf("%s/%d", networkDescription.IPs[0].Address, cidr(net.ParseIP(networkDescription.IPs[0].Netmask))))
+	// build a map of already used ID's
+	usedIds, availableHosts, err := v.getNetworkUsedIDs(networkNames)
 	if err != nil {
 		return 0, err
 	}
 
-	// build a map of already used ID's
-	usedIds := make(map[uint]bool, len(hosts))
-	for _, host := range hosts {
-		id, err := ipToID(*ipNet, net.ParseIP(host.IP))
-		if err != nil {
-			return 0, err
-		}
-		usedIds[id] = true
-	}
-
 	if wantedID != 0 { // one was already set
 		if used := usedIds[wantedID]; used {
 			return 0, fmt.Errorf("preset ID '%d' already used", wantedID)
@@ -273,24 +452,93 @@ func (v *Virter) getVMID(wantedID uint) (uint, error) {
 		return wantedID, nil
 	}
 
-	// try to find a free one
+	// try to find a free one, starting from the top of the available
+	// host IDs
+	return v.freeID(usedIds, availableHosts)
+}
+
+// getNetworkUsedIDs returns the IDs used by DHCP entries in the given libvirt
+// networks and the number of hosts available in the smallest network.
+func (v *Virter) getNetworkUsedIDs(networkNames []string) (map[uint]bool, uint, error) {
+	usedIds := map[uint]bool{}
+	var availableHosts uint
+	for _, networkName := range networkNames {
+		network, err := v.libvirt.NetworkLookupByName(networkName)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not get network '%s': %w", networkName, err)
+		}
+
+		external, err := v.externalNetwork(network)
+		if err != nil {
+			return nil, 0, err
+		}
+		if external {
+			continue
+		}
+
+		hosts, err := v.getDHCPHosts(network)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, host := range hosts {
+			id, err := ipToID(host.networkRange.ipNet, net.ParseIP(host.IP))
+			if err != nil {
+				return nil, 0, err
+			}
+			usedIds[id] = true
+		}
+
+		networkHosts, err := v.availableHosts(network)
+		if err != nil {
+			return nil, 0, err
+		}
+		if availableHosts == 0 || networkHosts < availableHosts {
+			availableHosts = networkHosts
+		}
+	}
+
+	return usedIds, availableHosts, nil
+}
+
+// maxHostBits limits the number of IDs for large networks such as IPv6
+// ranges, so that they fit in a uint on all platforms.
+const maxHostBits = 31
 
-	// from the netmask the number of avialable hosts
-	maskSize, _ := ipNet.Mask.Size()
-	availableHosts := uint((1 << (32 - maskSize)) - 2)
+// availableHosts returns the number of IDs for which there is an IP in each
+// DHCP range of a network.
+func (v *Virter) availableHosts(network libvirt.Network) (uint, error) {
+	ranges, err := v.getDHCPRanges(network)
+	if err != nil {
+		return 0, err
+	}
 
-	// we start from top of avialable host id's and check if they are already used and find one
-	for i := availableHosts; i > 0; i-- {
-		_, exists := usedIds[i]
-		if !exists {
-			return i, nil
+	hostBits := maxHostBits
+	for _, r := range ranges {
+		ones, bits := r.ipNet.Mask.Size()
+		if bits-ones < hostBits {
+			hostBits = bits - ones
 		}
 	}
 
-	return 0, fmt.Errorf("could not find unused VM id")
+	if hostBits < 2 {
+		return 0, nil
+	}
+
+	// exclude the network and broadcast addresses
+	return uint(1<<hostBits) - 2, nil
 }
 
 func (v *Virter) tryReleaseDHCP(mac string, addrs []string, network libvirt.Network) error {
+	if !v.dhcpRelease {
+		return nil
+	}
+
+	// dhcp_release has to run on the libvirt host
+	if v.tunnel != nil {
+		return fmt.Errorf("libvirt host is not reachable directly")
+	}
+
 	networkDescription, err := getNetworkDescription(v.libvirt, network)
 	if err != nil {
 		return err
@@ -302,6 +550,11 @@ func (v *Virter) tryReleaseDHCP(mac string, addrs []string, network libvirt.Netw
 	iface := networkDescription.Bridge.Name
 
 	for _, addr := range addrs {
+		// dhcp_release only handles IPv4 leases
+		if net.ParseIP(addr).To4() == nil {
+			continue
+		}
+
 		log.Debugf("Releasing DHCP lease from %v to %v", mac, addr)
 		cmd := exec.Command("sudo", "--non-interactive", "dhcp_release", iface, addr, mac)
 		_, err = cmd.Output()
@@ -3,6 +3,8 @@ package virter
 import (
 	"net"
 	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
 
 func TestIPToID(t *testing.T) {
@@ -38,3 +40,73 @@ func TestCidr(t *testing.T) {
 		t.Fatalf("cidr expected 24 got: %d", c)
 	}
 }
+
+func TestIPToIDIPv6(t *testing.T) {
+	_, ipnet, err := net.ParseCIDR("fd00:1::/64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := ipToID(*ipnet, net.ParseIP("fd00:1::2a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id != 42 {
+		t.Fatalf("Expected ID 42, actual: %d", id)
+	}
+}
+
+func TestAddToIP(t *testing.T) {
+	cases := []struct {
+		ip     string
+		addend uint
+		expect string
+	}{
+		{"192.168.122.0", 42, "192.168.122.42"},
+		{"10.0.0.0", 300, "10.0.1.44"},
+		{"fd00:1::", 42, "fd00:1::2a"},
+		{"fd00:1::ff00", 512, "fd00:1::1:100"},
+	}
+
+	for _, c := range cases {
+		actual := addToIP(net.ParseIP(c.ip), c.addend)
+		if actual.String() != c.expect {
+			t.Errorf("%s + %d: expected %s, actual: %s", c.ip, c.addend, c.expect, actual)
+		}
+	}
+}
+
+func TestGetNetworkRanges(t *testing.T) {
+	description := &libvirtxml.Network{
+		IPs: []libvirtxml.NetworkIP{
+			{Family: "ipv6", Address: "fd00:1::1", Prefix: 64},
+			{Address: "192.168.122.1", Netmask: "255.255.255.0", DHCP: &libvirtxml.NetworkDHCP{}},
+			{Address: "10.0.0.1", Prefix: 16},
+		},
+	}
+
+	ranges, err := getNetworkRanges(description)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []struct {
+		index int
+		cidr  string
+	}{
+		{1, "192.168.122.0/24"},
+		{2, "10.0.0.0/16"},
+		{0, "fd00:1::/64"},
+	}
+
+	if len(ranges) != len(expect) {
+		t.Fatalf("Expected %d ranges, actual: %d", len(expect), len(ranges))
+	}
+
+	for i, e := range expect {
+		if ranges[i].index != e.index || ranges[i].ipNet.String() != e.cidr {
+			t.Errorf("range %d: expected %d %s, actual: %d %s", i, e.index, e.cidr, ranges[i].index, ranges[i].ipNet.String())
+		}
+	}
+}
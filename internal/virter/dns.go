@@ -0,0 +1,136 @@
+package virter
+
+import (
+	"fmt"
+	"net"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// SetDNSDomain sets the DNS domain of the VMs, which is used when the libvirt
+// network does not define a domain.
+func (v *Virter) SetDNSDomain(domain string) {
+	v.dnsDomain = domain
+}
+
+// getDNSDomain returns the domain set in the libvirt network, falling back to
+// the configured DNS domain.
+func (v *Virter) getDNSDomain() (string, error) {
+	if !v.usesLibvirtNetwork() {
+		return v.dnsDomain, nil
+	}
+
+	network, err := v.libvirt.NetworkLookupByName(v.networkName)
+	if err != nil {
+		return "", fmt.Errorf("could not get network: %w", err)
+	}
+
+	networkDescription, err := getNetworkDescription(v.libvirt, network)
+	if err != nil {
+		return "", err
+	}
+
+	if networkDescription.Domain != nil && networkDescription.Domain.Name != "" {
+		return networkDescription.Domain.Name, nil
+	}
+
+	return v.dnsDomain, nil
+}
+
+// getFQDN returns the fully qualified domain name of a VM. It is empty if no
+// DNS domain is known.
+func (v *Virter) getFQDN(vmName string) (string, error) {
+	domain, err := v.getDNSDomain()
+	if err != nil {
+		return "", err
+	}
+
+	if domain == "" {
+		return "", nil
+	}
+
+	return vmName + "." + domain, nil
+}
+
+// addDNSHost adds a DNS entry to the network which resolves the name and the
+// FQDN of a VM to its IP.
+func (v *Virter) addDNSHost(network libvirt.Network, vmName string, ip net.IP) error {
+	fqdn, err := v.getFQDN(vmName)
+	if err != nil {
+		return err
+	}
+
+	host := libvirtxml.NetworkDNSHost{
+		IP:        ip.String(),
+		Hostnames: []libvirtxml.NetworkDNSHostHostname{{Hostname: vmName}},
+	}
+	if fqdn != "" {
+		host.Hostnames = append(host.Hostnames, libvirtxml.NetworkDNSHostHostname{Hostname: fqdn})
+	}
+
+	hostXML, err := host.Marshal()
+	if err != nil {
+		return fmt.Errorf("could not marshal DNS host: %w", err)
+	}
+
+	log.Printf("Add DNS entry from %v to %v", vmName, ip)
+	err = v.libvirt.NetworkUpdate(
+		network,
+		// the following 2 arguments are swapped; see
+		// https://github.com/digitalocean/go-libvirt/issues/87
+		uint32(libvirt.NetworkSectionDNSHost),
+		uint32(libvirt.NetworkUpdateCommandAddLast),
+		-1,
+		hostXML,
+		libvirt.NetworkUpdateAffectLive|libvirt.NetworkUpdateAffectConfig)
+	if err != nil {
+		return fmt.Errorf("could not add DNS entry: %w", err)
+	}
+
+	return nil
+}
+
+// rmDNSHost removes the DNS entry for an IP from the network. VMs created by
+// older versions of virter have no DNS entry, so a missing entry is ignored.
+func (v *Virter) rmDNSHost(network libvirt.Network, ip string) error {
+	networkDescription, err := getNetworkDescription(v.libvirt, network)
+	if err != nil {
+		return err
+	}
+
+	if !hasDNSHost(networkDescription, ip) {
+		return nil
+	}
+
+	log.Printf("Remove DNS entry for %v", ip)
+	err = v.libvirt.NetworkUpdate(
+		network,
+		// the following 2 arguments are swapped; see
+		// https://github.com/digitalocean/go-libvirt/issues/87
+		uint32(libvirt.NetworkSectionDNSHost),
+		uint32(libvirt.NetworkUpdateCommandDelete),
+		-1,
+		fmt.Sprintf("<host ip='%s'/>", ip),
+		libvirt.NetworkUpdateAffectLive|libvirt.NetworkUpdateAffectConfig)
+	if err != nil {
+		return fmt.Errorf("could not remove DNS entry: %w", err)
+	}
+
+	return nil
+}
+
+func hasDNSHost(networkDescription *libvirtxml.Network, ip string) bool {
+	if networkDescription.DNS == nil {
+		return false
+	}
+
+	for _, host := range networkDescription.DNS.Host {
+		if host.IP == ip {
+			return true
+		}
+	}
+
+	return false
+}
@@ -6,17 +6,29 @@ package virter
 // See https://github.com/digitalocean/go-libvirt/issues/56
 
 import (
+	"errors"
 	"reflect"
 )
 
 type errorNumber int32
 
 const (
-	errNoDomain     errorNumber = 42
-	errNoStorageVol errorNumber = 50
+	errNoDomain         errorNumber = 42
+	errNoStorageVol     errorNumber = 50
+	errOperationInvalid errorNumber = 55
 )
 
+// hasErrorCode checks the libvirt error code of err or of any error it wraps.
 func hasErrorCode(err error, code errorNumber) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if isErrorCode(err, code) {
+			return true
+		}
+	}
+	return false
+}
+
+func isErrorCode(err error, code errorNumber) bool {
 	v := reflect.ValueOf(err)
 	if v.Kind() != reflect.Struct {
 		return false
@@ -0,0 +1,505 @@
+package virter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sshclient "github.com/LINBIT/gosshclient"
+	"github.com/digitalocean/go-libvirt"
+	lx "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	guestAgentChannelName = "org.qemu.guest_agent.0"
+	// guestAgentTimeout is the time in seconds libvirt waits for the
+	// guest agent to respond to a single command
+	guestAgentTimeout = 10
+	// guestExecPollPeriod is the interval for checking whether a command
+	// started with guest-exec has finished
+	guestExecPollPeriod = 200 * time.Millisecond
+	// guestExecKillTimeout limits waiting for a command to be killed
+	guestExecKillTimeout = 30 * time.Second
+	// guestFileChunkSize is the number of bytes transferred with a single
+	// guest-file-read or guest-file-write command
+	guestFileChunkSize = 48 * 1024
+)
+
+// GuestAgentConnection sends commands to the QEMU guest agents of libvirt
+// domains.
+type GuestAgentConnection interface {
+	QEMUDomainAgentCommand(Dom libvirt.Domain, Cmd string, Timeout int32, Flags uint32) (rResult string, err error)
+}
+
+// SetGuestAgent sets the connection used for guest agent commands.
+func (v *Virter) SetGuestAgent(agent GuestAgentConnection) {
+	v.guestAgent = agent
+}
+
+// GuestInterface is a network interface as reported by the guest agent.
+type GuestInterface struct {
+	Name string   `json:"name"`
+	MAC  string   `json:"mac,omitempty"`
+	IPs  []string `json:"ips"`
+}
+
+// GuestCommand is a command which is run in a VM by the guest agent.
+type GuestCommand struct {
+	Path string
+	Args []string
+	// Input is passed to the command on stdin.
+	Input []byte
+}
+
+// GuestExecResult is the result of a command run by the guest agent.
+type GuestExecResult struct {
+	ExitCode int
+	// Signal is set if the command was terminated by a signal.
+	Signal int
+	Stdout []byte
+	Stderr []byte
+}
+
+// guestAgentChannel returns the channel device for the guest agent. libvirt
+// chooses the path of the socket.
+func guestAgentChannel() lx.DomainChannel {
+	return lx.DomainChannel{
+		Source: &lx.DomainChardevSource{
+			UNIX: &lx.DomainChardevSourceUNIX{Mode: "bind"},
+		},
+		Target: &lx.DomainChannelTarget{
+			VirtIO: &lx.DomainChannelTargetVirtIO{Name: guestAgentChannelName},
+		},
+	}
+}
+
+func hasGuestAgentChannel(domainDescription *lx.Domain) bool {
+	if domainDescription.Devices == nil {
+		return false
+	}
+
+	for _, channel := range domainDescription.Devices.Channels {
+		if channel.Target != nil && channel.Target.VirtIO != nil && channel.Target.VirtIO.Name == guestAgentChannelName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// guestAgentCommand runs a guest agent command in a VM and decodes the value
+// it returns into result, unless result is nil.
+func (v *Virter) guestAgentCommand(vmName string, command string, arguments interface{}, result interface{}) error {
+	if v.guestAgent == nil {
+		return fmt.Errorf("guest agent commands are not supported by this connection")
+	}
+
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return fmt.Errorf("could not get domain: %w", err)
+	}
+
+	domainDescription, err := getDomainDescription(v.libvirt, domain)
+	if err != nil {
+		return err
+	}
+
+	if !hasGuestAgentChannel(domainDescription) {
+		return fmt.Errorf("VM '%s' has no guest agent channel", vmName)
+	}
+
+	request := struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+	}{
+		Execute:   command,
+		Arguments: arguments,
+	}
+
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("could not encode guest agent command: %w", err)
+	}
+
+	responseJSON, err := v.guestAgent.QEMUDomainAgentCommand(domain, string(requestJSON), guestAgentTimeout, 0)
+	if err != nil {
+		return fmt.Errorf("guest agent command '%s' failed in '%s': %w", command, vmName, err)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	var response struct {
+		Return json.RawMessage `json:"return"`
+	}
+	err = json.Unmarshal([]byte(responseJSON), &response)
+	if err == nil {
+		err = json.Unmarshal(response.Return, result)
+	}
+	if err != nil {
+		return fmt.Errorf("could not decode response to guest agent command '%s': %w", command, err)
+	}
+
+	return nil
+}
+
+// VMGuestInterfaces returns the network interfaces of a VM as reported by the
+// guest agent.
+func (v *Virter) VMGuestInterfaces(vmName string) ([]GuestInterface, error) {
+	var ifaces []struct {
+		Name        string `json:"name"`
+		MAC         string `json:"hardware-address"`
+		IPAddresses []struct {
+			Address string `json:"ip-address"`
+		} `json:"ip-addresses"`
+	}
+
+	err := v.guestAgentCommand(vmName, "guest-network-get-interfaces", nil, &ifaces)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []GuestInterface{}
+	for _, iface := range ifaces {
+		guestInterface := GuestInterface{
+			Name: iface.Name,
+			MAC:  iface.MAC,
+			IPs:  []string{},
+		}
+		for _, addr := range iface.IPAddresses {
+			guestInterface.IPs = append(guestInterface.IPs, addr.Address)
+		}
+		result = append(result, guestInterface)
+	}
+
+	return result, nil
+}
+
+// guestIPsByMAC returns the addresses reported by the guest agent indexed by
+// MAC address. Since the guest agent is optional, failures are only logged.
+func (v *Virter) guestIPsByMAC(domainDescription *lx.Domain) map[string][]string {
+	if v.guestAgent == nil || !hasGuestAgentChannel(domainDescription) {
+		return nil
+	}
+
+	ifaces, err := v.VMGuestInterfaces(domainDescription.Name)
+	if err != nil {
+		log.Debugf("Could not get addresses from guest agent: %v", err)
+		return nil
+	}
+
+	result := map[string][]string{}
+	for _, iface := range ifaces {
+		if iface.MAC != "" {
+			result[strings.ToLower(iface.MAC)] = iface.IPs
+		}
+	}
+
+	return result
+}
+
+// VMGuestExec runs a command in a VM with the guest agent and waits for it to
+// finish. If the context is done first, the command is killed in the VM.
+func (v *Virter) VMGuestExec(ctx context.Context, vmName string, command GuestCommand) (GuestExecResult, error) {
+	pid, err := v.guestExecStart(vmName, command)
+	if err != nil {
+		return GuestExecResult{}, err
+	}
+
+	result, err := v.guestExecWait(ctx, vmName, pid, command.Path)
+	if err != nil && ctx.Err() != nil {
+		// the guest agent keeps running the command, so that it would
+		// overlap with a retry of the step
+		v.guestExecKill(vmName, pid, command.Path)
+	}
+	return result, err
+}
+
+func (v *Virter) guestExecStart(vmName string, command GuestCommand) (int, error) {
+	execArgs := struct {
+		Path          string   `json:"path"`
+		Args          []string `json:"arg,omitempty"`
+		InputData     string   `json:"input-data,omitempty"`
+		CaptureOutput bool     `json:"capture-output"`
+	}{
+		Path:          command.Path,
+		Args:          command.Args,
+		CaptureOutput: true,
+	}
+	if command.Input != nil {
+		execArgs.InputData = base64.StdEncoding.EncodeToString(command.Input)
+	}
+
+	var execResult struct {
+		PID int `json:"pid"`
+	}
+	err := v.guestAgentCommand(vmName, "guest-exec", execArgs, &execResult)
+	if err != nil {
+		return 0, err
+	}
+
+	return execResult.PID, nil
+}
+
+// guestExecWait waits for a command started with guest-exec to finish.
+func (v *Virter) guestExecWait(ctx context.Context, vmName string, pid int, path string) (GuestExecResult, error) {
+	statusArgs := struct {
+		PID int `json:"pid"`
+	}{
+		PID: pid,
+	}
+
+	for {
+		var status struct {
+			Exited       bool   `json:"exited"`
+			ExitCode     int    `json:"exitcode"`
+			Signal       int    `json:"signal"`
+			OutData      string `json:"out-data"`
+			ErrData      string `json:"err-data"`
+			OutTruncated bool   `json:"out-truncated"`
+			ErrTruncated bool   `json:"err-truncated"`
+		}
+		err := v.guestAgentCommand(vmName, "guest-exec-status", statusArgs, &status)
+		if err != nil {
+			return GuestExecResult{}, err
+		}
+
+		if status.Exited {
+			if status.OutTruncated || status.ErrTruncated {
+				log.Warnf("%s: output of '%s' was truncated by the guest agent", vmName, path)
+			}
+
+			result := GuestExecResult{
+				ExitCode: status.ExitCode,
+				Signal:   status.Signal,
+			}
+			result.Stdout, err = base64.StdEncoding.DecodeString(status.OutData)
+			if err != nil {
+				return GuestExecResult{}, fmt.Errorf("could not decode output of '%s': %w", path, err)
+			}
+			result.Stderr, err = base64.StdEncoding.DecodeString(status.ErrData)
+			if err != nil {
+				return GuestExecResult{}, fmt.Errorf("could not decode output of '%s': %w", path, err)
+			}
+			return result, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return GuestExecResult{}, fmt.Errorf("'%s' did not finish in '%s': %w", path, vmName, ctx.Err())
+		case <-time.After(guestExecPollPeriod):
+		}
+	}
+}
+
+// guestKillScript kills the process with the PID given as first argument and
+// all its descendants. The processes are stopped first, so that they cannot
+// start new children in the meantime.
+const guestKillScript = `
+kill_tree() {
+	kill -STOP "$1" 2>/dev/null
+	for child in $(pgrep -P "$1" 2>/dev/null || cat /proc/"$1"/task/*/children 2>/dev/null); do
+		kill_tree "$child"
+	done
+	kill -KILL "$1" 2>/dev/null
+}
+kill_tree "$1"
+`
+
+// guestExecKill kills a command started with guest-exec and waits until it
+// has exited. Failures are only logged, as the command is killed because of
+// an earlier error.
+func (v *Virter) guestExecKill(vmName string, pid int, path string) {
+	log.Warnf("Killing '%s' in '%s'", path, vmName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), guestExecKillTimeout)
+	defer cancel()
+
+	killPID, err := v.guestExecStart(vmName, GuestCommand{
+		Path: "/bin/sh",
+		Args: []string{"-c", guestKillScript, "sh", strconv.Itoa(pid)},
+	})
+	if err == nil {
+		_, err = v.guestExecWait(ctx, vmName, killPID, "kill")
+	}
+	if err == nil {
+		_, err = v.guestExecWait(ctx, vmName, pid, path)
+	}
+	if err != nil {
+		log.Warnf("Could not kill '%s' in '%s': %v", path, vmName, err)
+	}
+}
+
+// VMGuestFileRead reads a file in a VM with the guest agent.
+func (v *Virter) VMGuestFileRead(vmName, path string) ([]byte, error) {
+	handle, err := v.guestFileOpen(vmName, path, "r")
+	if err != nil {
+		return nil, err
+	}
+	defer v.guestFileClose(vmName, handle)
+
+	readArgs := struct {
+		Handle int `json:"handle"`
+		Count  int `json:"count"`
+	}{
+		Handle: handle,
+		Count:  guestFileChunkSize,
+	}
+
+	var content bytes.Buffer
+	for {
+		var readResult struct {
+			Count int    `json:"count"`
+			Data  string `json:"buf-b64"`
+			EOF   bool   `json:"eof"`
+		}
+		err := v.guestAgentCommand(vmName, "guest-file-read", readArgs, &readResult)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := base64.StdEncoding.DecodeString(readResult.Data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode content of '%s': %w", path, err)
+		}
+		content.Write(data)
+
+		if readResult.EOF || readResult.Count == 0 {
+			return content.Bytes(), nil
+		}
+	}
+}
+
+// VMGuestFileWrite writes a file in a VM with the guest agent. An existing
+// file is truncated.
+func (v *Virter) VMGuestFileWrite(vmName, path string, content []byte) error {
+	handle, err := v.guestFileOpen(vmName, path, "w")
+	if err != nil {
+		return err
+	}
+
+	for len(content) > 0 {
+		chunk := content
+		if len(chunk) > guestFileChunkSize {
+			chunk = chunk[:guestFileChunkSize]
+		}
+
+		writeArgs := struct {
+			Handle int    `json:"handle"`
+			Data   string `json:"buf-b64"`
+		}{
+			Handle: handle,
+			Data:   base64.StdEncoding.EncodeToString(chunk),
+		}
+
+		var writeResult struct {
+			Count int `json:"count"`
+		}
+		err := v.guestAgentCommand(vmName, "guest-file-write", writeArgs, &writeResult)
+		if err != nil {
+			v.guestFileClose(vmName, handle)
+			return err
+		}
+		if writeResult.Count <= 0 {
+			v.guestFileClose(vmName, handle)
+			return fmt.Errorf("could not write to '%s' in '%s'", path, vmName)
+		}
+
+		content = content[writeResult.Count:]
+	}
+
+	// data may only be written when the file is closed, so errors matter
+	err = v.guestAgentCommand(vmName, "guest-file-close", struct {
+		Handle int `json:"handle"`
+	}{handle}, nil)
+	if err != nil {
+		return fmt.Errorf("could not close '%s' in '%s': %w", path, vmName, err)
+	}
+
+	return nil
+}
+
+func (v *Virter) guestFileOpen(vmName, path, mode string) (int, error) {
+	openArgs := struct {
+		Path string `json:"path"`
+		Mode string `json:"mode"`
+	}{
+		Path: path,
+		Mode: mode,
+	}
+
+	var handle int
+	err := v.guestAgentCommand(vmName, "guest-file-open", openArgs, &handle)
+	if err != nil {
+		return 0, fmt.Errorf("could not open '%s' in '%s': %w", path, vmName, err)
+	}
+
+	return handle, nil
+}
+
+func (v *Virter) guestFileClose(vmName string, handle int) {
+	err := v.guestAgentCommand(vmName, "guest-file-close", struct {
+		Handle int `json:"handle"`
+	}{handle}, nil)
+	if err != nil {
+		log.Warnf("Could not close file in '%s': %v", vmName, err)
+	}
+}
+
+// VMExecShellAgent runs a shell provisioning step with the guest agent
+// instead of SSH. The output is logged once the script has finished.
+func (v *Virter) VMExecShellAgent(ctx context.Context, vmNames []string, shellStep *ProvisionShellStep) error {
+	steps, err := v.shellStepsForVMs(vmNames, shellStep)
+	if err != nil {
+		return err
+	}
+
+	scripts := make([]string, len(vmNames))
+	for i, step := range steps {
+		scripts[i], err = sshclient.AddEnv(step.Script, EnvmapToSlice(step.Env))
+		if err != nil {
+			return err
+		}
+	}
+
+	var g vmGroup
+	for i, vmName := range vmNames {
+		vmName := vmName
+		step := steps[i]
+		script := scripts[i]
+
+		log.Println("Provisioning via guest agent:", step.Script, "in", vmName)
+		g.Go(vmName, func() error {
+			result, err := v.VMGuestExec(ctx, vmName, GuestCommand{
+				Path:  "/bin/sh",
+				Input: []byte(script),
+			})
+			if err != nil {
+				return err
+			}
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			logLines(&wg, vmName, false, bytes.NewReader(result.Stdout))
+			logLines(&wg, vmName, true, bytes.NewReader(result.Stderr))
+
+			if result.Signal != 0 {
+				return fmt.Errorf("script in '%s' was terminated by signal %d", vmName, result.Signal)
+			}
+			if result.ExitCode != 0 {
+				return fmt.Errorf("script in '%s' failed with exit code %d", vmName, result.ExitCode)
+			}
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
@@ -0,0 +1,315 @@
+package virter_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+)
+
+// FakeGuestAgent implements a small part of the QEMU guest agent protocol
+// with an in-memory file system.
+type FakeGuestAgent struct {
+	interfaces []map[string]interface{}
+	files      map[string][]byte
+	handles    map[int]string
+	commands   []string
+	processes  map[int]*fakeGuestProcess
+	// exec returns the exit code and output of a command
+	exec func(path string, input []byte) (int, string)
+	// hang keeps commands running until they are killed
+	hang       bool
+	started    int
+	running    int
+	maxRunning int
+}
+
+type fakeGuestProcess struct {
+	exited   bool
+	exitCode int
+	signal   int
+	output   string
+}
+
+func newFakeGuestAgent() *FakeGuestAgent {
+	return &FakeGuestAgent{
+		files:     map[string][]byte{},
+		handles:   map[int]string{},
+		processes: map[int]*fakeGuestProcess{},
+	}
+}
+
+// guestExec starts a command. Commands with arguments are only used to kill
+// other commands, their last argument is the PID to kill.
+func (a *FakeGuestAgent) guestExec(path string, args []string, input []byte) int {
+	pid := len(a.processes) + 1
+	p := &fakeGuestProcess{exited: true}
+	a.processes[pid] = p
+
+	if len(args) > 0 {
+		killPID, _ := strconv.Atoi(args[len(args)-1])
+		if killed, ok := a.processes[killPID]; ok && !killed.exited {
+			killed.exited = true
+			killed.signal = 9
+			a.running--
+		}
+		return pid
+	}
+
+	if a.hang {
+		p.exited = false
+		a.started++
+		a.running++
+		if a.running > a.maxRunning {
+			a.maxRunning = a.running
+		}
+		return pid
+	}
+
+	p.exitCode, p.output = a.exec(path, input)
+	return pid
+}
+
+func (a *FakeGuestAgent) QEMUDomainAgentCommand(Dom libvirt.Domain, Cmd string, Timeout int32, Flags uint32) (string, error) {
+	var request struct {
+		Execute   string `json:"execute"`
+		Arguments struct {
+			Path      string   `json:"path"`
+			Args      []string `json:"arg"`
+			PID       int      `json:"pid"`
+			Handle    int      `json:"handle"`
+			Data      string   `json:"buf-b64"`
+			InputData string   `json:"input-data"`
+		} `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(Cmd), &request); err != nil {
+		return "", err
+	}
+	a.commands = append(a.commands, request.Execute)
+
+	var result interface{}
+	switch request.Execute {
+	case "guest-network-get-interfaces":
+		result = a.interfaces
+	case "guest-exec":
+		input, _ := base64.StdEncoding.DecodeString(request.Arguments.InputData)
+		pid := a.guestExec(request.Arguments.Path, request.Arguments.Args, input)
+		result = map[string]int{"pid": pid}
+	case "guest-exec-status":
+		p, ok := a.processes[request.Arguments.PID]
+		if !ok {
+			return "", fmt.Errorf("unknown PID %d", request.Arguments.PID)
+		}
+		result = map[string]interface{}{
+			"exited":   p.exited,
+			"exitcode": p.exitCode,
+			"signal":   p.signal,
+			"out-data": base64.StdEncoding.EncodeToString([]byte(p.output)),
+		}
+	case "guest-file-open":
+		handle := len(a.handles) + 1
+		a.handles[handle] = request.Arguments.Path
+		result = handle
+	case "guest-file-read":
+		path := a.handles[request.Arguments.Handle]
+		content := a.files[path]
+		a.files[path] = nil
+		result = map[string]interface{}{
+			"count":   len(content),
+			"buf-b64": base64.StdEncoding.EncodeToString(content),
+			"eof":     len(content) == 0,
+		}
+	case "guest-file-write":
+		data, _ := base64.StdEncoding.DecodeString(request.Arguments.Data)
+		path := a.handles[request.Arguments.Handle]
+		a.files[path] = append(a.files[path], data...)
+		result = map[string]interface{}{"count": len(data), "eof": false}
+	case "guest-file-close":
+		delete(a.handles, request.Arguments.Handle)
+		result = map[string]interface{}{}
+	default:
+		return "", fmt.Errorf("unknown command '%s'", request.Execute)
+	}
+
+	response, err := json.Marshal(map[string]interface{}{"return": result})
+	return string(response), err
+}
+
+func runGuestAgentVM(t *testing.T, l *FakeLibvirtConnection, v *virter.Virter, extraNICs []virter.NIC) {
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	c := virter.VMConfig{
+		ImageName:  imageName,
+		Name:       vmName,
+		ID:         vmID,
+		VCPUs:      1,
+		MemoryKiB:  1024,
+		GuestAgent: true,
+		ExtraNICs:  extraNICs,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+}
+
+func TestVMRunGuestAgent(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := virter.New(l, poolName, networkName)
+
+	runGuestAgentVM(t, l, v, nil)
+
+	channels := l.domains[vmName].description.Devices.Channels
+	if assert.Len(t, channels, 1) {
+		assert.Equal(t, "org.qemu.guest_agent.0", channels[0].Target.VirtIO.Name)
+	}
+}
+
+func TestVMGuestAgentNotAvailable(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := virter.New(l, poolName, networkName)
+
+	runGuestAgentVM(t, l, v, nil)
+
+	_, err := v.VMGuestInterfaces(vmName)
+	assert.Error(t, err)
+
+	// the addresses are still known from the reservations
+	ifaces, err := v.VMInterfaces(vmName)
+	assert.NoError(t, err)
+	if assert.Len(t, ifaces, 1) {
+		assert.Equal(t, []string{vmIP}, ifaces[0].IPs)
+	}
+}
+
+func TestVMInterfacesGuestAgent(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	replication := addReplicationNetwork(l)
+	replication.description.Forward = &libvirtxml.NetworkForward{Mode: "bridge"}
+	replication.description.IPs = nil
+
+	agent := newFakeGuestAgent()
+	v := virter.New(l, poolName, networkName)
+	v.SetGuestAgent(agent)
+
+	runGuestAgentVM(t, l, v, []virter.NIC{testNIC{network: replicationNetworkName, mac: "52:54:00:00:00:02"}})
+
+	agent.interfaces = []map[string]interface{}{
+		{
+			"name":             "eth1",
+			"hardware-address": "52:54:00:00:00:02",
+			"ip-addresses": []map[string]interface{}{
+				{"ip-address-type": "ipv4", "ip-address": "10.1.0.5", "prefix": 16},
+			},
+		},
+	}
+
+	ifaces, err := v.VMInterfaces(vmName)
+	assert.NoError(t, err)
+	if assert.Len(t, ifaces, 2) {
+		assert.Equal(t, []string{vmIP}, ifaces[0].IPs)
+		assert.Equal(t, []string{"10.1.0.5"}, ifaces[1].IPs)
+	}
+}
+
+func TestVMGuestExec(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	agent := newFakeGuestAgent()
+	v := virter.New(l, poolName, networkName)
+	v.SetGuestAgent(agent)
+
+	runGuestAgentVM(t, l, v, nil)
+
+	var script string
+	agent.exec = func(path string, input []byte) (int, string) {
+		script = string(input)
+		return 3, "output"
+	}
+
+	result, err := v.VMGuestExec(context.Background(), vmName, virter.GuestCommand{
+		Path:  "/bin/sh",
+		Input: []byte("exit 3"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "output", string(result.Stdout))
+	assert.Equal(t, "exit 3", script)
+
+	err = v.VMExecShellAgent(context.Background(), []string{vmName}, &virter.ProvisionShellStep{
+		Script: "false",
+		Env:    map[string]string{"FOO": "bar"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, script, "FOO")
+	assert.Contains(t, script, "false")
+
+	agent.exec = func(path string, input []byte) (int, string) {
+		return 0, ""
+	}
+	err = v.VMExecShellAgent(context.Background(), []string{vmName}, &virter.ProvisionShellStep{Script: "true"})
+	assert.NoError(t, err)
+}
+
+func TestVMExecShellAgentTimeoutRetry(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	agent := newFakeGuestAgent()
+	v := virter.New(l, poolName, networkName)
+	v.SetGuestAgent(agent)
+
+	runGuestAgentVM(t, l, v, nil)
+
+	agent.hang = true
+
+	pc, err := virter.NewProvisionConfig(virter.ProvisionOption{
+		Overrides: []string{
+			"steps[0].shell.script=sleep infinity",
+			"steps[0].timeout=300ms",
+			"steps[0].retries=1",
+		},
+	})
+	assert.NoError(t, err)
+
+	err = v.Provision(context.Background(), pc, []string{vmName}, func(ctx context.Context, s virter.ProvisionStep, vmNames []string) error {
+		return v.VMExecShellAgent(ctx, vmNames, s.Shell)
+	})
+	assert.Error(t, err)
+
+	assert.Equal(t, 2, agent.started)
+	// the retry only starts once the timed out attempt was killed
+	assert.Equal(t, 1, agent.maxRunning)
+	assert.Equal(t, 0, agent.running)
+}
+
+func TestVMGuestFile(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	agent := newFakeGuestAgent()
+	v := virter.New(l, poolName, networkName)
+	v.SetGuestAgent(agent)
+
+	runGuestAgentVM(t, l, v, nil)
+
+	content := make([]byte, 100*1024)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	err := v.VMGuestFileWrite(vmName, "/tmp/file", content)
+	assert.NoError(t, err)
+	assert.Equal(t, content, agent.files["/tmp/file"])
+
+	read, err := v.VMGuestFileRead(vmName, "/tmp/file")
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+
+	// all files are closed again
+	assert.Empty(t, agent.handles)
+	assert.Equal(t, "guest-file-close", agent.commands[len(agent.commands)-1])
+}
@@ -0,0 +1,230 @@
+package virter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	lx "github.com/libvirt/libvirt-go-xml"
+)
+
+// StaticLease is a MAC address based DHCP reservation on a host bridge.
+type StaticLease struct {
+	MAC string
+	IP  net.IP
+}
+
+// HostBridge is an existing bridge on the libvirt host. The DHCP server on
+// the bridge is managed outside of libvirt and has static leases for the
+// VMs. The ID of a VM determines its IP in Network, and the MAC of the VM is
+// taken from the static lease for that IP.
+type HostBridge struct {
+	Name    string
+	Network net.IPNet
+	Leases  []StaticLease
+}
+
+// ParseStaticLeases reads static leases in the dnsmasq dhcp-hostsfile format
+// ("52:54:00:00:00:10,192.168.1.10,name") or the /etc/ethers format
+// ("52:54:00:00:00:10 192.168.1.10"). Empty lines and comments starting
+// with '#' are ignored.
+func ParseStaticLeases(r io.Reader) ([]StaticLease, error) {
+	leases := []StaticLease{}
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.FieldsFunc(line, func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+
+		var lease StaticLease
+		for _, field := range fields {
+			if mac, err := net.ParseMAC(field); err == nil && lease.MAC == "" {
+				lease.MAC = mac.String()
+			} else if ip := net.ParseIP(field); ip != nil && lease.IP == nil {
+				lease.IP = ip
+			}
+		}
+
+		if lease.MAC == "" || lease.IP == nil {
+			return nil, fmt.Errorf("line %d: static lease requires a MAC and an IP address", lineNumber)
+		}
+
+		leases = append(leases, lease)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read static leases: %w", err)
+	}
+
+	return leases, nil
+}
+
+// UseHostBridge configures virter to attach VMs directly to an existing host
+// bridge instead of the libvirt network.
+func (v *Virter) UseHostBridge(bridge HostBridge) {
+	bridge.Network.IP = bridge.Network.IP.Mask(bridge.Network.Mask)
+	v.hostBridge = &bridge
+}
+
+// usesLibvirtNetwork returns whether the first interface of the VMs is
+// attached to the configured libvirt network.
+func (v *Virter) usesLibvirtNetwork() bool {
+	return !v.userNetwork() && v.hostBridge == nil
+}
+
+// leaseForID returns the static lease for the IP corresponding to an ID.
+func (b *HostBridge) leaseForID(id uint) (StaticLease, error) {
+	ip := addToIP(b.Network.IP, id)
+	if !b.Network.Contains(ip) {
+		return StaticLease{}, fmt.Errorf("computed IP %v is not in network %v", ip, b.Network.String())
+	}
+
+	for _, lease := range b.Leases {
+		if lease.IP.Equal(ip) {
+			return lease, nil
+		}
+	}
+
+	return StaticLease{}, fmt.Errorf("no static lease for IP %v (ID %d) on bridge '%s'", ip, id, b.Name)
+}
+
+// leaseForMAC returns the static lease for a MAC address.
+func (b *HostBridge) leaseForMAC(mac string) (StaticLease, error) {
+	for _, lease := range b.Leases {
+		if strings.EqualFold(lease.MAC, mac) {
+			return lease, nil
+		}
+	}
+
+	return StaticLease{}, fmt.Errorf("no static lease for MAC %s on bridge '%s'", mac, b.Name)
+}
+
+// ids returns the IDs for which there are static leases, highest first.
+func (b *HostBridge) ids() []uint {
+	ids := []uint{}
+	for _, lease := range b.Leases {
+		id, err := ipToID(b.Network, lease.IP)
+		if err != nil || id == 0 {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+
+	return ids
+}
+
+func (b *HostBridge) domainInterface(id uint) (lx.DomainInterface, error) {
+	lease, err := b.leaseForID(id)
+	if err != nil {
+		return lx.DomainInterface{}, err
+	}
+
+	return lx.DomainInterface{
+		Source: &lx.DomainInterfaceSource{
+			Bridge: &lx.DomainInterfaceSourceBridge{
+				Bridge: b.Name,
+			},
+		},
+		MAC: &lx.DomainInterfaceMAC{
+			Address: lease.MAC,
+		},
+		Model: &lx.DomainInterfaceModel{
+			Type: "virtio",
+		},
+	}, nil
+}
+
+// getHostBridgeIP returns the IP of a domain attached to the host bridge.
+func (v *Virter) getHostBridgeIP(domain libvirt.Domain) (string, error) {
+	mac, err := v.getMAC(domain)
+	if err != nil {
+		return "", err
+	}
+
+	lease, err := v.hostBridge.leaseForMAC(mac)
+	if err != nil {
+		return "", err
+	}
+
+	return lease.IP.String(), nil
+}
+
+// getMetadataIDs returns the IDs recorded in the virter metadata of all
+// domains.
+func (v *Virter) getMetadataIDs() (map[uint]bool, error) {
+	domains, _, err := v.libvirt.ConnectListAllDomains(-1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list domains: %w", err)
+	}
+
+	usedIDs := make(map[uint]bool, len(domains))
+	for _, domain := range domains {
+		meta, err := v.getVMMetadata(domain)
+		if err != nil {
+			return nil, err
+		}
+		if meta != nil {
+			usedIDs[meta.ID] = true
+		}
+	}
+
+	return usedIDs, nil
+}
+
+// getHostBridgeVMID returns wantedID if it is not 0 and free. Otherwise it
+// returns the highest free ID for which there is a static lease. IDs are
+// free if they are neither used by another VM nor by DHCP entries in the
+// additional libvirt networks.
+func (v *Virter) getHostBridgeVMID(wantedID uint, networkNames []string) (uint, error) {
+	usedIDs, availableHosts, err := v.getNetworkUsedIDs(networkNames)
+	if err != nil {
+		return 0, err
+	}
+
+	metadataIDs, err := v.getMetadataIDs()
+	if err != nil {
+		return 0, err
+	}
+	for id := range metadataIDs {
+		usedIDs[id] = true
+	}
+
+	if wantedID != 0 {
+		if usedIDs[wantedID] {
+			return 0, fmt.Errorf("preset ID '%d' already used", wantedID)
+		}
+		if _, err := v.hostBridge.leaseForID(wantedID); err != nil {
+			return 0, err
+		}
+		return wantedID, nil
+	}
+
+	for _, id := range v.hostBridge.ids() {
+		if (availableHosts != 0 && id > availableHosts) || !v.idInRange(id) {
+			continue
+		}
+		if !usedIDs[id] {
+			return id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("could not find unused VM id with a static lease on bridge '%s'", v.hostBridge.Name)
+}
@@ -0,0 +1,117 @@
+package virter_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+)
+
+const staticLeases = `# static leases for virter
+52:54:00:00:01:0a,192.168.1.10,vm-10
+52:54:00:00:01:0b 192.168.1.11
+
+52:54:00:00:01:0c	192.168.1.12 # trailing comment
+`
+
+func hostBridge(t *testing.T) virter.HostBridge {
+	_, ipNet, err := net.ParseCIDR("192.168.1.0/24")
+	assert.NoError(t, err)
+
+	leases, err := virter.ParseStaticLeases(strings.NewReader(staticLeases))
+	assert.NoError(t, err)
+
+	return virter.HostBridge{
+		Name:    "br0",
+		Network: *ipNet,
+		Leases:  leases,
+	}
+}
+
+func TestParseStaticLeases(t *testing.T) {
+	leases, err := virter.ParseStaticLeases(strings.NewReader(staticLeases))
+	assert.NoError(t, err)
+	assert.Equal(t, []virter.StaticLease{
+		{MAC: "52:54:00:00:01:0a", IP: net.ParseIP("192.168.1.10")},
+		{MAC: "52:54:00:00:01:0b", IP: net.ParseIP("192.168.1.11")},
+		{MAC: "52:54:00:00:01:0c", IP: net.ParseIP("192.168.1.12")},
+	}, leases)
+
+	_, err = virter.ParseStaticLeases(strings.NewReader("52:54:00:00:01:0a\n"))
+	assert.Error(t, err)
+
+	_, err = virter.ParseStaticLeases(strings.NewReader("vm-10,192.168.1.10\n"))
+	assert.Error(t, err)
+}
+
+func TestVMRunHostBridge(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+	v.UseHostBridge(hostBridge(t))
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	assert.Empty(t, l.network.description.IPs[0].DHCP.Hosts)
+
+	interfaces := l.domains[vmName].description.Devices.Interfaces
+	if assert.Len(t, interfaces, 1) {
+		assert.Nil(t, interfaces[0].Source.Network)
+		assert.Equal(t, "br0", interfaces[0].Source.Bridge.Bridge)
+		assert.Equal(t, "52:54:00:00:01:0c", interfaces[0].MAC.Address)
+	}
+
+	meta, err := v.VMInspect(vmName)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(12), meta.ID)
+
+	// IDs without a static lease cannot be used
+	c.Name = "other-vm"
+	c.ID = 13
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.Error(t, err)
+
+	// the ID of the existing VM must not be reused
+	c.ID = 12
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.Error(t, err)
+
+	c.ID = 0
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	vms, err := v.VMList()
+	assert.NoError(t, err)
+	if assert.Len(t, vms, 2) {
+		assert.Equal(t, "192.168.1.11", vms[0].IP)
+		assert.Equal(t, "192.168.1.12", vms[1].IP)
+	}
+
+	ifaces, err := v.VMInterfaces(vmName)
+	assert.NoError(t, err)
+	assert.Equal(t, []virter.VMInterface{
+		{
+			Bridge: "br0",
+			MAC:    "52:54:00:00:01:0c",
+			Model:  "virtio",
+			IPs:    []string{"192.168.1.12"},
+		},
+	}, ifaces)
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+}
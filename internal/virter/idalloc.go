@@ -0,0 +1,119 @@
+package virter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// IDRange is an inclusive range of VM IDs.
+type IDRange struct {
+	First uint
+	Last  uint
+}
+
+// SetIDRange limits the IDs which are chosen automatically for new VMs, so
+// that several users of one network can use disjoint sets of IDs. Explicitly
+// requested IDs are not limited.
+func (v *Virter) SetIDRange(r IDRange) error {
+	if r.First == 0 || r.First > r.Last {
+		return fmt.Errorf("invalid ID range %d-%d", r.First, r.Last)
+	}
+
+	v.idRange = &r
+	return nil
+}
+
+// SetIDLockFile configures a lock file which is held while an ID is chosen
+// for a new VM until it is reserved in the DHCP entries. This prevents virter processes which
+// use the same lock file from choosing the same ID.
+func (v *Virter) SetIDLockFile(path string) {
+	v.idLockFile = path
+}
+
+// idInRange returns whether an ID may be chosen automatically.
+func (v *Virter) idInRange(id uint) bool {
+	if v.idRange == nil {
+		return true
+	}
+
+	return id >= v.idRange.First && id <= v.idRange.Last
+}
+
+// freeID returns the highest ID up to maxID which is neither used nor
+// outside of the configured ID range.
+func (v *Virter) freeID(usedIDs map[uint]bool, maxID uint) (uint, error) {
+	first := uint(1)
+	last := maxID
+	if v.idRange != nil {
+		first = v.idRange.First
+		if v.idRange.Last < last {
+			last = v.idRange.Last
+		}
+	}
+
+	for id := last; id >= first; id-- {
+		if !usedIDs[id] {
+			return id, nil
+		}
+	}
+
+	if v.idRange != nil {
+		return 0, fmt.Errorf("could not find unused VM id in range %d-%d", v.idRange.First, v.idRange.Last)
+	}
+
+	return 0, fmt.Errorf("could not find unused VM id")
+}
+
+// openLockFile opens a lock file and creates it if it does not exist yet.
+//
+// The lock file may belong to another user, so it is only opened for
+// reading, which is sufficient for flock. An existing file is opened without
+// O_CREAT, because with fs.protected_regular, opening a file of another user
+// in a sticky directory like /tmp with O_CREAT fails.
+func openLockFile(path string) (*os.File, error) {
+	for {
+		f, err := os.Open(path)
+		if !os.IsNotExist(err) {
+			return f, err
+		}
+
+		f, err = os.OpenFile(path, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+		// another process created the file in the meantime
+	}
+}
+
+// lockIDs acquires the ID lock file, if one is configured. The returned
+// function releases the lock and may be called more than once.
+func (v *Virter) lockIDs() (func(), error) {
+	if v.idLockFile == "" {
+		return func() {}, nil
+	}
+
+	f, err := openLockFile(v.idLockFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not open ID lock file: %w", err)
+	}
+
+	log.Debugf("Acquire ID lock '%s'", v.idLockFile)
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not lock ID lock file: %w", err)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			log.Debugf("Release ID lock '%s'", v.idLockFile)
+			// closing the file releases the lock
+			f.Close()
+		})
+	}, nil
+}
@@ -0,0 +1,93 @@
+package virter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreeID(t *testing.T) {
+	v := &Virter{}
+
+	id, err := v.freeID(map[uint]bool{254: true}, 254)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(253), id)
+
+	err = v.SetIDRange(IDRange{First: 10, Last: 11})
+	assert.NoError(t, err)
+
+	id, err = v.freeID(map[uint]bool{11: true}, 254)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(10), id)
+
+	_, err = v.freeID(map[uint]bool{10: true, 11: true}, 254)
+	assert.Error(t, err)
+
+	// the range is limited by the size of the network
+	_, err = v.freeID(map[uint]bool{}, 5)
+	assert.Error(t, err)
+
+	assert.Error(t, v.SetIDRange(IDRange{First: 0, Last: 10}))
+	assert.Error(t, v.SetIDRange(IDRange{First: 11, Last: 10}))
+}
+
+func TestLockIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	v := &Virter{}
+	v.SetIDLockFile(filepath.Join(dir, "id.lock"))
+
+	unlock, err := v.lockIDs()
+	assert.NoError(t, err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlockOther, err := v.lockIDs()
+		assert.NoError(t, err)
+		close(locked)
+		unlockOther()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("lock acquired twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	// releasing again has no effect
+	unlock()
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not released")
+	}
+}
+
+func TestOpenLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "id.lock")
+
+	f, err := openLockFile(path)
+	assert.NoError(t, err)
+	f.Close()
+	assert.FileExists(t, path)
+
+	// a lock file of another user is typically not writable
+	err = os.Chmod(path, 0444)
+	assert.NoError(t, err)
+
+	f, err = openLockFile(path)
+	assert.NoError(t, err)
+	f.Close()
+}
@@ -2,9 +2,13 @@ package virter
 
 import (
 	"context"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/LINBIT/virter/pkg/netcopy"
@@ -99,7 +103,6 @@ type ImageBuildConfig struct {
 
 func (v *Virter) imageBuildProvisionCommit(ctx context.Context, tools ImageBuildTools, vmConfig VMConfig, buildConfig ImageBuildConfig) error {
 	vmNames := []string{vmConfig.Name}
-	sshPrivateKey := buildConfig.SSHPrivateKey
 	var err error
 
 	if buildConfig.ResetMachineID {
@@ -113,22 +116,11 @@ func (v *Virter) imageBuildProvisionCommit(ctx context.Context, tools ImageBuild
 		buildConfig.ProvisionConfig.Steps = append(buildConfig.ProvisionConfig.Steps, resetMachineID)
 	}
 
-	for _, s := range buildConfig.ProvisionConfig.Steps {
-		if s.Docker != nil {
-			dockerContainerConfig := buildConfig.DockerContainerConfig
-			dockerContainerConfig.ImageName = s.Docker.Image
-			dockerContainerConfig.Env = EnvmapToSlice(s.Docker.Env)
-			err = v.VMExecDocker(ctx, tools.DockerClient, vmNames, dockerContainerConfig, sshPrivateKey)
-		} else if s.Shell != nil {
-			err = v.VMExecShell(ctx, vmNames, sshPrivateKey, s.Shell)
-		} else if s.Rsync != nil {
-			copier := netcopy.NewRsyncNetworkCopier(buildConfig.SSHPrivateKeyPath)
-			err = v.VMExecRsync(ctx, copier, vmNames, s.Rsync)
-		}
-
-		if err != nil {
-			return err
-		}
+	err = v.Provision(ctx, buildConfig.ProvisionConfig, vmNames, func(ctx context.Context, s ProvisionStep, vmNames []string) error {
+		return v.imageBuildProvisionStep(ctx, tools, buildConfig, s, vmNames)
+	})
+	if err != nil {
+		return err
 	}
 
 	err = v.VMCommit(tools.AfterNotifier, vmConfig.Name, true, buildConfig.ShutdownTimeout)
@@ -139,12 +131,34 @@ func (v *Virter) imageBuildProvisionCommit(ctx context.Context, tools ImageBuild
 	return nil
 }
 
+func (v *Virter) imageBuildProvisionStep(ctx context.Context, tools ImageBuildTools, buildConfig ImageBuildConfig, s ProvisionStep, vmNames []string) error {
+	sshPrivateKey := buildConfig.SSHPrivateKey
+
+	if s.Docker != nil {
+		dockerContainerConfig := buildConfig.DockerContainerConfig
+		dockerContainerConfig.ImageName = s.Docker.Image
+		dockerContainerConfig.Env = EnvmapToSlice(s.Docker.Env)
+		return v.VMExecDocker(ctx, tools.DockerClient, vmNames, dockerContainerConfig, sshPrivateKey)
+	} else if s.Shell != nil {
+		return v.VMExecShell(ctx, vmNames, sshPrivateKey, s.Shell)
+	} else if s.Rsync != nil {
+		copier := netcopy.NewRsyncNetworkCopier(buildConfig.SSHPrivateKeyPath)
+		return v.VMExecRsync(ctx, copier, vmNames, s.Rsync)
+	} else if s.Ansible != nil {
+		return v.VMExecAnsible(ctx, vmNames, sshPrivateKey, s.Ansible)
+	} else if s.Fetch != nil {
+		copier := netcopy.NewRsyncNetworkCopier(buildConfig.SSHPrivateKeyPath)
+		return v.VMExecFetch(ctx, copier, vmNames, s.Fetch)
+	}
+	return nil
+}
+
 // ImageBuild builds an image by running a VM and provisioning it
 func (v *Virter) ImageBuild(ctx context.Context, tools ImageBuildTools, vmConfig VMConfig, buildConfig ImageBuildConfig) error {
 	// VMRun is responsible to call CheckVMConfig here!
-	// TODO(): currently we can not know why VM run failed, so we don't clean up in this stage,
-	//         it could have been an existing VM, we don't want to delete it.
-	err := v.VMRun(tools.ShellClientBuilder, vmConfig)
+	// VMRun removes the resources it created itself if it fails. It never
+	// touches an existing VM, so there is nothing to clean up here.
+	err := v.VMRun(ctx, tools.ShellClientBuilder, vmConfig)
 	if err != nil {
 		return err
 	}
@@ -211,3 +225,240 @@ func (v *Virter) ImageSave(name string, to io.Writer) error {
 
 	return nil
 }
+
+// VolumeKind describes what a volume in the virter storage pool is used for
+type VolumeKind string
+
+const (
+	// VolumeKindImage is an image which can be used to start VMs
+	VolumeKindImage VolumeKind = "image"
+	// VolumeKindBoot is the boot volume of a VM
+	VolumeKindBoot VolumeKind = "boot"
+	// VolumeKindCIData is the cloud-init volume of a VM
+	VolumeKindCIData VolumeKind = "cidata"
+	// VolumeKindDisk is an additional disk of a VM
+	VolumeKindDisk VolumeKind = "disk"
+)
+
+// VolumeInfo contains information about a volume in the virter storage pool
+type VolumeInfo struct {
+	Name        string     `json:"name"`
+	Kind        VolumeKind `json:"kind"`
+	VM          string     `json:"vm,omitempty"`
+	CapacityB   uint64     `json:"capacity"`
+	AllocationB uint64     `json:"allocation"`
+	Format      string     `json:"format"`
+	Created     time.Time  `json:"created"`
+}
+
+// VolumeList lists all volumes in the virter storage pool. Volumes which are
+// attached to a domain or recorded in its metadata are reported as VM volumes.
+// So are the volumes of VMs whose domain is gone, as long as their cloud-init
+// volume is left. All others are images.
+func (v *Virter) VolumeList() ([]VolumeInfo, error) {
+	sp, err := v.libvirt.StoragePoolLookupByName(v.storagePoolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get storage pool: %w", err)
+	}
+
+	vols, _, err := v.libvirt.StoragePoolListAllVolumes(sp, -1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list storage volumes: %w", err)
+	}
+
+	vmVolumes, domainNames, err := v.getVMVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	orphanVMs := findOrphanVMs(vols, domainNames)
+
+	result := []VolumeInfo{}
+	for _, vol := range vols {
+		info, err := v.getVolumeInfo(vol)
+		if err != nil {
+			return nil, err
+		}
+
+		vm, ok := vmVolumes[vol.Name]
+		if !ok {
+			vm = orphanVMOfVolume(vol.Name, orphanVMs)
+		}
+		if vm != "" {
+			info.VM = vm
+			info.Kind = volumeKind(vm, vol.Name)
+		}
+
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+// getVMVolumes returns a map from the names of all volumes belonging to a
+// domain to the name of that domain, and the set of all domain names.
+func (v *Virter) getVMVolumes() (map[string]string, map[string]bool, error) {
+	domains, _, err := v.libvirt.ConnectListAllDomains(-1, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list domains: %w", err)
+	}
+
+	vmVolumes := make(map[string]string)
+	domainNames := make(map[string]bool)
+	for _, domain := range domains {
+		domainNames[domain.Name] = true
+
+		disks, err := v.getDisksOfDomain(domain)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		meta, err := v.getVMMetadata(domain)
+		if err != nil {
+			return nil, nil, err
+		}
+		if meta != nil {
+			// detached disks still belong to the VM
+			disks = append(disks, meta.BootVolume)
+			disks = append(disks, meta.Volumes()...)
+		}
+
+		for _, disk := range disks {
+			vmVolumes[disk] = domain.Name
+		}
+	}
+
+	return vmVolumes, domainNames, nil
+}
+
+// findOrphanVMs returns the names of the VMs that have a cloud-init volume
+// but no domain. Committing a VM removes its cloud-init volume, so images
+// never have one.
+func findOrphanVMs(vols []libvirt.StorageVol, domainNames map[string]bool) []string {
+	var vms []string
+	for _, vol := range vols {
+		if !strings.HasSuffix(vol.Name, ciDataVolumeSuffix) {
+			continue
+		}
+
+		vm := strings.TrimSuffix(vol.Name, ciDataVolumeSuffix)
+		if !domainNames[vm] {
+			vms = append(vms, vm)
+		}
+	}
+	return vms
+}
+
+// orphanVMOfVolume returns the VM without a domain which the volume is named
+// after, or "" if there is none.
+func orphanVMOfVolume(volumeName string, orphanVMs []string) string {
+	result := ""
+	for _, vm := range orphanVMs {
+		if volumeName != vm && !strings.HasPrefix(volumeName, vm+"-") {
+			continue
+		}
+
+		// prefer the longest name if the names of VMs overlap
+		if len(vm) > len(result) {
+			result = vm
+		}
+	}
+	return result
+}
+
+func volumeKind(vmName, volumeName string) VolumeKind {
+	switch volumeName {
+	case vmName:
+		return VolumeKindBoot
+	case ciDataVolumeName(vmName):
+		return VolumeKindCIData
+	default:
+		return VolumeKindDisk
+	}
+}
+
+func (v *Virter) getVolumeInfo(vol libvirt.StorageVol) (VolumeInfo, error) {
+	info := VolumeInfo{
+		Name: vol.Name,
+		Kind: VolumeKindImage,
+	}
+
+	var err error
+	_, info.CapacityB, info.AllocationB, err = v.libvirt.StorageVolGetInfo(vol)
+	if err != nil {
+		return info, fmt.Errorf("could not get info for volume '%s': %w", vol.Name, err)
+	}
+
+	volXML, err := v.libvirt.StorageVolGetXMLDesc(vol, 0)
+	if err != nil {
+		return info, fmt.Errorf("could not get XML for volume '%s': %w", vol.Name, err)
+	}
+
+	volcfg := &libvirtxml.StorageVolume{}
+	err = volcfg.Unmarshal(volXML)
+	if err != nil {
+		return info, fmt.Errorf("could not unmarshal XML for volume '%s': %w", vol.Name, err)
+	}
+
+	if volcfg.Target != nil {
+		if volcfg.Target.Format != nil {
+			info.Format = volcfg.Target.Format.Type
+		}
+		if volcfg.Target.Timestamps != nil {
+			info.Created, err = volumeCreationTime(volXML, volcfg.Target.Timestamps)
+			if err != nil {
+				return info, fmt.Errorf("could not parse timestamp of volume '%s': %w", vol.Name, err)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// volumeTimestampsXML contains the birth time of a volume, which
+// libvirtxml does not parse.
+type volumeTimestampsXML struct {
+	Btime string `xml:"target>timestamps>btime"`
+}
+
+// volumeCreationTime returns the birth time of a volume if the file system
+// records it. Otherwise, it falls back to the modification time. The ctime
+// is the time of the last inode change, so it is not used.
+func volumeCreationTime(volXML string, timestamps *libvirtxml.StorageVolumeTargetTimestamps) (time.Time, error) {
+	var ts volumeTimestampsXML
+	if err := xml.Unmarshal([]byte(volXML), &ts); err != nil {
+		return time.Time{}, err
+	}
+
+	if ts.Btime != "" {
+		return parseVolumeTimestamp(ts.Btime)
+	}
+
+	return parseVolumeTimestamp(timestamps.Mtime)
+}
+
+// parseVolumeTimestamp parses a libvirt volume timestamp of the form
+// "seconds.nanoseconds".
+func parseVolumeTimestamp(ts string) (time.Time, error) {
+	if ts == "" {
+		return time.Time{}, nil
+	}
+
+	parts := strings.SplitN(ts, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nsec int64
+	if len(parts) == 2 {
+		nsec, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return time.Unix(sec, nsec), nil
+}
@@ -165,5 +165,96 @@ func TestImageSave(t *testing.T) {
 	assert.Equal(t, []byte(imageContent), dest.Bytes())
 }
 
+func TestVolumeList(t *testing.T) {
+	shell := new(mocks.ShellClient)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{
+		description: &libvirtxml.StorageVolume{
+			Name: imageName,
+			Target: &libvirtxml.StorageVolumeTarget{
+				Format: &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+				Timestamps: &libvirtxml.StorageVolumeTargetTimestamps{
+					Mtime: "1590065112.000000042",
+					Ctime: "1590065999.000000000",
+				},
+			},
+		},
+	}
+
+	// the volumes of a VM whose domain is gone
+	for _, name := range []string{"old-vm", "old-vm-cidata", "old-vm-data"} {
+		l.vols[name] = &FakeLibvirtStorageVol{
+			description: &libvirtxml.StorageVolume{
+				Name:   name,
+				Target: &libvirtxml.StorageVolumeTarget{},
+			},
+		}
+	}
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	vols, err := v.VolumeList()
+	assert.NoError(t, err)
+	assert.Equal(t, []virter.VolumeInfo{
+		{
+			Name:        "old-vm",
+			Kind:        virter.VolumeKindBoot,
+			VM:          "old-vm",
+			CapacityB:   42,
+			AllocationB: 23,
+		},
+		{
+			Name:        "old-vm-cidata",
+			Kind:        virter.VolumeKindCIData,
+			VM:          "old-vm",
+			CapacityB:   42,
+			AllocationB: 23,
+		},
+		{
+			Name:        "old-vm-data",
+			Kind:        virter.VolumeKindDisk,
+			VM:          "old-vm",
+			CapacityB:   42,
+			AllocationB: 23,
+		},
+		{
+			Name:        imageName,
+			Kind:        virter.VolumeKindImage,
+			CapacityB:   42,
+			AllocationB: 23,
+			Format:      "qcow2",
+			Created:     time.Unix(1590065112, 42),
+		},
+		{
+			Name:        vmName,
+			Kind:        virter.VolumeKindBoot,
+			VM:          vmName,
+			CapacityB:   42,
+			AllocationB: 23,
+			Format:      "qcow2",
+		},
+		{
+			Name:        ciDataVolumeName,
+			Kind:        virter.VolumeKindCIData,
+			VM:          vmName,
+			CapacityB:   42,
+			AllocationB: 23,
+			Format:      "raw",
+		},
+	}, vols)
+}
+
 const imageURL = "http://foo.bar"
 const imageContent = "some-data"
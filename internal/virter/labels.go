@@ -0,0 +1,137 @@
+package virter
+
+import (
+	"fmt"
+	"strings"
+)
+
+type labelRequirement struct {
+	key      string
+	value    string
+	operator string
+}
+
+// LabelSelector selects VMs based on their labels. All requirements of a
+// selector have to be met for a VM to be selected.
+type LabelSelector struct {
+	requirements []labelRequirement
+}
+
+// ParseLabels parses a list of "key=value" strings into a label map.
+func ParseLabels(labels []string) (map[string]string, error) {
+	result := make(map[string]string, len(labels))
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed label '%s': expected 'key=value'", l)
+		}
+
+		key := strings.TrimSpace(kv[0])
+		if err := checkLabelKey(key); err != nil {
+			return nil, fmt.Errorf("malformed label '%s': %w", l, err)
+		}
+
+		value := strings.TrimSpace(kv[1])
+		if strings.Contains(value, ",") {
+			return nil, fmt.Errorf("malformed label '%s': value cannot contain ','", l)
+		}
+
+		result[key] = value
+	}
+
+	return result, nil
+}
+
+func checkLabelKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key cannot be empty")
+	}
+	if strings.ContainsAny(key, "=!, ") {
+		return fmt.Errorf("key cannot contain any of '=', '!', ',' or ' '")
+	}
+	return nil
+}
+
+// ParseLabelSelector parses a selector of the form "key1=value1,key2!=value2,key3".
+// A requirement of the form "key" matches if the label is present, "!key"
+// matches if it is absent.
+func ParseLabelSelector(selector string) (LabelSelector, error) {
+	var s LabelSelector
+
+	for _, r := range strings.Split(selector, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		var req labelRequirement
+		if kv := strings.SplitN(r, "!=", 2); len(kv) == 2 {
+			req = labelRequirement{key: kv[0], value: kv[1], operator: "!="}
+		} else if kv := strings.SplitN(r, "=", 2); len(kv) == 2 {
+			req = labelRequirement{key: kv[0], value: kv[1], operator: "="}
+		} else if strings.HasPrefix(r, "!") {
+			req = labelRequirement{key: r[1:], operator: "!"}
+		} else {
+			req = labelRequirement{key: r, operator: ""}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if err := checkLabelKey(req.key); err != nil {
+			return s, fmt.Errorf("malformed selector requirement '%s': %w", r, err)
+		}
+
+		s.requirements = append(s.requirements, req)
+	}
+
+	if len(s.requirements) == 0 {
+		return s, fmt.Errorf("empty label selector")
+	}
+
+	return s, nil
+}
+
+// Matches checks whether a set of labels fulfills all requirements of the
+// selector.
+func (s LabelSelector) Matches(labels map[string]string) bool {
+	for _, req := range s.requirements {
+		value, ok := labels[req.key]
+		switch req.operator {
+		case "=":
+			if !ok || value != req.value {
+				return false
+			}
+		case "!=":
+			if ok && value == req.value {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		default:
+			if !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// VMSelect returns the names of all VMs whose labels match the selector.
+func (v *Virter) VMSelect(selector LabelSelector) ([]string, error) {
+	vms, err := v.VMList()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, vm := range vms {
+		if selector.Matches(vm.Labels) {
+			names = append(names, vm.Name)
+		}
+	}
+
+	return names, nil
+}
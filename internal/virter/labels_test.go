@@ -0,0 +1,92 @@
+package virter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	cases := []struct {
+		input       []string
+		expect      map[string]string
+		expectError bool
+	}{
+		{
+			input:  []string{},
+			expect: map[string]string{},
+		}, {
+			input:  []string{"role=controller", "zone = a"},
+			expect: map[string]string{"role": "controller", "zone": "a"},
+		}, {
+			input:  []string{"empty="},
+			expect: map[string]string{"empty": ""},
+		}, {
+			input:       []string{"novalue"},
+			expectError: true,
+		}, {
+			input:       []string{"=value"},
+			expectError: true,
+		}, {
+			input:       []string{"key=a,b"},
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		actual, err := ParseLabels(c.input)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("on input %q: expected error, got nil", c.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("on input %q: unexpected error: %v", c.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, c.expect) {
+			t.Errorf("on input %q: expected %v, got %v", c.input, c.expect, actual)
+		}
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{
+		"role": "controller",
+		"zone": "a",
+	}
+
+	cases := []struct {
+		selector string
+		expect   bool
+	}{
+		{"role=controller", true},
+		{"role=satellite", false},
+		{"role=controller,zone=a", true},
+		{"role=controller,zone=b", false},
+		{"role!=satellite", true},
+		{"role!=controller", false},
+		{"zone", true},
+		{"missing", false},
+		{"!missing", true},
+		{"!zone", false},
+		{"missing!=x", true},
+	}
+
+	for _, c := range cases {
+		s, err := ParseLabelSelector(c.selector)
+		if err != nil {
+			t.Errorf("on selector '%s': unexpected error: %v", c.selector, err)
+			continue
+		}
+		if actual := s.Matches(labels); actual != c.expect {
+			t.Errorf("on selector '%s': expected %v, got %v", c.selector, c.expect, actual)
+		}
+	}
+
+	for _, invalid := range []string{"", ",", "=value", "!"} {
+		if _, err := ParseLabelSelector(invalid); err == nil {
+			t.Errorf("on selector '%s': expected error, got nil", invalid)
+		}
+	}
+}
@@ -5,14 +5,17 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
 
 	libvirt "github.com/digitalocean/go-libvirt"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
 
 type FakeLibvirtConnection struct {
-	vols            map[string]*FakeLibvirtStorageVol
-	network         *FakeLibvirtNetwork
+	vols    map[string]*FakeLibvirtStorageVol
+	network *FakeLibvirtNetwork
+	// networks contains network and any additional networks
+	networks        map[string]*FakeLibvirtNetwork
 	domains         map[string]*FakeLibvirtDomain
 	lifecycleEvents <-chan libvirt.DomainEventLifecycleMsg
 }
@@ -24,19 +27,26 @@ type FakeLibvirtStorageVol struct {
 
 type FakeLibvirtNetwork struct {
 	description *libvirtxml.Network
+	active      bool
+	autostart   bool
 }
 
 type FakeLibvirtDomain struct {
 	description *libvirtxml.Domain
 	persistent  bool
 	active      bool
+	snapshots   map[string]*libvirtxml.DomainSnapshot
+	current     string
+	rebooted    bool
 }
 
 func newFakeLibvirtConnection() *FakeLibvirtConnection {
+	network := fakeLibvirtNetwork()
 	return &FakeLibvirtConnection{
-		vols:    make(map[string]*FakeLibvirtStorageVol),
-		network: fakeLibvirtNetwork(),
-		domains: make(map[string]*FakeLibvirtDomain),
+		vols:     make(map[string]*FakeLibvirtStorageVol),
+		network:  network,
+		networks: map[string]*FakeLibvirtNetwork{networkName: network},
+		domains:  make(map[string]*FakeLibvirtDomain),
 	}
 }
 
@@ -53,6 +63,16 @@ func (l *FakeLibvirtConnection) StoragePoolLookupByName(Name string) (rPool libv
 	}, nil
 }
 
+func (l *FakeLibvirtConnection) StoragePoolListAllVolumes(Pool libvirt.StoragePool, NeedResults int32, Flags uint32) (rVols []libvirt.StorageVol, rRet uint32, err error) {
+	for name := range l.vols {
+		rVols = append(rVols, libvirt.StorageVol{
+			Name: name,
+		})
+	}
+
+	return rVols, uint32(len(rVols)), nil
+}
+
 func (l *FakeLibvirtConnection) StorageVolCreateXML(Pool libvirt.StoragePool, XML string, Flags libvirt.StorageVolCreateFlags) (rVol libvirt.StorageVol, err error) {
 	description := &libvirtxml.StorageVolume{}
 	if err := description.Unmarshal(XML); err != nil {
@@ -111,11 +131,17 @@ func (l *FakeLibvirtConnection) StorageVolUpload(Vol libvirt.StorageVol, outStre
 }
 
 func (l *FakeLibvirtConnection) StorageVolGetXMLDesc(Vol libvirt.StorageVol, Flags uint32) (rXML string, err error) {
-	if Vol.Name != imageName {
-		return "", errors.New("unknown volume")
+	vol, ok := l.vols[Vol.Name]
+	if !ok {
+		return "", mockLibvirtError(errNoStorageVol)
+	}
+
+	description := vol.description
+	if description == nil {
+		description = &libvirtxml.StorageVolume{Name: Vol.Name}
 	}
 
-	xml, err := l.vols[Vol.Name].description.Marshal()
+	xml, err := description.Marshal()
 	if err != nil {
 		panic(err)
 	}
@@ -169,8 +195,33 @@ func (l *FakeLibvirtConnection) StorageVolGetInfo(Vol libvirt.StorageVol) (rType
 	return 0, 42, 23, nil
 }
 
+func (l *FakeLibvirtConnection) StorageVolLookupByPath(Path string) (rVol libvirt.StorageVol, err error) {
+	for name, vol := range l.vols {
+		if vol.description != nil && vol.description.Target != nil && vol.description.Target.Path == Path {
+			return libvirt.StorageVol{
+				Name: name,
+			}, nil
+		}
+	}
+
+	// all volumes share the same path in this fake, so assume the image
+	// is meant
+	_, ok := l.vols[imageName]
+	if Path != backingPath || !ok {
+		return libvirt.StorageVol{}, mockLibvirtError(errNoStorageVol)
+	}
+
+	return libvirt.StorageVol{
+		Name: imageName,
+	}, nil
+}
+
+func (l *FakeLibvirtConnection) StoragePoolRefresh(Pool libvirt.StoragePool, Flags uint32) (err error) {
+	return nil
+}
+
 func (l *FakeLibvirtConnection) NetworkLookupByName(Name string) (rNet libvirt.Network, err error) {
-	if Name != networkName {
+	if _, ok := l.networks[Name]; !ok {
 		return libvirt.Network{}, errors.New("unknown network")
 	}
 
@@ -180,11 +231,12 @@ func (l *FakeLibvirtConnection) NetworkLookupByName(Name string) (rNet libvirt.N
 }
 
 func (l *FakeLibvirtConnection) NetworkGetXMLDesc(Net libvirt.Network, Flags uint32) (rXML string, err error) {
-	if Net.Name != networkName {
+	network, ok := l.networks[Net.Name]
+	if !ok {
 		return "", errors.New("unknown network")
 	}
 
-	xml, err := l.network.description.Marshal()
+	xml, err := network.description.Marshal()
 	if err != nil {
 		panic(err)
 	}
@@ -192,7 +244,8 @@ func (l *FakeLibvirtConnection) NetworkGetXMLDesc(Net libvirt.Network, Flags uin
 }
 
 func (l *FakeLibvirtConnection) NetworkUpdate(Net libvirt.Network, Command uint32, Section uint32, ParentIndex int32, XML string, Flags libvirt.NetworkUpdateFlags) (err error) {
-	if Net.Name != networkName {
+	network, ok := l.networks[Net.Name]
+	if !ok {
 		return errors.New("unknown network")
 	}
 
@@ -201,11 +254,21 @@ func (l *FakeLibvirtConnection) NetworkUpdate(Net libvirt.Network, Command uint3
 	section := Command
 	command := Section
 
+	if section == uint32(libvirt.NetworkSectionDNSHost) {
+		return network.updateDNSHost(command, XML)
+	}
+
 	if section != uint32(libvirt.NetworkSectionIPDhcpHost) {
 		return errors.New("unknown section")
 	}
 
-	hosts := &l.network.description.IPs[0].DHCP.Hosts
+	if ParentIndex < 0 {
+		ParentIndex = 0
+	}
+	if int(ParentIndex) >= len(network.description.IPs) {
+		return errors.New("unknown parent index")
+	}
+	hosts := &network.description.IPs[ParentIndex].DHCP.Hosts
 
 	host := &libvirtxml.NetworkDHCPHost{}
 	if err := host.Unmarshal(XML); err != nil {
@@ -213,11 +276,16 @@ func (l *FakeLibvirtConnection) NetworkUpdate(Net libvirt.Network, Command uint3
 	}
 
 	if command == uint32(libvirt.NetworkUpdateCommandAddLast) {
+		for _, h := range *hosts {
+			if (h.MAC != "" && h.MAC == host.MAC) || h.IP == host.IP {
+				return mockLibvirtError(errOperationInvalid)
+			}
+		}
 		*hosts = append(*hosts, *host)
 	} else if command == uint32(libvirt.NetworkUpdateCommandDelete) {
 		newHosts := []libvirtxml.NetworkDHCPHost{}
 		for _, h := range *hosts {
-			if h.MAC != host.MAC || h.IP != host.IP {
+			if h.MAC != host.MAC || h.Name != host.Name || h.IP != host.IP {
 				newHosts = append(newHosts, h)
 			}
 		}
@@ -235,6 +303,121 @@ func (l *FakeLibvirtConnection) NetworkUpdate(Net libvirt.Network, Command uint3
 	return nil
 }
 
+func (l *FakeLibvirtConnection) NetworkDefineXML(XML string) (rNet libvirt.Network, err error) {
+	description := &libvirtxml.Network{}
+	if err := description.Unmarshal(XML); err != nil {
+		return libvirt.Network{}, fmt.Errorf("invalid network XML: %w", err)
+	}
+	if _, ok := l.networks[description.Name]; ok {
+		return libvirt.Network{}, errors.New("network already exists")
+	}
+	l.networks[description.Name] = &FakeLibvirtNetwork{
+		description: description,
+	}
+	return libvirt.Network{
+		Name: description.Name,
+	}, nil
+}
+
+func (l *FakeLibvirtConnection) NetworkCreate(Net libvirt.Network) (err error) {
+	network, ok := l.networks[Net.Name]
+	if !ok {
+		return errors.New("unknown network")
+	}
+
+	network.active = true
+	return nil
+}
+
+func (l *FakeLibvirtConnection) NetworkSetAutostart(Net libvirt.Network, Autostart int32) (err error) {
+	network, ok := l.networks[Net.Name]
+	if !ok {
+		return errors.New("unknown network")
+	}
+
+	network.autostart = Autostart != 0
+	return nil
+}
+
+func (l *FakeLibvirtConnection) NetworkIsActive(Net libvirt.Network) (rActive int32, err error) {
+	network, ok := l.networks[Net.Name]
+	if !ok {
+		return 0, errors.New("unknown network")
+	}
+
+	return boolToInt32(network.active), nil
+}
+
+func (l *FakeLibvirtConnection) NetworkDestroy(Net libvirt.Network) (err error) {
+	network, ok := l.networks[Net.Name]
+	if !ok {
+		return errors.New("unknown network")
+	}
+
+	network.active = false
+	return nil
+}
+
+func (l *FakeLibvirtConnection) NetworkUndefine(Net libvirt.Network) (err error) {
+	if _, ok := l.networks[Net.Name]; !ok {
+		return errors.New("unknown network")
+	}
+
+	delete(l.networks, Net.Name)
+	return nil
+}
+
+func (l *FakeLibvirtConnection) ConnectListAllNetworks(NeedResults int32, Flags libvirt.ConnectListAllNetworksFlags) (rNets []libvirt.Network, rRet uint32, err error) {
+	for name := range l.networks {
+		rNets = append(rNets, libvirt.Network{
+			Name: name,
+		})
+	}
+
+	return rNets, uint32(len(rNets)), nil
+}
+
+func (n *FakeLibvirtNetwork) updateDNSHost(command uint32, XML string) error {
+	if n.description.DNS == nil {
+		n.description.DNS = &libvirtxml.NetworkDNS{}
+	}
+	hosts := &n.description.DNS.Host
+
+	host := &libvirtxml.NetworkDNSHost{}
+	if err := host.Unmarshal(XML); err != nil {
+		return fmt.Errorf("invalid network DNS host XML: %w", err)
+	}
+
+	if command == uint32(libvirt.NetworkUpdateCommandAddLast) {
+		*hosts = append(*hosts, *host)
+	} else if command == uint32(libvirt.NetworkUpdateCommandDelete) {
+		newHosts := []libvirtxml.NetworkDNSHost{}
+		for _, h := range *hosts {
+			if h.IP != host.IP {
+				newHosts = append(newHosts, h)
+			}
+		}
+		if len(newHosts) == len(*hosts) {
+			return errors.New("DNS host for deletion not found")
+		}
+		*hosts = newHosts
+	} else {
+		return errors.New("unknown command")
+	}
+
+	return nil
+}
+
+func (l *FakeLibvirtConnection) ConnectListAllDomains(NeedResults int32, Flags libvirt.ConnectListAllDomainsFlags) (rDomains []libvirt.Domain, rRet uint32, err error) {
+	for name := range l.domains {
+		rDomains = append(rDomains, libvirt.Domain{
+			Name: name,
+		})
+	}
+
+	return rDomains, uint32(len(rDomains)), nil
+}
+
 func (l *FakeLibvirtConnection) DomainLookupByName(Name string) (rDom libvirt.Domain, err error) {
 	_, ok := l.domains[Name]
 	if !ok {
@@ -264,9 +447,12 @@ func (l *FakeLibvirtConnection) DomainDefineXML(XML string) (rDom libvirt.Domain
 	if err := description.Unmarshal(XML); err != nil {
 		return libvirt.Domain{}, fmt.Errorf("invalid domain XML: %w", err)
 	}
-	if description.Devices.Interfaces[0].MAC == nil {
-		description.Devices.Interfaces[0].MAC = &libvirtxml.DomainInterfaceMAC{
-			Address: "00:11:22:33:44:55",
+	for i := range description.Devices.Interfaces {
+		if description.Devices.Interfaces[i].MAC == nil {
+			description.Devices.Interfaces[i].MAC = &libvirtxml.DomainInterfaceMAC{
+				// like libvirt, generate a different MAC for each domain
+				Address: fmt.Sprintf("00:11:22:33:%02x:%02x", 0x44+len(l.domains), 0x55+i),
+			}
 		}
 	}
 	l.domains[description.Name] = &FakeLibvirtDomain{
@@ -340,6 +526,21 @@ func (l *FakeLibvirtConnection) DomainDestroy(Dom libvirt.Domain) (err error) {
 	return nil
 }
 
+func (l *FakeLibvirtConnection) DomainReboot(Dom libvirt.Domain, Flags libvirt.DomainRebootFlagValues) (err error) {
+	domain, ok := l.domains[Dom.Name]
+	if !ok {
+		return mockLibvirtError(errNoDomain)
+	}
+
+	if !domain.active {
+		return fmt.Errorf("domain is not running")
+	}
+
+	domain.rebooted = true
+
+	return nil
+}
+
 func (l *FakeLibvirtConnection) DomainUndefine(Dom libvirt.Domain) (err error) {
 	domain, ok := l.domains[Dom.Name]
 	if !ok {
@@ -360,15 +561,132 @@ func gcDomain(domains map[string]*FakeLibvirtDomain, name string, domain *FakeLi
 }
 
 func (l *FakeLibvirtConnection) DomainListAllSnapshots(Dom libvirt.Domain, NeedResults int32, Flags uint32) (rSnapshots []libvirt.DomainSnapshot, rRet int32, err error) {
-	_, ok := l.domains[Dom.Name]
+	domain, ok := l.domains[Dom.Name]
 	if !ok {
 		return []libvirt.DomainSnapshot{}, 0, mockLibvirtError(errNoDomain)
 	}
 
-	return []libvirt.DomainSnapshot{}, 0, nil
+	rSnapshots = []libvirt.DomainSnapshot{}
+	for name := range domain.snapshots {
+		rSnapshots = append(rSnapshots, libvirt.DomainSnapshot{
+			Name: name,
+			Dom:  Dom,
+		})
+	}
+
+	return rSnapshots, int32(len(rSnapshots)), nil
 }
 
 func (l *FakeLibvirtConnection) DomainSnapshotDelete(Snap libvirt.DomainSnapshot, Flags libvirt.DomainSnapshotDeleteFlags) (err error) {
+	domain, ok := l.domains[Snap.Dom.Name]
+	if !ok {
+		return mockLibvirtError(errNoDomain)
+	}
+
+	if _, ok := domain.snapshots[Snap.Name]; !ok {
+		return mockLibvirtError(errNoDomainSnapshot)
+	}
+
+	delete(domain.snapshots, Snap.Name)
+
+	return nil
+}
+
+func (l *FakeLibvirtConnection) DomainSnapshotCreateXML(Dom libvirt.Domain, XMLDesc string, Flags uint32) (rSnap libvirt.DomainSnapshot, err error) {
+	domain, ok := l.domains[Dom.Name]
+	if !ok {
+		return libvirt.DomainSnapshot{}, mockLibvirtError(errNoDomain)
+	}
+
+	description := &libvirtxml.DomainSnapshot{}
+	if err := description.Unmarshal(XMLDesc); err != nil {
+		return libvirt.DomainSnapshot{}, fmt.Errorf("invalid snapshot XML: %w", err)
+	}
+
+	if domain.snapshots == nil {
+		domain.snapshots = make(map[string]*libvirtxml.DomainSnapshot)
+	}
+
+	description.CreationTime = strconv.Itoa(len(domain.snapshots) + 1)
+	description.State = "shutoff"
+	if domain.active {
+		description.State = "running"
+	}
+	if domain.current != "" {
+		description.Parent = &libvirtxml.DomainSnapshotParent{Name: domain.current}
+	}
+
+	// libvirt chooses the overlay file names for external snapshots
+	if description.Disks != nil {
+		for i := range description.Disks.Disks {
+			disk := &description.Disks.Disks[i]
+			if disk.Snapshot == "external" && (disk.Source == nil || disk.Source.File == nil || disk.Source.File.File == "") {
+				disk.Source = &libvirtxml.DomainDiskSource{
+					File: &libvirtxml.DomainDiskSourceFile{
+						File: backingPath + "." + description.Name,
+					},
+				}
+			}
+		}
+	}
+
+	domain.snapshots[description.Name] = description
+	domain.current = description.Name
+
+	return libvirt.DomainSnapshot{
+		Name: description.Name,
+		Dom:  Dom,
+	}, nil
+}
+
+func (l *FakeLibvirtConnection) DomainSnapshotLookupByName(Dom libvirt.Domain, Name string, Flags uint32) (rSnap libvirt.DomainSnapshot, err error) {
+	domain, ok := l.domains[Dom.Name]
+	if !ok {
+		return libvirt.DomainSnapshot{}, mockLibvirtError(errNoDomain)
+	}
+
+	if _, ok := domain.snapshots[Name]; !ok {
+		return libvirt.DomainSnapshot{}, mockLibvirtError(errNoDomainSnapshot)
+	}
+
+	return libvirt.DomainSnapshot{
+		Name: Name,
+		Dom:  Dom,
+	}, nil
+}
+
+func (l *FakeLibvirtConnection) DomainSnapshotGetXMLDesc(Snap libvirt.DomainSnapshot, Flags uint32) (rXML string, err error) {
+	domain, ok := l.domains[Snap.Dom.Name]
+	if !ok {
+		return "", mockLibvirtError(errNoDomain)
+	}
+
+	snapshot, ok := domain.snapshots[Snap.Name]
+	if !ok {
+		return "", mockLibvirtError(errNoDomainSnapshot)
+	}
+
+	xml, err := snapshot.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return xml, nil
+}
+
+func (l *FakeLibvirtConnection) DomainRevertToSnapshot(Snap libvirt.DomainSnapshot, Flags uint32) (err error) {
+	domain, ok := l.domains[Snap.Dom.Name]
+	if !ok {
+		return mockLibvirtError(errNoDomain)
+	}
+
+	snapshot, ok := domain.snapshots[Snap.Name]
+	if !ok {
+		return mockLibvirtError(errNoDomainSnapshot)
+	}
+
+	domain.active = snapshot.State == "running"
+	domain.current = Snap.Name
+
 	return nil
 }
 
@@ -391,8 +709,10 @@ func (e libvirtError) Error() string {
 type errorNumber int32
 
 const (
-	errNoDomain     errorNumber = 42
-	errNoStorageVol errorNumber = 50
+	errNoDomain         errorNumber = 42
+	errNoStorageVol     errorNumber = 50
+	errOperationInvalid errorNumber = 55
+	errNoDomainSnapshot errorNumber = 72
 )
 
 func fakeLibvirtNetwork() *FakeLibvirtNetwork {
@@ -425,7 +745,9 @@ func newFakeLibvirtDomain(mac string) *FakeLibvirtDomain {
 				Interfaces: []libvirtxml.DomainInterface{
 					libvirtxml.DomainInterface{
 						Source: &libvirtxml.DomainInterfaceSource{
-							Network: &libvirtxml.DomainInterfaceSourceNetwork{},
+							Network: &libvirtxml.DomainInterfaceSourceNetwork{
+								Network: networkName,
+							},
 						},
 						MAC: &libvirtxml.DomainInterfaceMAC{
 							Address: mac,
@@ -106,9 +106,21 @@ func (v *Virter) vmXML(poolName string, vm VMConfig) (string, error) {
 	}
 	log.Debugf("output are these disks: %+v", disks)
 
+	interfaces, err := v.vmInterfaces(vm)
+	if err != nil {
+		return "", err
+	}
+
+	meta := newVMMetadata(vm)
+	metadata, err := meta.toDomainMetadata()
+	if err != nil {
+		return "", err
+	}
+
 	domain := &lx.Domain{
-		Type: "kvm",
-		Name: vm.Name,
+		Type:     "kvm",
+		Name:     vm.Name,
+		Metadata: metadata,
 		Memory: &lx.DomainMemory{
 			Unit: "KiB",
 			// NOTE: because we cast to uint here, and we always
@@ -156,19 +168,7 @@ func (v *Virter) vmXML(poolName string, vm VMConfig) (string, error) {
 					Model: "virtio-scsi",
 				},
 			},
-			Interfaces: []lx.DomainInterface{
-				lx.DomainInterface{
-					Source: &lx.DomainInterfaceSource{
-						Network: &lx.DomainInterfaceSourceNetwork{
-							Network: v.networkName,
-							Bridge:  "virbr0",
-						},
-					},
-					Model: &lx.DomainInterfaceModel{
-						Type: "virtio",
-					},
-				},
-			},
+			Interfaces: interfaces,
 			Consoles: []lx.DomainConsole{
 				libvirtConsole(vm),
 			},
@@ -187,6 +187,14 @@ func (v *Virter) vmXML(poolName string, vm VMConfig) (string, error) {
 			},
 		},
 	}
+	if vm.GuestAgent {
+		domain.Devices.Channels = []lx.DomainChannel{guestAgentChannel()}
+	}
+
+	if v.userNetwork() {
+		domain.QEMUCommandline = v.userNetworkCommandline(vm.ID)
+	}
+
 	return domain.Marshal()
 }
 
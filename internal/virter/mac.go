@@ -0,0 +1,68 @@
+package virter
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// macNICIndexBits is the number of bits of a generated MAC address
+	// which identify the interface of a VM. The remaining bits after the
+	// OUI prefix contain the VM ID.
+	macNICIndexBits = 4
+	macIDBits       = 24 - macNICIndexBits
+)
+
+// SetMACPrefix configures virter to derive the MAC addresses of the VMs from
+// their IDs, so that an ID is always paired with the same MAC address. The
+// prefix is a 3 byte OUI. Without a prefix, libvirt generates random MAC
+// addresses.
+func (v *Virter) SetMACPrefix(prefix net.HardwareAddr) error {
+	if len(prefix) != 3 {
+		return fmt.Errorf("MAC prefix %v must have 3 bytes", prefix)
+	}
+
+	if prefix[0]&1 != 0 {
+		return fmt.Errorf("MAC prefix %v is a multicast address", prefix)
+	}
+
+	v.macPrefix = prefix
+	return nil
+}
+
+// SetDHCPRelease enables releasing the DHCP leases of removed VMs with
+// dhcp_release. This is only needed when MAC addresses are reused with
+// different IPs, which is not the case for MAC addresses derived from the VM
+// ID.
+func (v *Virter) SetDHCPRelease(release bool) {
+	v.dhcpRelease = release
+}
+
+// vmMAC returns the MAC address of an interface of a VM, or the empty string
+// if libvirt should generate one. Index 0 is the first interface.
+func (v *Virter) vmMAC(id uint, index uint) (string, error) {
+	if v.macPrefix == nil {
+		return "", nil
+	}
+
+	if id >= 1<<macIDBits {
+		return "", fmt.Errorf("ID %d is too large to generate a MAC address", id)
+	}
+
+	if index >= 1<<macNICIndexBits {
+		return "", fmt.Errorf("cannot generate MAC address for more than %d interfaces", 1<<macNICIndexBits)
+	}
+
+	suffix := index<<macIDBits | id
+
+	mac := net.HardwareAddr{
+		v.macPrefix[0],
+		v.macPrefix[1],
+		v.macPrefix[2],
+		byte(suffix >> 16),
+		byte(suffix >> 8),
+		byte(suffix),
+	}
+
+	return mac.String(), nil
+}
@@ -0,0 +1,64 @@
+package virter_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+)
+
+func TestVMRunMACPrefix(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	replication := addReplicationNetwork(l)
+
+	v := virter.New(l, poolName, networkName)
+	err := v.SetMACPrefix(net.HardwareAddr{0x52, 0x54, 0x00})
+	assert.NoError(t, err)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+		ExtraNICs: []virter.NIC{
+			testNIC{network: replicationNetworkName},
+		},
+	}
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	interfaces := l.domains[vmName].description.Devices.Interfaces
+	if assert.Len(t, interfaces, 2) {
+		assert.Equal(t, "52:54:00:00:00:2a", interfaces[0].MAC.Address)
+		assert.Equal(t, "52:54:00:10:00:2a", interfaces[1].MAC.Address)
+	}
+
+	assert.Equal(t, "52:54:00:00:00:2a", l.network.description.IPs[0].DHCP.Hosts[0].MAC)
+	assert.Equal(t, "52:54:00:10:00:2a", replication.description.IPs[0].DHCP.Hosts[0].MAC)
+
+	// the same ID gets the same MAC address again
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+	assert.Equal(t, "52:54:00:00:00:2a", l.domains[vmName].description.Devices.Interfaces[0].MAC.Address)
+}
+
+func TestSetMACPrefixInvalid(t *testing.T) {
+	v := virter.New(newFakeLibvirtConnection(), poolName, networkName)
+
+	err := v.SetMACPrefix(net.HardwareAddr{0x52, 0x54})
+	assert.Error(t, err)
+
+	err = v.SetMACPrefix(net.HardwareAddr{0x01, 0x00, 0x5e})
+	assert.Error(t, err)
+}
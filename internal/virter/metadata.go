@@ -0,0 +1,206 @@
+package virter
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"time"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	lx "github.com/libvirt/libvirt-go-xml"
+)
+
+// Version is the virter version recorded in the metadata of created VMs.
+// It is expected to be set by the main program.
+var Version = "DEV"
+
+// metadataNamespace is the XML namespace of the virter element in the
+// <metadata> section of a domain.
+const metadataNamespace = "https://github.com/LINBIT/virter"
+
+// VMMetadataDisk describes an additional disk of a VM
+type VMMetadataDisk struct {
+	Name   string `json:"name"`
+	Volume string `json:"volume"`
+}
+
+// VMMetadata is the information virter records about a VM it created
+type VMMetadata struct {
+	ImageName    string            `json:"image"`
+	ID           uint              `json:"id"`
+	BootVolume   string            `json:"boot_volume"`
+	CIDataVolume string            `json:"cidata_volume"`
+	Disks        []VMMetadataDisk  `json:"disks"`
+	Created      time.Time         `json:"created"`
+	Version      string            `json:"version"`
+	Labels       map[string]string `json:"labels"`
+}
+
+type vmMetadataLabelXML struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type vmMetadataDiskXML struct {
+	Name   string `xml:"name,attr"`
+	Volume string `xml:"volume,attr"`
+}
+
+type vmMetadataXML struct {
+	XMLName      xml.Name             `xml:"https://github.com/LINBIT/virter vm"`
+	ImageName    string               `xml:"image"`
+	ID           uint                 `xml:"id"`
+	BootVolume   string               `xml:"boot-volume"`
+	CIDataVolume string               `xml:"cidata-volume"`
+	Disks        []vmMetadataDiskXML  `xml:"disks>disk"`
+	Created      string               `xml:"created"`
+	Version      string               `xml:"version"`
+	Labels       []vmMetadataLabelXML `xml:"labels>label"`
+}
+
+type domainMetadataXML struct {
+	VM *vmMetadataXML `xml:"https://github.com/LINBIT/virter vm"`
+}
+
+// newVMMetadata builds the metadata for a VM that is about to be created.
+func newVMMetadata(vm VMConfig) VMMetadata {
+	meta := VMMetadata{
+		ImageName:    vm.ImageName,
+		ID:           vm.ID,
+		BootVolume:   vm.Name,
+		CIDataVolume: ciDataVolumeName(vm.Name),
+		Disks:        []VMMetadataDisk{},
+		Created:      time.Now().UTC().Truncate(time.Second),
+		Version:      Version,
+		Labels:       map[string]string{},
+	}
+
+	for _, d := range vm.Disks {
+		meta.Disks = append(meta.Disks, VMMetadataDisk{
+			Name:   d.GetName(),
+			Volume: diskVolumeName(vm.Name, d.GetName()),
+		})
+	}
+
+	for k, val := range vm.Labels {
+		meta.Labels[k] = val
+	}
+
+	return meta
+}
+
+// Volumes returns the names of all volumes belonging to the VM, except for
+// the boot volume.
+func (m *VMMetadata) Volumes() []string {
+	volumes := []string{m.CIDataVolume}
+	for _, d := range m.Disks {
+		volumes = append(volumes, d.Volume)
+	}
+	return volumes
+}
+
+func (m *VMMetadata) toDomainMetadata() (*lx.DomainMetadata, error) {
+	mx := vmMetadataXML{
+		ImageName:    m.ImageName,
+		ID:           m.ID,
+		BootVolume:   m.BootVolume,
+		CIDataVolume: m.CIDataVolume,
+		Created:      m.Created.Format(time.RFC3339),
+		Version:      m.Version,
+	}
+
+	for _, d := range m.Disks {
+		mx.Disks = append(mx.Disks, vmMetadataDiskXML{Name: d.Name, Volume: d.Volume})
+	}
+
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		mx.Labels = append(mx.Labels, vmMetadataLabelXML{Key: k, Value: m.Labels[k]})
+	}
+
+	doc, err := xml.Marshal(mx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal VM metadata: %w", err)
+	}
+
+	return &lx.DomainMetadata{XML: string(doc)}, nil
+}
+
+// parseVMMetadata extracts the virter metadata from a domain description.
+// It returns nil if the domain does not contain virter metadata.
+func parseVMMetadata(domcfg *lx.Domain) (*VMMetadata, error) {
+	if domcfg.Metadata == nil {
+		return nil, nil
+	}
+
+	var dm domainMetadataXML
+	err := xml.Unmarshal([]byte("<metadata>"+domcfg.Metadata.XML+"</metadata>"), &dm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal VM metadata: %w", err)
+	}
+
+	if dm.VM == nil {
+		return nil, nil
+	}
+
+	mx := dm.VM
+	meta := &VMMetadata{
+		ImageName:    mx.ImageName,
+		ID:           mx.ID,
+		BootVolume:   mx.BootVolume,
+		CIDataVolume: mx.CIDataVolume,
+		Disks:        []VMMetadataDisk{},
+		Version:      mx.Version,
+		Labels:       map[string]string{},
+	}
+
+	if mx.Created != "" {
+		meta.Created, err = time.Parse(time.RFC3339, mx.Created)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse VM creation time: %w", err)
+		}
+	}
+
+	for _, d := range mx.Disks {
+		meta.Disks = append(meta.Disks, VMMetadataDisk{Name: d.Name, Volume: d.Volume})
+	}
+
+	for _, l := range mx.Labels {
+		meta.Labels[l.Key] = l.Value
+	}
+
+	return meta, nil
+}
+
+// getVMMetadata returns the virter metadata of a domain, or nil if the
+// domain was not created by virter.
+func (v *Virter) getVMMetadata(domain libvirt.Domain) (*VMMetadata, error) {
+	domcfg, err := getDomainDescription(v.libvirt, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseVMMetadata(domcfg)
+}
+
+// VMInspect returns the metadata virter recorded when creating a VM.
+func (v *Virter) VMInspect(vmName string) (*VMMetadata, error) {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get domain: %w", err)
+	}
+
+	meta, err := v.getVMMetadata(domain)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("domain '%s' was not created by virter", vmName)
+	}
+
+	return meta, nil
+}
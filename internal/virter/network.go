@@ -0,0 +1,352 @@
+package virter
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	lx "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// NetworkConfig contains the configuration of a libvirt network created by
+// virter.
+type NetworkConfig struct {
+	Name string
+	// Address is the address of the host in the network. If it is the
+	// network address, the first address in the network is used.
+	Address net.IPNet
+	// DHCPStart and DHCPEnd limit the addresses handed out to clients
+	// without a reservation. If they are not set, all addresses of the
+	// network after the host address are used.
+	DHCPStart net.IP
+	DHCPEnd   net.IP
+	DNSDomain string
+	// Isolated networks are not forwarded to the outside of the host.
+	Isolated bool
+}
+
+// NetworkInfo describes a libvirt network.
+type NetworkInfo struct {
+	Name         string               `json:"name"`
+	Active       bool                 `json:"active"`
+	Forward      string               `json:"forward"`
+	Bridge       string               `json:"bridge,omitempty"`
+	Domain       string               `json:"domain,omitempty"`
+	Addresses    []string             `json:"addresses"`
+	Reservations []NetworkReservation `json:"reservations"`
+}
+
+// NetworkReservation is a DHCP reservation in a network.
+type NetworkReservation struct {
+	ID   uint   `json:"id"`
+	IP   string `json:"ip"`
+	MAC  string `json:"mac,omitempty"`
+	Name string `json:"name,omitempty"`
+	// VM is the name of the VM with an interface which holds the
+	// reservation.
+	VM string `json:"vm,omitempty"`
+}
+
+func networkXML(config NetworkConfig) (string, error) {
+	ip := config.Address.IP
+	ipNet := net.IPNet{IP: ip.Mask(config.Address.Mask), Mask: config.Address.Mask}
+	if ip.Equal(ipNet.IP) {
+		ip = addToIP(ipNet.IP, 1)
+	}
+
+	dhcpStart := config.DHCPStart
+	if dhcpStart == nil {
+		dhcpStart = addToIP(ip, 1)
+	}
+
+	dhcpEnd := config.DHCPEnd
+	if dhcpEnd == nil {
+		ones, bits := ipNet.Mask.Size()
+		hostBits := bits - ones
+		if hostBits > maxHostBits {
+			hostBits = maxHostBits
+		}
+		if hostBits < 2 {
+			return "", fmt.Errorf("network %v is too small", ipNet.String())
+		}
+		// exclude the broadcast address
+		dhcpEnd = addToIP(ipNet.IP, uint(1<<hostBits)-2)
+	}
+
+	for _, addr := range []net.IP{ip, dhcpStart, dhcpEnd} {
+		if !ipNet.Contains(addr) {
+			return "", fmt.Errorf("address %v is not in network %v", addr, ipNet.String())
+		}
+	}
+
+	if ipToInt(dhcpStart).Cmp(ipToInt(dhcpEnd)) > 0 {
+		return "", fmt.Errorf("DHCP range %v-%v is empty", dhcpStart, dhcpEnd)
+	}
+
+	prefix, _ := ipNet.Mask.Size()
+	network := lx.Network{
+		Name: config.Name,
+		IPs: []lx.NetworkIP{
+			lx.NetworkIP{
+				Address: ip.String(),
+				Prefix:  uint(prefix),
+				DHCP: &lx.NetworkDHCP{
+					Ranges: []lx.NetworkDHCPRange{
+						lx.NetworkDHCPRange{
+							Start: dhcpStart.String(),
+							End:   dhcpEnd.String(),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if ip.To4() == nil {
+		network.IPs[0].Family = "ipv6"
+	}
+
+	if !config.Isolated {
+		network.Forward = &lx.NetworkForward{Mode: "nat"}
+	}
+
+	if config.DNSDomain != "" {
+		network.Domain = &lx.NetworkDomain{
+			Name:      config.DNSDomain,
+			LocalOnly: "yes",
+		}
+	}
+
+	return network.Marshal()
+}
+
+// NetworkAdd defines and starts a libvirt network. The network is started
+// automatically with the libvirt daemon.
+func (v *Virter) NetworkAdd(config NetworkConfig) error {
+	xml, err := networkXML(config)
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Using network XML: %s", xml)
+
+	// remove the network again if it cannot be started, so that adding
+	// can simply be retried
+	rb := &rollback{}
+	err = v.networkCreate(xml, rb)
+	if err != nil {
+		rb.run()
+		return err
+	}
+
+	return nil
+}
+
+func (v *Virter) networkCreate(xml string, rb *rollback) error {
+	network, err := v.libvirt.NetworkDefineXML(xml)
+	if err != nil {
+		return fmt.Errorf("could not define network: %w", err)
+	}
+	rb.add("undefine network", func() error {
+		return v.libvirt.NetworkUndefine(network)
+	})
+
+	err = v.libvirt.NetworkSetAutostart(network, 1)
+	if err != nil {
+		return fmt.Errorf("could not set network to autostart: %w", err)
+	}
+
+	err = v.libvirt.NetworkCreate(network)
+	if err != nil {
+		return fmt.Errorf("could not start network: %w", err)
+	}
+
+	return nil
+}
+
+// NetworkRm stops and removes a libvirt network. Networks which VMs are
+// attached to cannot be removed.
+func (v *Virter) NetworkRm(name string) error {
+	network, err := v.libvirt.NetworkLookupByName(name)
+	if err != nil {
+		return fmt.Errorf("could not get network: %w", err)
+	}
+
+	attached, err := v.getNetworkVMs(name)
+	if err != nil {
+		return err
+	}
+	if len(attached) > 0 {
+		return fmt.Errorf("network '%s' is in use by VMs: %s", name, strings.Join(attached, ", "))
+	}
+
+	active, err := v.libvirt.NetworkIsActive(network)
+	if err != nil {
+		return fmt.Errorf("could not check if network is active: %w", err)
+	}
+
+	if active != 0 {
+		err = v.libvirt.NetworkDestroy(network)
+		if err != nil {
+			return fmt.Errorf("could not stop network: %w", err)
+		}
+	}
+
+	err = v.libvirt.NetworkUndefine(network)
+	if err != nil {
+		return fmt.Errorf("could not undefine network: %w", err)
+	}
+
+	return nil
+}
+
+// NetworkList returns all libvirt networks together with their DHCP
+// reservations.
+func (v *Virter) NetworkList() ([]NetworkInfo, error) {
+	networks, _, err := v.libvirt.ConnectListAllNetworks(-1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list networks: %w", err)
+	}
+
+	result := []NetworkInfo{}
+	for _, network := range networks {
+		info, err := v.getNetworkInfo(network)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+
+	return result, nil
+}
+
+func (v *Virter) getNetworkInfo(network libvirt.Network) (NetworkInfo, error) {
+	networkDescription, err := getNetworkDescription(v.libvirt, network)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+
+	active, err := v.libvirt.NetworkIsActive(network)
+	if err != nil {
+		return NetworkInfo{}, fmt.Errorf("could not check if network '%s' is active: %w", network.Name, err)
+	}
+
+	info := NetworkInfo{
+		Name:         network.Name,
+		Active:       active != 0,
+		Forward:      forwardMode(networkDescription),
+		Addresses:    []string{},
+		Reservations: []NetworkReservation{},
+	}
+	if info.Forward == "" {
+		info.Forward = "isolated"
+	}
+	if networkDescription.Bridge != nil {
+		info.Bridge = networkDescription.Bridge.Name
+	}
+	if networkDescription.Domain != nil {
+		info.Domain = networkDescription.Domain.Name
+	}
+
+	// networks which are managed outside libvirt have no addresses
+	if len(networkDescription.IPs) == 0 {
+		return info, nil
+	}
+
+	ranges, err := getNetworkRanges(networkDescription)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+
+	hasDHCP := false
+	for _, r := range ranges {
+		ones, _ := r.ipNet.Mask.Size()
+		address := networkDescription.IPs[r.index].Address
+		info.Addresses = append(info.Addresses, fmt.Sprintf("%s/%d", address, ones))
+		hasDHCP = hasDHCP || r.dhcp != nil
+	}
+
+	if !hasDHCP {
+		return info, nil
+	}
+
+	hosts, err := v.getDHCPHosts(network)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+
+	vmsByMAC, err := v.getNetworkVMsByMAC(network.Name)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+
+	for _, host := range hosts {
+		reservation := NetworkReservation{
+			IP:   host.IP,
+			MAC:  host.MAC,
+			Name: host.Name,
+			VM:   vmsByMAC[host.MAC],
+		}
+
+		// reservations which were not made by virter may be outside of
+		// the range of IDs
+		id, err := ipToID(host.networkRange.ipNet, net.ParseIP(host.IP))
+		if err == nil {
+			reservation.ID = id
+		}
+
+		if reservation.VM == "" && host.networkRange.ipv6() {
+			reservation.VM = host.Name
+		}
+
+		info.Reservations = append(info.Reservations, reservation)
+	}
+
+	return info, nil
+}
+
+// getNetworkVMsByMAC returns the names of the VMs attached to a network,
+// indexed by the MAC addresses of their interfaces.
+func (v *Virter) getNetworkVMsByMAC(networkName string) (map[string]string, error) {
+	domains, _, err := v.libvirt.ConnectListAllDomains(-1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list domains: %w", err)
+	}
+
+	vms := map[string]string{}
+	for _, domain := range domains {
+		ifaces, err := v.getDomainNetworkInterfaces(domain)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, iface := range ifaces {
+			if iface.network == networkName {
+				vms[iface.mac] = domain.Name
+			}
+		}
+	}
+
+	return vms, nil
+}
+
+// getNetworkVMs returns the names of the VMs attached to a network.
+func (v *Virter) getNetworkVMs(networkName string) ([]string, error) {
+	vmsByMAC, err := v.getNetworkVMsByMAC(networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	vms := []string{}
+	for _, vmName := range vmsByMAC {
+		vms = append(vms, vmName)
+	}
+	sort.Strings(vms)
+
+	return vms, nil
+}
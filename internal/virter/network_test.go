@@ -0,0 +1,178 @@
+package virter_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+)
+
+func parseCIDR(t *testing.T, s string) net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	assert.NoError(t, err)
+	return net.IPNet{IP: ip, Mask: ipNet.Mask}
+}
+
+func TestNetworkAdd(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.NetworkAdd(virter.NetworkConfig{
+		Name:      "nat-net",
+		Address:   parseCIDR(t, "10.1.0.0/24"),
+		DNSDomain: "cluster.test",
+	})
+	assert.NoError(t, err)
+
+	network := l.networks["nat-net"]
+	assert.True(t, network.active)
+	assert.True(t, network.autostart)
+	assert.Equal(t, "nat", network.description.Forward.Mode)
+	assert.Equal(t, "cluster.test", network.description.Domain.Name)
+	if assert.Len(t, network.description.IPs, 1) {
+		ip := network.description.IPs[0]
+		assert.Equal(t, "10.1.0.1", ip.Address)
+		assert.Equal(t, uint(24), ip.Prefix)
+		if assert.Len(t, ip.DHCP.Ranges, 1) {
+			assert.Equal(t, "10.1.0.2", ip.DHCP.Ranges[0].Start)
+			assert.Equal(t, "10.1.0.254", ip.DHCP.Ranges[0].End)
+		}
+	}
+
+	err = v.NetworkAdd(virter.NetworkConfig{
+		Name:      "isolated-net",
+		Address:   parseCIDR(t, "10.2.0.254/24"),
+		DHCPStart: net.ParseIP("10.2.0.100"),
+		DHCPEnd:   net.ParseIP("10.2.0.199"),
+		Isolated:  true,
+	})
+	assert.NoError(t, err)
+
+	network = l.networks["isolated-net"]
+	assert.Nil(t, network.description.Forward)
+	assert.Nil(t, network.description.Domain)
+	assert.Equal(t, "10.2.0.254", network.description.IPs[0].Address)
+	if assert.Len(t, network.description.IPs[0].DHCP.Ranges, 1) {
+		assert.Equal(t, "10.2.0.100", network.description.IPs[0].DHCP.Ranges[0].Start)
+		assert.Equal(t, "10.2.0.199", network.description.IPs[0].DHCP.Ranges[0].End)
+	}
+}
+
+func TestNetworkAddInvalid(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.NetworkAdd(virter.NetworkConfig{
+		Name:      "invalid-range",
+		Address:   parseCIDR(t, "10.1.0.1/24"),
+		DHCPStart: net.ParseIP("10.1.1.2"),
+	})
+	assert.Error(t, err)
+
+	err = v.NetworkAdd(virter.NetworkConfig{
+		Name:    "too-small",
+		Address: parseCIDR(t, "10.1.0.1/31"),
+	})
+	assert.Error(t, err)
+
+	err = v.NetworkAdd(virter.NetworkConfig{
+		Name:    networkName,
+		Address: parseCIDR(t, "10.1.0.1/24"),
+	})
+	assert.Error(t, err)
+
+	assert.Len(t, l.networks, 1)
+}
+
+func TestNetworkList(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+	l.network.active = true
+	fakeNetworkAddHost(l.network, "52:54:00:00:00:01", "192.168.122.10")
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.NetworkAdd(virter.NetworkConfig{
+		Name:     "isolated-net",
+		Address:  parseCIDR(t, "10.2.0.1/24"),
+		Isolated: true,
+	})
+	assert.NoError(t, err)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	networks, err := v.NetworkList()
+	assert.NoError(t, err)
+	assert.Equal(t, []virter.NetworkInfo{
+		{
+			Name:         "isolated-net",
+			Active:       true,
+			Forward:      "isolated",
+			Addresses:    []string{"10.2.0.1/24"},
+			Reservations: []virter.NetworkReservation{},
+		}, {
+			Name:      networkName,
+			Active:    true,
+			Forward:   "isolated",
+			Addresses: []string{"192.168.122.1/24"},
+			Reservations: []virter.NetworkReservation{
+				{ID: 10, IP: "192.168.122.10", MAC: "52:54:00:00:00:01"},
+				{ID: vmID, IP: vmIP, MAC: "00:11:22:33:44:55", VM: vmName},
+			},
+		},
+	}, networks)
+}
+
+func TestNetworkRm(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.NetworkAdd(virter.NetworkConfig{
+		Name:    replicationNetworkName,
+		Address: parseCIDR(t, "10.0.0.1/24"),
+	})
+	assert.NoError(t, err)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+		ExtraNICs: []virter.NIC{testNIC{network: replicationNetworkName}},
+	}
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	err = v.NetworkRm(replicationNetworkName)
+	assert.Error(t, err)
+	assert.Contains(t, l.networks, replicationNetworkName)
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+
+	err = v.NetworkRm(replicationNetworkName)
+	assert.NoError(t, err)
+	assert.NotContains(t, l.networks, replicationNetworkName)
+
+	err = v.NetworkRm(replicationNetworkName)
+	assert.Error(t, err)
+}
@@ -0,0 +1,334 @@
+package virter
+
+import (
+	"fmt"
+	"net"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	lx "github.com/libvirt/libvirt-go-xml"
+)
+
+// NIC is an additional network interface of a VM. Every VM has an interface
+// on the network or host bridge virter is configured with. Additional
+// interfaces are attached to other libvirt networks and get an IP derived
+// from the VM ID in each of them.
+type NIC interface {
+	GetNetwork() string
+	GetModel() string
+	// GetMAC returns the MAC address of the interface. If it is empty,
+	// the MAC address is derived from the VM ID or generated by libvirt.
+	GetMAC() string
+}
+
+// VMInterface describes a network interface of a VM and the addresses
+// reserved for it.
+type VMInterface struct {
+	Network string   `json:"network"`
+	Bridge  string   `json:"bridge,omitempty"`
+	MAC     string   `json:"mac"`
+	Model   string   `json:"model"`
+	IPs     []string `json:"ips"`
+}
+
+func checkNICs(vmConfig VMConfig) error {
+	networks := map[string]bool{}
+	for _, n := range vmConfig.ExtraNICs {
+		if n.GetNetwork() == "" {
+			return fmt.Errorf("cannot attach network interface without network")
+		}
+		if networks[n.GetNetwork()] {
+			return fmt.Errorf("cannot attach more than one network interface to network '%s'", n.GetNetwork())
+		}
+		networks[n.GetNetwork()] = true
+
+		if n.GetMAC() != "" {
+			if _, err := net.ParseMAC(n.GetMAC()); err != nil {
+				return fmt.Errorf("invalid MAC address for network '%s': %w", n.GetNetwork(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// vmNetworkNames returns the names of all libvirt networks a VM is attached
+// to.
+func (v *Virter) vmNetworkNames(vmConfig VMConfig) []string {
+	names := []string{}
+	if v.usesLibvirtNetwork() {
+		names = append(names, v.networkName)
+	}
+	for _, n := range vmConfig.ExtraNICs {
+		names = append(names, n.GetNetwork())
+	}
+	return names
+}
+
+// checkNetworks checks that the additional interfaces of a VM can be
+// attached.
+func (v *Virter) checkNetworks(vmConfig VMConfig) error {
+	if len(vmConfig.ExtraNICs) == 0 {
+		return nil
+	}
+
+	if v.userNetwork() {
+		return fmt.Errorf("additional network interfaces are not supported with user-mode networking")
+	}
+
+	for _, n := range vmConfig.ExtraNICs {
+		if v.usesLibvirtNetwork() && n.GetNetwork() == v.networkName {
+			return fmt.Errorf("network '%s' is already attached as the default network", n.GetNetwork())
+		}
+	}
+
+	return nil
+}
+
+// vmInterfaces returns the interfaces of a VM. The first interface is
+// attached to the host bridge if one is configured, otherwise to the
+// configured libvirt network.
+func (v *Virter) vmInterfaces(vm VMConfig) ([]lx.DomainInterface, error) {
+	if v.userNetwork() {
+		return nil, nil
+	}
+
+	var interfaces []lx.DomainInterface
+	if v.hostBridge != nil {
+		iface, err := v.hostBridge.domainInterface(vm.ID)
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, iface)
+	} else {
+		mac, err := v.vmMAC(vm.ID, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		iface, err := v.networkInterface(v.networkName, "virtio", mac)
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, iface)
+	}
+
+	for i, n := range vm.ExtraNICs {
+		mac := n.GetMAC()
+		if mac == "" {
+			var err error
+			mac, err = v.vmMAC(vm.ID, uint(i+1))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		iface, err := v.networkInterface(n.GetNetwork(), n.GetModel(), mac)
+		if err != nil {
+			return nil, err
+		}
+		interfaces = append(interfaces, iface)
+	}
+
+	return interfaces, nil
+}
+
+// networkInterface returns an interface attached to a libvirt network. The
+// bridge is only set for networks where libvirt manages the bridge itself;
+// for networks which forward to a host bridge or a physical device
+// (macvtap/direct), libvirt picks the device when the domain is started.
+func (v *Virter) networkInterface(networkName string, model string, mac string) (lx.DomainInterface, error) {
+	network, err := v.libvirt.NetworkLookupByName(networkName)
+	if err != nil {
+		return lx.DomainInterface{}, fmt.Errorf("could not get network '%s': %w", networkName, err)
+	}
+
+	networkDescription, err := getNetworkDescription(v.libvirt, network)
+	if err != nil {
+		return lx.DomainInterface{}, err
+	}
+
+	source := &lx.DomainInterfaceSourceNetwork{
+		Network: networkName,
+	}
+
+	switch forwardMode(networkDescription) {
+	case "", "nat", "route", "open":
+		if networkDescription.Bridge != nil {
+			source.Bridge = networkDescription.Bridge.Name
+		}
+	case "bridge", "private", "vepa", "passthrough":
+	default:
+		return lx.DomainInterface{}, fmt.Errorf("network '%s' has unsupported forward mode '%s'",
+			networkName, forwardMode(networkDescription))
+	}
+
+	iface := lx.DomainInterface{
+		Source: &lx.DomainInterfaceSource{
+			Network: source,
+		},
+		Model: &lx.DomainInterfaceModel{
+			Type: model,
+		},
+	}
+	if mac != "" {
+		iface.MAC = &lx.DomainInterfaceMAC{Address: mac}
+	}
+
+	return iface, nil
+}
+
+// externalNetwork returns whether a network forwards to a host bridge or a
+// physical device. libvirt does not provide DHCP on such networks, so no
+// addresses are reserved for the VMs.
+func (v *Virter) externalNetwork(network libvirt.Network) (bool, error) {
+	networkDescription, err := getNetworkDescription(v.libvirt, network)
+	if err != nil {
+		return false, err
+	}
+
+	switch forwardMode(networkDescription) {
+	case "bridge", "private", "vepa", "passthrough":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// forwardMode returns the forward mode of a network. It is empty for
+// isolated networks.
+func forwardMode(networkDescription *lx.Network) string {
+	if networkDescription.Forward == nil {
+		return ""
+	}
+	if networkDescription.Forward.Mode == "" {
+		return "nat"
+	}
+	return networkDescription.Forward.Mode
+}
+
+// domainNetworkInterface is an interface of a domain which is attached to a
+// libvirt network.
+type domainNetworkInterface struct {
+	network string
+	mac     string
+	model   string
+}
+
+// getDomainNetworkInterfaces returns the interfaces of a domain which are
+// attached to libvirt networks, starting with the interface on the default
+// network.
+func (v *Virter) getDomainNetworkInterfaces(domain libvirt.Domain) ([]domainNetworkInterface, error) {
+	domainDescription, err := getDomainDescription(v.libvirt, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if domainDescription.Devices == nil {
+		return nil, fmt.Errorf("no devices in domain")
+	}
+
+	result := []domainNetworkInterface{}
+	for _, iface := range domainDescription.Devices.Interfaces {
+		if iface.Source == nil || iface.Source.Network == nil || iface.MAC == nil {
+			continue
+		}
+
+		n := domainNetworkInterface{
+			network: iface.Source.Network.Network,
+			mac:     iface.MAC.Address,
+		}
+		if iface.Model != nil {
+			n.model = iface.Model.Type
+		}
+		result = append(result, n)
+	}
+
+	return result, nil
+}
+
+// VMInterfaces returns the network interfaces of a VM together with the
+// addresses reserved for them. Addresses of interfaces without reservations
+// are queried from the guest agent, if the VM has one.
+func (v *Virter) VMInterfaces(vmName string) ([]VMInterface, error) {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get domain: %w", err)
+	}
+
+	if v.userNetwork() {
+		return []VMInterface{{IPs: []string{userNetworkIP}}}, nil
+	}
+
+	ifaces, err := v.getDomainNetworkInterfaces(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []VMInterface{}
+	if v.hostBridge != nil {
+		mac, err := v.getMAC(domain)
+		if err != nil {
+			return nil, err
+		}
+
+		bridgeInterface := VMInterface{
+			Bridge: v.hostBridge.Name,
+			MAC:    mac,
+			Model:  "virtio",
+		}
+		if lease, err := v.hostBridge.leaseForMAC(mac); err == nil {
+			bridgeInterface.IPs = []string{lease.IP.String()}
+		}
+		result = append(result, bridgeInterface)
+	}
+
+	for _, iface := range ifaces {
+		network, err := v.libvirt.NetworkLookupByName(iface.network)
+		if err != nil {
+			return nil, fmt.Errorf("could not get network '%s': %w", iface.network, err)
+		}
+
+		external, err := v.externalNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+
+		ips := []string{}
+		if !external {
+			ips, err = v.findIPs(network, vmName, iface.mac)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		result = append(result, VMInterface{
+			Network: iface.network,
+			MAC:     iface.mac,
+			Model:   iface.model,
+			IPs:     ips,
+		})
+	}
+
+	// networks which are managed outside libvirt have no reservations, but
+	// the guest agent may know the addresses
+	missingIPs := false
+	for _, iface := range result {
+		missingIPs = missingIPs || len(iface.IPs) == 0
+	}
+
+	if missingIPs {
+		domainDescription, err := getDomainDescription(v.libvirt, domain)
+		if err != nil {
+			return nil, err
+		}
+
+		guestIPs := v.guestIPsByMAC(domainDescription)
+		for i := range result {
+			if len(result[i].IPs) == 0 && guestIPs[result[i].MAC] != nil {
+				result[i].IPs = guestIPs[result[i].MAC]
+			}
+		}
+	}
+
+	return result, nil
+}
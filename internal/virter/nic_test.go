@@ -0,0 +1,228 @@
+package virter_test
+
+import (
+	"context"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+)
+
+const replicationNetworkName = "replication"
+
+type testNIC struct {
+	network string
+	mac     string
+}
+
+func (n testNIC) GetNetwork() string { return n.network }
+func (n testNIC) GetModel() string   { return "virtio" }
+func (n testNIC) GetMAC() string     { return n.mac }
+
+func addReplicationNetwork(l *FakeLibvirtConnection) *FakeLibvirtNetwork {
+	network := &FakeLibvirtNetwork{
+		description: &libvirtxml.Network{
+			IPs: []libvirtxml.NetworkIP{
+				libvirtxml.NetworkIP{
+					Address: "10.0.0.1",
+					Prefix:  24,
+					DHCP:    &libvirtxml.NetworkDHCP{},
+				},
+			},
+		},
+	}
+	l.networks[replicationNetworkName] = network
+	return network
+}
+
+func TestVMRunExtraNICs(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	replication := addReplicationNetwork(l)
+	// the highest ID is already used in the additional network
+	fakeNetworkAddHost(replication, "52:54:00:00:00:01", "10.0.0.254")
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+		ExtraNICs: []virter.NIC{testNIC{network: replicationNetworkName, mac: "52:54:00:00:00:02"}},
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	interfaces := l.domains[vmName].description.Devices.Interfaces
+	if assert.Len(t, interfaces, 2) {
+		assert.Equal(t, replicationNetworkName, interfaces[1].Source.Network.Network)
+		assert.Equal(t, "52:54:00:00:00:02", interfaces[1].MAC.Address)
+	}
+
+	assert.Equal(t, "192.168.122.253", l.network.description.IPs[0].DHCP.Hosts[0].IP)
+	assert.Equal(t, "10.0.0.253", replication.description.IPs[0].DHCP.Hosts[1].IP)
+
+	ifaces, err := v.VMInterfaces(vmName)
+	assert.NoError(t, err)
+	assert.Equal(t, []virter.VMInterface{
+		{
+			Network: networkName,
+			MAC:     "00:11:22:33:44:55",
+			Model:   "virtio",
+			IPs:     []string{"192.168.122.253"},
+		}, {
+			Network: replicationNetworkName,
+			MAC:     "52:54:00:00:00:02",
+			Model:   "virtio",
+			IPs:     []string{"10.0.0.253"},
+		},
+	}, ifaces)
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+	assert.Empty(t, l.network.description.IPs[0].DHCP.Hosts)
+	assert.Len(t, replication.description.IPs[0].DHCP.Hosts, 1)
+}
+
+func TestVMRunExtraNICsInvalid(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	addReplicationNetwork(l)
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+
+	c.ExtraNICs = []virter.NIC{testNIC{network: networkName}}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.Error(t, err)
+
+	c.ExtraNICs = []virter.NIC{testNIC{network: "nonexistent"}}
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.Error(t, err)
+	assert.Empty(t, l.domains)
+
+	c.ExtraNICs = []virter.NIC{
+		testNIC{network: replicationNetworkName},
+		testNIC{network: replicationNetworkName},
+	}
+	_, err = virter.CheckVMConfig(c)
+	assert.Error(t, err)
+
+	c.ExtraNICs = []virter.NIC{testNIC{network: replicationNetworkName, mac: "invalid"}}
+	_, err = virter.CheckVMConfig(c)
+	assert.Error(t, err)
+}
+
+func TestVMRunNetworkForwardMode(t *testing.T) {
+	cases := []struct {
+		descr       string
+		forward     *libvirtxml.NetworkForward
+		bridge      string
+		external    bool
+		expectError bool
+	}{
+		{
+			descr:  "isolated",
+			bridge: "virbr1",
+		},
+		{
+			descr:   "nat",
+			forward: &libvirtxml.NetworkForward{Mode: "nat"},
+			bridge:  "virbr1",
+		},
+		{
+			descr:    "bridge",
+			forward:  &libvirtxml.NetworkForward{Mode: "bridge"},
+			external: true,
+		},
+		{
+			descr:    "macvtap",
+			forward:  &libvirtxml.NetworkForward{Mode: "passthrough"},
+			external: true,
+		},
+		{
+			descr:       "hostdev",
+			forward:     &libvirtxml.NetworkForward{Mode: "hostdev"},
+			expectError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.descr, func(t *testing.T) {
+			l := newFakeLibvirtConnection()
+
+			l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+			replication := addReplicationNetwork(l)
+			replication.description.Forward = c.forward
+			replication.description.Bridge = &libvirtxml.NetworkBridge{Name: "virbr1"}
+			if c.external {
+				replication.description.IPs = nil
+			}
+
+			v := virter.New(l, poolName, networkName)
+
+			vmConfig := virter.VMConfig{
+				ImageName: imageName,
+				Name:      vmName,
+				ID:        vmID,
+				VCPUs:     1,
+				MemoryKiB: 1024,
+				ExtraNICs: []virter.NIC{testNIC{network: replicationNetworkName}},
+			}
+			err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, vmConfig)
+			if c.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			interfaces := l.domains[vmName].description.Devices.Interfaces
+			if assert.Len(t, interfaces, 2) {
+				assert.Equal(t, "", interfaces[0].Source.Network.Bridge)
+				assert.Equal(t, replicationNetworkName, interfaces[1].Source.Network.Network)
+				assert.Equal(t, c.bridge, interfaces[1].Source.Network.Bridge)
+			}
+
+			err = v.VMRm(vmName)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestVMRunExternalNetwork(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	l.network.description.Forward = &libvirtxml.NetworkForward{Mode: "bridge"}
+	l.network.description.IPs = nil
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.Error(t, err)
+	assert.Empty(t, l.domains)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/helm/helm/pkg/strvals"
@@ -22,19 +23,112 @@ type ProvisionDockerStep struct {
 type ProvisionShellStep struct {
 	Script string            `toml:"script"`
 	Env    map[string]string `toml:"env"`
+	// vmTemplateValues are set if the step has to be rendered for each VM
+	vmTemplateValues map[string]string
+	// deferredFields are the fields which are rendered for each VM
+	deferredFields map[string]bool
+	// provisionedVMs are all VMs in the template data, if the step only
+	// runs on some of them
+	provisionedVMs []string
 }
 
 // ProvisionRsyncStep is used to copy files to the target via the rsync utility
 type ProvisionRsyncStep struct {
 	Source string `toml:"source"`
 	Dest   string `toml:"dest"`
+	// vmTemplateValues are set if the step has to be rendered for each VM
+	vmTemplateValues map[string]string
+	// deferredFields are the fields which are rendered for each VM
+	deferredFields map[string]bool
+	// provisionedVMs are all VMs in the template data, if the step only
+	// runs on some of them
+	provisionedVMs []string
+}
+
+// ProvisionFetchStep is used to copy files from the VMs to the host via the
+// rsync utility
+type ProvisionFetchStep struct {
+	Source string `toml:"source"`
+	// Dest is the directory on the host. The files of each VM are copied to
+	// a subdirectory named like the VM.
+	Dest string `toml:"dest"`
+	// Always runs the step even if an earlier step failed
+	Always bool `toml:"always"`
+	// vmTemplateValues are set if the step has to be rendered for each VM
+	vmTemplateValues map[string]string
+	// deferredFields are the fields which are rendered for each VM
+	deferredFields map[string]bool
+	// provisionedVMs are all VMs in the template data, if the step only
+	// runs on some of them
+	provisionedVMs []string
+}
+
+// ProvisionAnsibleStep runs an Ansible playbook on the host against the VMs
+type ProvisionAnsibleStep struct {
+	Playbook string            `toml:"playbook"`
+	Env      map[string]string `toml:"env"`
+	// Groups maps inventory group names to the names of the VMs in them
+	Groups map[string][]string `toml:"groups"`
+	// HostVars maps VM names to variables of the host in the inventory
+	HostVars map[string]map[string]string `toml:"host_vars"`
+	// ExtraVars are passed to the playbook in addition to the values of
+	// the provisioning file, which they override
+	ExtraVars map[string]string `toml:"extra_vars"`
+	// Args are additional arguments for ansible-playbook
+	Args []string `toml:"args"`
 }
 
 // ProvisionStep is a single provisioniong step
 type ProvisionStep struct {
-	Docker *ProvisionDockerStep `toml:"docker,omitempty"`
-	Shell  *ProvisionShellStep  `toml:"shell,omitempty"`
-	Rsync  *ProvisionRsyncStep  `toml:"rsync,omitempty"`
+	Docker  *ProvisionDockerStep  `toml:"docker,omitempty"`
+	Shell   *ProvisionShellStep   `toml:"shell,omitempty"`
+	Rsync   *ProvisionRsyncStep   `toml:"rsync,omitempty"`
+	Ansible *ProvisionAnsibleStep `toml:"ansible,omitempty"`
+	Fetch   *ProvisionFetchStep   `toml:"fetch,omitempty"`
+	// Targets restricts the step to the VMs matching any of the entries:
+	// a glob pattern for the name, "label:<selector>" or "index:<n>"
+	Targets []string `toml:"targets,omitempty"`
+	// When is a template. The step is skipped unless it renders to true.
+	When string `toml:"when,omitempty"`
+	// Timeout limits the duration of each attempt of the step
+	Timeout string `toml:"timeout,omitempty"`
+	// Retries is the number of times the step is repeated if it fails
+	Retries    int    `toml:"retries,omitempty"`
+	RetryDelay string `toml:"retry_delay,omitempty"`
+	// AllowFailure continues the provisioning as if the step succeeded
+	AllowFailure bool `toml:"allow_failure,omitempty"`
+
+	targets    []provisionTarget
+	disabled   bool
+	timeout    time.Duration
+	retryDelay time.Duration
+}
+
+// RunAfterFailure returns whether the step is run even if an earlier step
+// failed.
+func (s ProvisionStep) RunAfterFailure() bool {
+	return s.Fetch != nil && s.Fetch.Always
+}
+
+// Type returns the name of the type of the step.
+func (s ProvisionStep) Type() string {
+	if s.Docker != nil {
+		return "docker"
+	} else if s.Shell != nil {
+		return "shell"
+	} else if s.Rsync != nil {
+		return "rsync"
+	} else if s.Ansible != nil {
+		return "ansible"
+	} else if s.Fetch != nil {
+		return "fetch"
+	}
+	return "unknown"
+}
+
+// Enabled returns whether the condition of the step is met.
+func (s ProvisionStep) Enabled() bool {
+	return !s.disabled
 }
 
 // ProvisionConfig holds the configuration of the whole provisioning
@@ -121,6 +215,43 @@ func newProvisionConfigReader(provReader io.Reader, provOpt ProvisionOption) (Pr
 	}
 
 	for i, s := range pc.Steps {
+		for _, target := range s.Targets {
+			t, err := parseProvisionTarget(target)
+			if err != nil {
+				return pc, fmt.Errorf("failed to parse targets for step %d: %w", i, err)
+			}
+			pc.Steps[i].targets = append(pc.Steps[i].targets, t)
+		}
+
+		if s.When != "" {
+			when, err := executeTemplate(s.When, pc.Values)
+			if err != nil {
+				return pc, fmt.Errorf("failed to execute template for when for step %d: %w", i, err)
+			}
+
+			enabled, err := parseCondition(when)
+			if err != nil {
+				return pc, fmt.Errorf("condition of step %d is not a boolean: '%s'", i, when)
+			}
+			pc.Steps[i].disabled = !enabled
+		}
+
+		if s.Timeout != "" {
+			if pc.Steps[i].timeout, err = time.ParseDuration(s.Timeout); err != nil {
+				return pc, fmt.Errorf("failed to parse timeout for step %d: %w", i, err)
+			}
+		}
+
+		if s.RetryDelay != "" {
+			if pc.Steps[i].retryDelay, err = time.ParseDuration(s.RetryDelay); err != nil {
+				return pc, fmt.Errorf("failed to parse retry_delay for step %d: %w", i, err)
+			}
+		}
+
+		if s.Retries < 0 {
+			return pc, fmt.Errorf("retries for step %d cannot be negative", i)
+		}
+
 		if s.Docker != nil {
 			s.Docker.Env = mergeEnv(&pc.Env, &s.Docker.Env)
 
@@ -134,13 +265,47 @@ func newProvisionConfigReader(provReader io.Reader, provOpt ProvisionOption) (Pr
 		} else if s.Shell != nil {
 			s.Shell.Env = mergeEnv(&pc.Env, &s.Shell.Env)
 
-			if err := executeTemplates(s.Shell.Env, pc.Values); err != nil {
+			t := stepTemplates{values: pc.Values}
+			if err := t.renderAll("env", s.Shell.Env); err != nil {
 				return pc, fmt.Errorf("failed to execute template for shell.env for step %d: %w", i, err)
 			}
+			s.Shell.Script = t.vmOnly("script", s.Shell.Script)
+			s.Shell.vmTemplateValues = t.vmValues()
+			s.Shell.deferredFields = t.deferred
 		} else if s.Rsync != nil {
-			if s.Rsync.Source, err = executeTemplate(s.Rsync.Source, pc.Values); err != nil {
+			t := stepTemplates{values: pc.Values}
+			if s.Rsync.Source, err = t.render("source", s.Rsync.Source); err != nil {
 				return pc, fmt.Errorf("failed to execute template for rsync.source for step %d: %w", i, err)
 			}
+			s.Rsync.Dest = t.vmOnly("dest", s.Rsync.Dest)
+			s.Rsync.vmTemplateValues = t.vmValues()
+			s.Rsync.deferredFields = t.deferred
+		} else if s.Ansible != nil {
+			s.Ansible.Env = mergeEnv(&pc.Env, &s.Ansible.Env)
+
+			if s.Ansible.Playbook, err = executeTemplate(s.Ansible.Playbook, pc.Values); err != nil {
+				return pc, fmt.Errorf("failed to execute template for ansible.playbook for step %d: %w", i, err)
+			}
+
+			if err := executeTemplates(s.Ansible.Env, pc.Values); err != nil {
+				return pc, fmt.Errorf("failed to execute template for ansible.env for step %d: %w", i, err)
+			}
+
+			if err := executeTemplates(s.Ansible.ExtraVars, pc.Values); err != nil {
+				return pc, fmt.Errorf("failed to execute template for ansible.extra_vars for step %d: %w", i, err)
+			}
+			s.Ansible.ExtraVars = mergeEnv(&pc.Values, &s.Ansible.ExtraVars)
+		} else if s.Fetch != nil {
+			t := stepTemplates{values: pc.Values}
+			if s.Fetch.Source, err = t.render("source", s.Fetch.Source); err != nil {
+				return pc, fmt.Errorf("failed to execute template for fetch.source for step %d: %w", i, err)
+			}
+
+			if s.Fetch.Dest, err = t.render("dest", s.Fetch.Dest); err != nil {
+				return pc, fmt.Errorf("failed to execute template for fetch.dest for step %d: %w", i, err)
+			}
+			s.Fetch.vmTemplateValues = t.vmValues()
+			s.Fetch.deferredFields = t.deferred
 		}
 	}
 
@@ -159,7 +324,7 @@ func genValueMap(provOpt ProvisionOption) (map[string]interface{}, error) {
 	return base, nil
 }
 
-func executeTemplates(templates map[string]string, templateData map[string]string) error {
+func executeTemplates(templates map[string]string, templateData interface{}) error {
 	for k, v := range templates {
 		result, err := executeTemplate(v, templateData)
 		if err != nil {
@@ -170,7 +335,7 @@ func executeTemplates(templates map[string]string, templateData map[string]strin
 	return nil
 }
 
-func executeTemplate(templateText string, templateData map[string]string) (string, error) {
+func executeTemplate(templateText string, templateData interface{}) (string, error) {
 	tmpl, err := template.New("").Option("missingkey=error").Parse(templateText)
 	if err != nil {
 		return "", err
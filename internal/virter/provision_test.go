@@ -280,3 +280,208 @@ foo = "{{.ShellEnv"
 		}
 	}
 }
+
+func TestNewProvisionConfigFetch(t *testing.T) {
+	input := `
+[values]
+Dir = "/tmp/artifacts"
+
+[[steps]]
+[steps.shell]
+script = "make"
+
+[[steps]]
+[steps.fetch]
+source = "/root/build/*.rpm"
+dest = "{{.Dir}}"
+always = true
+`
+
+	pc, err := newProvisionConfigReader(strings.NewReader(input), ProvisionOption{})
+	if err != nil {
+		t.Fatalf("Expected config to be valid, got error: %v", err)
+	}
+
+	expected := &ProvisionFetchStep{
+		Source: "/root/build/*.rpm",
+		Dest:   "/tmp/artifacts",
+		Always: true,
+	}
+	if !reflect.DeepEqual(pc.Steps[1].Fetch, expected) {
+		t.Errorf("Unexpected fetch step: %s", pretty.Diff(expected, pc.Steps[1].Fetch))
+	}
+
+	if pc.Steps[0].RunAfterFailure() {
+		t.Errorf("Expected shell step not to run after a failure")
+	}
+	if !pc.Steps[1].RunAfterFailure() {
+		t.Errorf("Expected fetch step to run after a failure")
+	}
+}
+
+func TestUsesVMData(t *testing.T) {
+	tests := map[string]bool{
+		"echo jrc":                        false,
+		"{{.Value}}":                      false,
+		"{{.VM.Name}}":                    true,
+		"{{ $.VM.IP }}":                   true,
+		"{{range .VMs}}{{.Name}} {{end}}": true,
+		"{{if eq .Value \"x\"}}{{.VM.ID}}{{end}}": true,
+		"{{.Broken": false,
+	}
+
+	for text, expected := range tests {
+		if usesVMData(text) != expected {
+			t.Errorf("Expected usesVMData(%q) to be %v", text, expected)
+		}
+	}
+}
+
+func TestNewProvisionConfigVMTemplate(t *testing.T) {
+	input := `
+[values]
+Port = "7000"
+
+[[steps]]
+[steps.shell]
+script = "drbdadm create-md {{.VM.Name}}"
+[steps.shell.env]
+PEERS = "{{range .VMs}}{{.IP}}:{{$.Port}} {{end}}"
+
+[[steps]]
+[steps.shell]
+script = "echo {{.NotATemplate}}"
+`
+
+	pc, err := newProvisionConfigReader(strings.NewReader(input), ProvisionOption{})
+	if err != nil {
+		t.Fatalf("Expected config to be valid, got error: %v", err)
+	}
+
+	step := pc.Steps[0].Shell
+	if step.vmTemplateValues == nil {
+		t.Fatalf("Expected shell step to be rendered for each VM")
+	}
+	if pc.Steps[1].Shell.vmTemplateValues != nil {
+		t.Errorf("Expected shell step without VM data to be rendered when read")
+	}
+
+	vms := []ProvisionVM{
+		{Name: "vm-1", ID: 1, IP: "192.168.122.2", Index: 0},
+		{Name: "vm-2", ID: 2, IP: "192.168.122.3", Index: 1},
+	}
+	rendered, err := step.forVM(vmTemplateData(step.vmTemplateValues, vms, &vms[1]))
+	if err != nil {
+		t.Fatalf("Expected step to be rendered, got error: %v", err)
+	}
+
+	expected := &ProvisionShellStep{
+		Script: "drbdadm create-md vm-2",
+		Env:    map[string]string{"PEERS": "192.168.122.2:7000 192.168.122.3:7000 "},
+	}
+	if !reflect.DeepEqual(rendered, expected) {
+		t.Errorf("Unexpected rendered step: %s", pretty.Diff(expected, rendered))
+	}
+}
+
+func TestNewProvisionConfigVMTemplateOnlyDeferred(t *testing.T) {
+	input := `
+[values]
+Braces = "{{literal}}"
+
+[[steps]]
+[steps.shell]
+script = "echo '{{.NotATemplate}}'"
+[steps.shell.env]
+NAME = "{{.VM.Name}}"
+BRACES = "{{.Braces}}"
+
+[[steps]]
+[steps.rsync]
+source = "{{.Braces}}"
+dest = "/tmp/{{.VM.Name}}"
+`
+
+	pc, err := newProvisionConfigReader(strings.NewReader(input), ProvisionOption{})
+	if err != nil {
+		t.Fatalf("Expected config to be valid, got error: %v", err)
+	}
+
+	vms := []ProvisionVM{{Name: "vm-1", ID: 1, IP: "192.168.122.2", Index: 0}}
+
+	shell := pc.Steps[0].Shell
+	renderedShell, err := shell.forVM(vmTemplateData(shell.vmTemplateValues, vms, &vms[0]))
+	if err != nil {
+		t.Fatalf("Expected shell step to be rendered, got error: %v", err)
+	}
+
+	expectedShell := &ProvisionShellStep{
+		Script: "echo '{{.NotATemplate}}'",
+		Env:    map[string]string{"NAME": "vm-1", "BRACES": "{{literal}}"},
+	}
+	if !reflect.DeepEqual(renderedShell, expectedShell) {
+		t.Errorf("Unexpected rendered shell step: %s", pretty.Diff(expectedShell, renderedShell))
+	}
+
+	rsync := pc.Steps[1].Rsync
+	renderedRsync, err := rsync.forVM(vmTemplateData(rsync.vmTemplateValues, vms, &vms[0]))
+	if err != nil {
+		t.Fatalf("Expected rsync step to be rendered, got error: %v", err)
+	}
+
+	expectedRsync := &ProvisionRsyncStep{Source: "{{literal}}", Dest: "/tmp/vm-1"}
+	if !reflect.DeepEqual(renderedRsync, expectedRsync) {
+		t.Errorf("Unexpected rendered rsync step: %s", pretty.Diff(expectedRsync, renderedRsync))
+	}
+}
+
+func TestNewProvisionConfigTargetsWhen(t *testing.T) {
+	input := `
+[values]
+Role = "controller"
+
+[[steps]]
+targets = ["ctrl-*", "label:role=controller", "index:0"]
+when = "{{eq .Role \"controller\"}}"
+[steps.shell]
+script = "linstor-controller"
+
+[[steps]]
+when = "{{if eq .Role \"satellite\"}}true{{end}}"
+[steps.shell]
+script = "linstor-satellite"
+`
+
+	pc, err := newProvisionConfigReader(strings.NewReader(input), ProvisionOption{})
+	if err != nil {
+		t.Fatalf("Expected config to be valid, got error: %v", err)
+	}
+
+	if len(pc.Steps[0].targets) != 3 {
+		t.Errorf("Expected 3 targets, got %d", len(pc.Steps[0].targets))
+	}
+	if !pc.Steps[0].Enabled() {
+		t.Errorf("Expected controller step to be enabled")
+	}
+	if pc.Steps[1].Enabled() {
+		t.Errorf("Expected satellite step to be disabled")
+	}
+
+	target := pc.Steps[0].targets[0]
+	if !target.matches("ctrl-1", 3, nil) || target.matches("sat-1", 0, nil) {
+		t.Errorf("Unexpected matches for target 'ctrl-*'")
+	}
+
+	invalid := []string{
+		"[[steps]]\ntargets = [\"index:x\"]\n[steps.shell]\nscript = \"true\"",
+		"[[steps]]\ntargets = [\"label:\"]\n[steps.shell]\nscript = \"true\"",
+		"[[steps]]\ntargets = [\"[\"]\n[steps.shell]\nscript = \"true\"",
+		"[[steps]]\nwhen = \"maybe\"\n[steps.shell]\nscript = \"true\"",
+		"[[steps]]\nwhen = \"{{.Missing}}\"\n[steps.shell]\nscript = \"true\"",
+	}
+	for _, input := range invalid {
+		if _, err := newProvisionConfigReader(strings.NewReader(input), ProvisionOption{}); err == nil {
+			t.Errorf("Expected error for config %q", input)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package virter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProvisionStepFunc runs a single provisioning step on some VMs.
+type ProvisionStepFunc func(ctx context.Context, step ProvisionStep, vmNames []string) error
+
+// provisionFailure records a step which failed for the summary
+type provisionFailure struct {
+	index   int
+	step    ProvisionStep
+	vmNames []string
+	err     error
+}
+
+// Provision runs the steps of a provisioning config on some VMs with run.
+// Steps which fail are retried and steps which are allowed to fail do not
+// stop the provisioning. The error of the first other step which failed is
+// returned once all steps are done.
+func (v *Virter) Provision(ctx context.Context, pc ProvisionConfig, vmNames []string, run ProvisionStepFunc) error {
+	// steps which collect results run even after a failure, so the first
+	// error is returned once all steps are done
+	var provisionErr error
+	var failures []provisionFailure
+	var notRun []int
+	for i, s := range pc.Steps {
+		if provisionErr != nil && !s.RunAfterFailure() {
+			notRun = append(notRun, i)
+			continue
+		}
+
+		if !s.Enabled() {
+			log.Infof("Skipping provisioning step %d, its condition is false", i)
+			continue
+		}
+
+		targets, err := v.ProvisionStepTargets(s, vmNames)
+		if err == nil {
+			if len(targets) == 0 {
+				log.Infof("Skipping provisioning step %d, no VM matches its targets", i)
+				continue
+			}
+			err = runProvisionStep(ctx, s.withProvisionedVMs(vmNames), targets, run)
+		}
+
+		if err == nil {
+			continue
+		}
+
+		failures = append(failures, provisionFailure{
+			index:   i,
+			step:    s,
+			vmNames: failedVMs(err, targets),
+			err:     err,
+		})
+
+		if s.AllowFailure {
+			log.Warnf("Provisioning step %d failed, continuing because failure is allowed: %v", i, err)
+			continue
+		}
+
+		if provisionErr != nil {
+			log.Errorf("Provisioning step failed after an earlier failure: %v", err)
+			continue
+		}
+		provisionErr = err
+	}
+
+	logProvisionSummary(failures, notRun)
+
+	return provisionErr
+}
+
+// runProvisionStep runs a step until it succeeds or it has no retries left.
+// Retries only run on the VMs the step failed on, so that steps which are not
+// idempotent are not repeated on the others.
+func runProvisionStep(ctx context.Context, s ProvisionStep, vmNames []string, run ProvisionStepFunc) error {
+	var err error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			vmNames = failedVMs(err, vmNames)
+			log.Warnf("Provisioning step failed, retrying on %s (%d/%d): %v", strings.Join(vmNames, ", "), attempt, s.Retries, err)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(s.retryDelay):
+			}
+		}
+
+		err = runProvisionAttempt(ctx, s, vmNames, run)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func runProvisionAttempt(ctx context.Context, s ProvisionStep, vmNames []string, run ProvisionStepFunc) error {
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+
+	err := run(ctx, s, vmNames)
+	if err != nil && ctx.Err() == context.DeadlineExceeded && s.timeout > 0 {
+		return fmt.Errorf("step did not finish within %s: %w", s.timeout, err)
+	}
+	return err
+}
+
+func logProvisionSummary(failures []provisionFailure, notRun []int) {
+	if len(failures) == 0 {
+		return
+	}
+
+	log.Errorf("Provisioning summary: %d step(s) failed", len(failures))
+	for _, f := range failures {
+		msg := fmt.Sprintf("  step %d (%s) failed on %s", f.index, f.step.Type(), strings.Join(f.vmNames, ", "))
+		if f.step.AllowFailure {
+			log.Warn(msg + " (failure allowed)")
+		} else {
+			log.Error(msg)
+		}
+	}
+
+	if len(notRun) > 0 {
+		steps := make([]string, len(notRun))
+		for i, index := range notRun {
+			steps[i] = fmt.Sprint(index)
+		}
+		log.Errorf("  steps not run because of an earlier failure: %s", strings.Join(steps, ", "))
+	}
+}
@@ -0,0 +1,346 @@
+package virter
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestProvisionRetries(t *testing.T) {
+	pc, err := newProvisionConfigReader(strings.NewReader(`
+[[steps]]
+retries = 2
+[steps.shell]
+script = "flaky"
+`), ProvisionOption{})
+	assert.NoError(t, err)
+
+	attempts := 0
+	v := &Virter{}
+	err = v.Provision(context.Background(), pc, []string{"vm-1"}, func(ctx context.Context, s ProvisionStep, vmNames []string) error {
+		attempts++
+		if attempts < 3 {
+			return fmt.Errorf("attempt %d failed", attempts)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	pc.Steps[0].Retries = 1
+	err = v.Provision(context.Background(), pc, []string{"vm-1"}, func(ctx context.Context, s ProvisionStep, vmNames []string) error {
+		attempts++
+		return fmt.Errorf("attempt %d failed", attempts)
+	})
+	assert.EqualError(t, err, "attempt 2 failed")
+	assert.Equal(t, 2, attempts)
+}
+
+func TestProvisionRetriesFailedVMs(t *testing.T) {
+	pc, err := newProvisionConfigReader(strings.NewReader(`
+[[steps]]
+retries = 2
+[steps.shell]
+script = "flaky"
+`), ProvisionOption{})
+	assert.NoError(t, err)
+
+	runs := map[string]int{}
+	v := &Virter{}
+	err = v.Provision(context.Background(), pc, []string{"vm-1", "vm-2", "vm-3"}, func(ctx context.Context, s ProvisionStep, vmNames []string) error {
+		g := &vmGroup{}
+		for _, vmName := range vmNames {
+			vmName := vmName
+			runs[vmName]++
+			attempt := runs[vmName]
+			g.Go(vmName, func() error {
+				// vm-2 fails once, vm-3 twice
+				if (vmName == "vm-2" && attempt < 2) || (vmName == "vm-3" && attempt < 3) {
+					return fmt.Errorf("attempt %d failed", attempt)
+				}
+				return nil
+			})
+		}
+		return g.Wait()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"vm-1": 1, "vm-2": 2, "vm-3": 3}, runs)
+}
+
+func TestProvisionTimeout(t *testing.T) {
+	pc, err := newProvisionConfigReader(strings.NewReader(`
+[[steps]]
+timeout = "10ms"
+[steps.shell]
+script = "sleep infinity"
+`), ProvisionOption{})
+	assert.NoError(t, err)
+
+	v := &Virter{}
+	err = v.Provision(context.Background(), pc, []string{"vm-1"}, func(ctx context.Context, s ProvisionStep, vmNames []string) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Second):
+			return nil
+		}
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "did not finish within 10ms")
+}
+
+func TestProvisionAllowFailure(t *testing.T) {
+	pc, err := newProvisionConfigReader(strings.NewReader(`
+[[steps]]
+allow_failure = true
+[steps.shell]
+script = "optional"
+
+[[steps]]
+[steps.shell]
+script = "required"
+
+[[steps]]
+[steps.shell]
+script = "skipped"
+`), ProvisionOption{})
+	assert.NoError(t, err)
+
+	run := []string{}
+	v := &Virter{}
+	err = v.Provision(context.Background(), pc, []string{"vm-1", "vm-2"}, func(ctx context.Context, s ProvisionStep, vmNames []string) error {
+		run = append(run, s.Shell.Script)
+		switch s.Shell.Script {
+		case "optional":
+			return fmt.Errorf("optional failed")
+		case "required":
+			var g vmGroup
+			g.Go("vm-2", func() error { return fmt.Errorf("required failed") })
+			return g.Wait()
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "required failed")
+	assert.Equal(t, []string{"optional", "required"}, run)
+}
+
+func TestFailedVMs(t *testing.T) {
+	vmNames := []string{"vm-1", "vm-2", "vm-3"}
+	assert.Equal(t, vmNames, failedVMs(fmt.Errorf("docker failed"), vmNames))
+
+	var g vmGroup
+	g.Go("vm-1", func() error { return fmt.Errorf("failed") })
+	g.Go("vm-2", func() error { return nil })
+	g.Go("vm-3", func() error { return fmt.Errorf("failed") })
+	err := g.Wait()
+	assert.Equal(t, []string{"vm-1", "vm-3"}, failedVMs(err, vmNames))
+	// wrapped like the error of a step which timed out
+	assert.Equal(t, []string{"vm-1", "vm-3"}, failedVMs(fmt.Errorf("step did not finish: %w", err), vmNames))
+
+	var single vmGroup
+	single.Go("vm-2", func() error { return fmt.Errorf("failed") })
+	assert.Equal(t, []string{"vm-2"}, failedVMs(fmt.Errorf("step did not finish: %w", single.Wait()), vmNames))
+}
+
+func TestNewProvisionConfigRetryOptions(t *testing.T) {
+	pc, err := newProvisionConfigReader(strings.NewReader(`
+[[steps]]
+timeout = "5m"
+retries = 3
+retry_delay = "10s"
+allow_failure = true
+[steps.shell]
+script = "true"
+`), ProvisionOption{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, pc.Steps[0].timeout)
+	assert.Equal(t, 3, pc.Steps[0].Retries)
+	assert.Equal(t, 10*time.Second, pc.Steps[0].retryDelay)
+	assert.True(t, pc.Steps[0].AllowFailure)
+
+	invalid := []string{
+		"[[steps]]\ntimeout = \"forever\"\n[steps.shell]\nscript = \"true\"",
+		"[[steps]]\nretry_delay = \"1\"\n[steps.shell]\nscript = \"true\"",
+		"[[steps]]\nretries = -1\n[steps.shell]\nscript = \"true\"",
+	}
+	for _, input := range invalid {
+		_, err := newProvisionConfigReader(strings.NewReader(input), ProvisionOption{})
+		assert.Error(t, err, input)
+	}
+}
+
+// hangingSSHServer accepts SSH connections whose shell never finishes. Like
+// sshd, it hangs up on the shell when the connection is closed. It counts how
+// many shells run at the same time.
+type hangingSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+	started    int
+}
+
+func newHangingSSHServer(t *testing.T) *hangingSSHServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	assert.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	s := &hangingSSHServer{listener: listener, config: config}
+	go s.serve()
+	return s
+}
+
+func (s *hangingSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *hangingSSHServer) handle(conn net.Conn) {
+	sConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range requests {
+				if req.Type == "shell" {
+					s.shellStarted()
+					go func() {
+						// the shell ends when the connection is closed
+						sConn.Wait()
+						s.shellEnded()
+					}()
+				}
+				req.Reply(true, nil)
+			}
+		}()
+		go io.Copy(ioutil.Discard, ch)
+	}
+}
+
+func (s *hangingSSHServer) shellStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started++
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+}
+
+func (s *hangingSSHServer) shellEnded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+}
+
+func TestProvisionShellTimeoutRetry(t *testing.T) {
+	server := newHangingSSHServer(t)
+	defer server.listener.Close()
+
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(clientKey)
+	assert.NoError(t, err)
+	sshConfig := &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	pc, err := newProvisionConfigReader(strings.NewReader(`
+[[steps]]
+timeout = "200ms"
+retries = 1
+[steps.shell]
+script = "sleep infinity"
+`), ProvisionOption{})
+	assert.NoError(t, err)
+
+	v := &Virter{}
+	err = v.Provision(context.Background(), pc, []string{"vm-1"}, func(ctx context.Context, s ProvisionStep, vmNames []string) error {
+		return runSSHCommand(ctx, sshConfig, vmNames[0], server.listener.Addr().String(), s.Shell.Script, nil)
+	})
+	assert.Error(t, err)
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	assert.Equal(t, 2, server.started)
+	// the retry only starts once the timed out attempt has ended
+	assert.Equal(t, 1, server.maxRunning)
+}
+
+func TestProvisionStepTargets(t *testing.T) {
+	vmNames := []string{"foreign", "some-vm"}
+	tests := []struct {
+		targets  string
+		expected []string
+	}{
+		{"", vmNames},
+		{"{some-*}", []string{"some-vm"}},
+		{"{index:0}", []string{"foreign"}},
+		{"{index:1,foreign}", vmNames},
+	}
+
+	v := &Virter{}
+	for _, tc := range tests {
+		overrides := []string{"steps[0].shell.script=hostname"}
+		if tc.targets != "" {
+			overrides = append(overrides, "steps[0].targets="+tc.targets)
+		}
+
+		pc, err := newProvisionConfigReader(nil, ProvisionOption{Overrides: overrides})
+		assert.NoError(t, err)
+
+		targets, err := v.ProvisionStepTargets(pc.Steps[0], vmNames)
+		assert.NoError(t, err, tc.targets)
+		assert.Equal(t, tc.expected, targets, tc.targets)
+	}
+}
+
+func TestProvisionTargetLabels(t *testing.T) {
+	target, err := parseProvisionTarget("label:role=controller")
+	assert.NoError(t, err)
+
+	assert.True(t, target.matches("some-vm", 0, map[string]string{"role": "controller"}))
+	assert.False(t, target.matches("some-vm", 0, map[string]string{"role": "satellite"}))
+	// domains which were not created by virter have no labels
+	assert.False(t, target.matches("foreign", 0, nil))
+}
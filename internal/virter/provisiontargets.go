@@ -0,0 +1,124 @@
+package virter
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	targetLabelPrefix = "label:"
+	targetIndexPrefix = "index:"
+)
+
+// provisionTarget selects the VMs a provisioning step is run on, either by a
+// glob pattern for the name, by a label selector or by the position of the
+// VM in the list of VMs which are provisioned together.
+type provisionTarget struct {
+	glob     string
+	selector *LabelSelector
+	index    int
+}
+
+func parseProvisionTarget(target string) (provisionTarget, error) {
+	if strings.HasPrefix(target, targetLabelPrefix) {
+		selector, err := ParseLabelSelector(strings.TrimPrefix(target, targetLabelPrefix))
+		if err != nil {
+			return provisionTarget{}, err
+		}
+		return provisionTarget{selector: &selector, index: -1}, nil
+	}
+
+	if strings.HasPrefix(target, targetIndexPrefix) {
+		index, err := strconv.Atoi(strings.TrimPrefix(target, targetIndexPrefix))
+		if err != nil || index < 0 {
+			return provisionTarget{}, fmt.Errorf("invalid index in target '%s'", target)
+		}
+		return provisionTarget{index: index}, nil
+	}
+
+	// check the pattern now, filepath.Match only reports errors for
+	// names it does not match otherwise
+	if _, err := filepath.Match(target, ""); err != nil {
+		return provisionTarget{}, fmt.Errorf("invalid pattern in target '%s': %w", target, err)
+	}
+	return provisionTarget{glob: target, index: -1}, nil
+}
+
+func (t provisionTarget) matches(vmName string, index int, labels map[string]string) bool {
+	if t.selector != nil {
+		return t.selector.Matches(labels)
+	}
+
+	if t.index >= 0 {
+		return t.index == index
+	}
+
+	matched, _ := filepath.Match(t.glob, vmName)
+	return matched
+}
+
+// parseCondition interprets the rendered "when" of a step. A condition which
+// renders to an empty string is false.
+func parseCondition(condition string) (bool, error) {
+	condition = strings.TrimSpace(condition)
+	if condition == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(condition)
+}
+
+// ProvisionStepTargets returns the VMs of vmNames which a step is run on, in
+// the same order.
+func (v *Virter) ProvisionStepTargets(step ProvisionStep, vmNames []string) ([]string, error) {
+	if len(step.targets) == 0 {
+		return vmNames, nil
+	}
+
+	needLabels := false
+	for _, t := range step.targets {
+		needLabels = needLabels || t.selector != nil
+	}
+
+	selected := []string{}
+	for i, vmName := range vmNames {
+		var labels map[string]string
+		if needLabels {
+			var err error
+			labels, err = v.vmLabels(vmName)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, t := range step.targets {
+			if t.matches(vmName, i, labels) {
+				selected = append(selected, vmName)
+				break
+			}
+		}
+	}
+
+	return selected, nil
+}
+
+// vmLabels returns the labels of a VM. VMs which were not created by virter
+// have no labels.
+func (v *Virter) vmLabels(vmName string) (map[string]string, error) {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get domain '%s': %w", vmName, err)
+	}
+
+	meta, err := v.getVMMetadata(domain)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		return nil, nil
+	}
+
+	return meta.Labels, nil
+}
@@ -0,0 +1,381 @@
+package virter
+
+import (
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// ProvisionVM describes a VM in the templates of provisioning steps which are
+// rendered for each VM.
+type ProvisionVM struct {
+	Name string
+	ID   uint
+	IP   string
+	// Index is the position of the VM in the list of VMs which are
+	// provisioned together
+	Index int
+}
+
+// vmTemplateFields are the fields of the template data which are only known
+// when a step is run
+var vmTemplateFields = map[string]bool{"VM": true, "VMs": true}
+
+// usesVMData returns whether a template refers to the data of the VMs. Text
+// which is not a valid template does not refer to it.
+func usesVMData(templateText string) bool {
+	tmpl, err := template.New("").Parse(templateText)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && nodeUsesVMData(t.Tree.Root) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nodeUsesVMData(node parse.Node) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if nodeUsesVMData(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUsesVMData(n.Pipe)
+	case *parse.IfNode:
+		return nodeUsesVMData(n.Pipe) || nodeUsesVMData(n.List) || nodeUsesVMData(n.ElseList)
+	case *parse.RangeNode:
+		return nodeUsesVMData(n.Pipe) || nodeUsesVMData(n.List) || nodeUsesVMData(n.ElseList)
+	case *parse.WithNode:
+		return nodeUsesVMData(n.Pipe) || nodeUsesVMData(n.List) || nodeUsesVMData(n.ElseList)
+	case *parse.TemplateNode:
+		return nodeUsesVMData(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUsesVMData(cmd) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUsesVMData(arg) {
+				return true
+			}
+		}
+	case *parse.ChainNode:
+		return nodeUsesVMData(n.Node)
+	case *parse.FieldNode:
+		return vmTemplateFields[n.Ident[0]]
+	case *parse.VariableNode:
+		// $.VM refers to the top level data
+		return len(n.Ident) > 1 && n.Ident[0] == "$" && vmTemplateFields[n.Ident[1]]
+	}
+
+	return false
+}
+
+// renderNow renders a template with the values of the provisioning file,
+// unless it refers to the data of the VMs. In that case, the text is
+// returned unchanged and it is rendered when the step is run.
+func renderNow(templateText string, values map[string]string) (string, bool, error) {
+	if usesVMData(templateText) {
+		return templateText, true, nil
+	}
+
+	result, err := executeTemplate(templateText, values)
+	return result, false, err
+}
+
+// vmTemplateData returns the data for rendering a template for a VM. The
+// values of the provisioning file are available at the top level like when
+// rendering the file. vm is nil for steps which are run once for all VMs.
+func vmTemplateData(values map[string]string, vms []ProvisionVM, vm *ProvisionVM) map[string]interface{} {
+	data := map[string]interface{}{}
+	for k, v := range values {
+		data[k] = v
+	}
+	data["VMs"] = vms
+	if vm != nil {
+		data["VM"] = *vm
+	}
+	return data
+}
+
+// renderDeferred renders a field of a step for a VM, if its template was
+// deferred until the step is run. Other fields are returned unchanged, as
+// they were already rendered or are no templates at all.
+func renderDeferred(deferred map[string]bool, field, text string, data map[string]interface{}) (string, error) {
+	if !deferred[field] {
+		return text, nil
+	}
+
+	return executeTemplate(text, data)
+}
+
+// stepTemplates renders the templates of a step when the provisioning file is
+// read and records which of them have to be rendered for each VM.
+type stepTemplates struct {
+	values   map[string]string
+	deferred map[string]bool
+}
+
+func (t *stepTemplates) deferField(field string) {
+	if t.deferred == nil {
+		t.deferred = map[string]bool{}
+	}
+	t.deferred[field] = true
+}
+
+func (t *stepTemplates) render(field, templateText string) (string, error) {
+	result, deferred, err := renderNow(templateText, t.values)
+	if deferred {
+		t.deferField(field)
+	}
+	return result, err
+}
+
+// renderAll renders the templates of a map. The entries are recorded as the
+// fields "<prefix>.<key>".
+func (t *stepTemplates) renderAll(prefix string, templates map[string]string) error {
+	for k, v := range templates {
+		result, err := t.render(prefix+"."+k, v)
+		if err != nil {
+			return err
+		}
+		templates[k] = result
+	}
+	return nil
+}
+
+// vmOnly handles fields which are only treated as templates if they refer
+// to the data of the VMs, because they were not templates originally.
+func (t *stepTemplates) vmOnly(field, text string) string {
+	if usesVMData(text) {
+		t.deferField(field)
+	}
+	return text
+}
+
+// vmValues returns the values for rendering the templates for each VM, or
+// nil if there is nothing left to render.
+func (t *stepTemplates) vmValues() map[string]string {
+	if t.deferred == nil {
+		return nil
+	}
+
+	values := map[string]string{}
+	for k, v := range t.values {
+		values[k] = v
+	}
+	return values
+}
+
+// provisionVMs collects the data of the VMs for the templates of provisioning
+// steps.
+func (v *Virter) provisionVMs(vmNames []string) ([]ProvisionVM, error) {
+	vms := make([]ProvisionVM, len(vmNames))
+	for i, vmName := range vmNames {
+		domain, err := v.libvirt.DomainLookupByName(vmName)
+		if err != nil {
+			return nil, fmt.Errorf("could not get domain '%s': %w", vmName, err)
+		}
+
+		meta, err := v.getVMMetadata(domain)
+		if err != nil {
+			return nil, err
+		}
+
+		ip, err := v.getIP(vmName, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		vms[i] = ProvisionVM{
+			Name:  vmName,
+			IP:    ip,
+			Index: i,
+		}
+		// VMs created by older versions of virter have no metadata
+		if meta != nil {
+			vms[i].ID = meta.ID
+		}
+	}
+
+	return vms, nil
+}
+
+// stepTemplateData returns the template data for each VM of vmNames. The
+// data of all provisioned VMs is available in the templates, even if the
+// step only runs on some of them. If provisioned is nil, the step runs on all
+// provisioned VMs. The entries are nil if the step has nothing left to
+// render.
+func (v *Virter) stepTemplateData(vmNames, provisioned []string, values map[string]string) ([]map[string]interface{}, error) {
+	data := make([]map[string]interface{}, len(vmNames))
+	if values == nil {
+		return data, nil
+	}
+
+	if provisioned == nil {
+		provisioned = vmNames
+	}
+
+	vms, err := v.provisionVMs(provisioned)
+	if err != nil {
+		return nil, fmt.Errorf("could not get VM data for templates: %w", err)
+	}
+
+	byName := make(map[string]*ProvisionVM, len(vms))
+	for i := range vms {
+		byName[vms[i].Name] = &vms[i]
+	}
+
+	for i, vmName := range vmNames {
+		vm, ok := byName[vmName]
+		if !ok {
+			return nil, fmt.Errorf("VM '%s' is not provisioned", vmName)
+		}
+		data[i] = vmTemplateData(values, vms, vm)
+	}
+	return data, nil
+}
+
+// withProvisionedVMs returns a copy of the step which renders its templates
+// with the data of all provisioned VMs, when it only runs on some of them.
+func (s ProvisionStep) withProvisionedVMs(vmNames []string) ProvisionStep {
+	if s.Shell != nil && s.Shell.vmTemplateValues != nil {
+		shell := *s.Shell
+		shell.provisionedVMs = vmNames
+		s.Shell = &shell
+	} else if s.Rsync != nil && s.Rsync.vmTemplateValues != nil {
+		rsync := *s.Rsync
+		rsync.provisionedVMs = vmNames
+		s.Rsync = &rsync
+	} else if s.Fetch != nil && s.Fetch.vmTemplateValues != nil {
+		fetch := *s.Fetch
+		fetch.provisionedVMs = vmNames
+		s.Fetch = &fetch
+	}
+	return s
+}
+
+func (s *ProvisionShellStep) forVM(data map[string]interface{}) (*ProvisionShellStep, error) {
+	if data == nil {
+		return s, nil
+	}
+
+	script, err := renderDeferred(s.deferredFields, "script", s.Script, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute template for shell.script: %w", err)
+	}
+
+	env := make(map[string]string, len(s.Env))
+	for k, v := range s.Env {
+		env[k], err = renderDeferred(s.deferredFields, "env."+k, v, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute template for shell.env: %w", err)
+		}
+	}
+
+	return &ProvisionShellStep{Script: script, Env: env}, nil
+}
+
+func (s *ProvisionRsyncStep) forVM(data map[string]interface{}) (*ProvisionRsyncStep, error) {
+	if data == nil {
+		return s, nil
+	}
+
+	source, err := renderDeferred(s.deferredFields, "source", s.Source, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute template for rsync.source: %w", err)
+	}
+
+	dest, err := renderDeferred(s.deferredFields, "dest", s.Dest, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute template for rsync.dest: %w", err)
+	}
+
+	return &ProvisionRsyncStep{Source: source, Dest: dest}, nil
+}
+
+func (s *ProvisionFetchStep) forVM(data map[string]interface{}) (*ProvisionFetchStep, error) {
+	if data == nil {
+		return s, nil
+	}
+
+	source, err := renderDeferred(s.deferredFields, "source", s.Source, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute template for fetch.source: %w", err)
+	}
+
+	dest, err := renderDeferred(s.deferredFields, "dest", s.Dest, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute template for fetch.dest: %w", err)
+	}
+
+	return &ProvisionFetchStep{Source: source, Dest: dest, Always: s.Always}, nil
+}
+
+// shellStepsForVMs renders a shell step for each VM. The steps for all VMs
+// are rendered before the step is started on any of them, so that a template
+// error does not leave it running on some VMs.
+func (v *Virter) shellStepsForVMs(vmNames []string, shellStep *ProvisionShellStep) ([]*ProvisionShellStep, error) {
+	data, err := v.stepTemplateData(vmNames, shellStep.provisionedVMs, shellStep.vmTemplateValues)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]*ProvisionShellStep, len(vmNames))
+	for i, vmName := range vmNames {
+		steps[i], err = shellStep.forVM(data[i])
+		if err != nil {
+			return nil, fmt.Errorf("could not render shell step for '%s': %w", vmName, err)
+		}
+	}
+	return steps, nil
+}
+
+// rsyncStepsForVMs renders an rsync step for each VM, like shellStepsForVMs.
+func (v *Virter) rsyncStepsForVMs(vmNames []string, rsyncStep *ProvisionRsyncStep) ([]*ProvisionRsyncStep, error) {
+	data, err := v.stepTemplateData(vmNames, rsyncStep.provisionedVMs, rsyncStep.vmTemplateValues)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]*ProvisionRsyncStep, len(vmNames))
+	for i, vmName := range vmNames {
+		steps[i], err = rsyncStep.forVM(data[i])
+		if err != nil {
+			return nil, fmt.Errorf("could not render rsync step for '%s': %w", vmName, err)
+		}
+	}
+	return steps, nil
+}
+
+// fetchStepsForVMs renders a fetch step for each VM, like shellStepsForVMs.
+func (v *Virter) fetchStepsForVMs(vmNames []string, fetchStep *ProvisionFetchStep) ([]*ProvisionFetchStep, error) {
+	data, err := v.stepTemplateData(vmNames, fetchStep.provisionedVMs, fetchStep.vmTemplateValues)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]*ProvisionFetchStep, len(vmNames))
+	for i, vmName := range vmNames {
+		steps[i], err = fetchStep.forVM(data[i])
+		if err != nil {
+			return nil, fmt.Errorf("could not render fetch step for '%s': %w", vmName, err)
+		}
+	}
+	return steps, nil
+}
@@ -0,0 +1,36 @@
+package virter
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// rollback records how to undo the creation of resources, so that they can
+// be removed again if a later step fails. Only resources that were actually
+// created should be recorded, so that pre-existing resources are never
+// touched.
+type rollback struct {
+	actions []rollbackAction
+}
+
+type rollbackAction struct {
+	description string
+	undo        func() error
+}
+
+// add records how to undo the creation of a resource.
+func (r *rollback) add(description string, undo func() error) {
+	r.actions = append(r.actions, rollbackAction{description: description, undo: undo})
+}
+
+// run undoes all recorded actions in reverse order. Failures are logged and
+// do not stop the remaining actions.
+func (r *rollback) run() {
+	for i := len(r.actions) - 1; i >= 0; i-- {
+		action := r.actions[i]
+		log.Printf("Roll back: %s", action.description)
+		if err := action.undo(); err != nil {
+			log.Errorf("Failed to roll back %s: %v", action.description, err)
+		}
+	}
+	r.actions = nil
+}
@@ -0,0 +1,312 @@
+package virter
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	lx "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// SnapshotOptions configures how a snapshot of a VM is taken
+type SnapshotOptions struct {
+	// External creates overlay files for the disks instead of storing
+	// the snapshot inside the qcow2 volumes.
+	External bool
+	// Memory includes the memory state of a running VM. Internal
+	// snapshots of running VMs always include the memory state.
+	Memory bool
+}
+
+// SnapshotInfo contains information about a snapshot of a VM
+type SnapshotInfo struct {
+	Name     string    `json:"name"`
+	Parent   string    `json:"parent"`
+	Created  time.Time `json:"created"`
+	State    string    `json:"state"`
+	External bool      `json:"external"`
+	Memory   bool      `json:"memory"`
+}
+
+// VMSnapshotCreate takes a snapshot of the boot volume and the additional
+// disks of a VM.
+func (v *Virter) VMSnapshotCreate(vmName, snapshotName string, opts SnapshotOptions) error {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return fmt.Errorf("could not get domain: %w", err)
+	}
+
+	active, err := v.libvirt.DomainIsActive(domain)
+	if err != nil {
+		return fmt.Errorf("could not check if domain is active: %w", err)
+	}
+
+	if opts.Memory && active == 0 {
+		return fmt.Errorf("cannot include memory state of VM '%s' that is not running", vmName)
+	}
+
+	domcfg, err := getDomainDescription(v.libvirt, domain)
+	if err != nil {
+		return err
+	}
+
+	snapcfg, err := v.snapshotDescription(vmName, snapshotName, domcfg, active != 0, opts)
+	if err != nil {
+		return err
+	}
+
+	snapXML, err := snapcfg.Marshal()
+	if err != nil {
+		return fmt.Errorf("could not marshal snapshot XML: %w", err)
+	}
+
+	log.Debugf("Using snapshot XML: %s", snapXML)
+
+	flags := libvirt.DomainSnapshotCreateAtomic
+	if opts.External && snapcfg.Memory.Snapshot == "no" {
+		flags |= libvirt.DomainSnapshotCreateDiskOnly
+	}
+
+	log.Printf("Create snapshot '%s' of VM '%s'", snapshotName, vmName)
+	_, err = v.libvirt.DomainSnapshotCreateXML(domain, snapXML, uint32(flags))
+	if err != nil {
+		return fmt.Errorf("could not create snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (v *Virter) snapshotDescription(vmName, snapshotName string, domcfg *lx.Domain, active bool, opts SnapshotOptions) (*lx.DomainSnapshot, error) {
+	diskMode := "internal"
+	if opts.External {
+		diskMode = "external"
+	}
+
+	snapcfg := &lx.DomainSnapshot{
+		Name:   snapshotName,
+		Memory: &lx.DomainSnapshotMemory{Snapshot: "no"},
+		Disks:  &lx.DomainSnapshotDisks{},
+	}
+
+	if domcfg.Devices != nil {
+		for _, disk := range domcfg.Devices.Disks {
+			if disk.Target == nil {
+				continue
+			}
+
+			// only the boot volume and additional disks are
+			// snapshotted, not the cloud-init CD-ROM
+			mode := "no"
+			if disk.Device == VMDiskDeviceDisk {
+				mode = diskMode
+			}
+
+			snapcfg.Disks.Disks = append(snapcfg.Disks.Disks, lx.DomainSnapshotDisk{
+				Name:     disk.Target.Dev,
+				Snapshot: mode,
+			})
+		}
+	}
+
+	if !active {
+		return snapcfg, nil
+	}
+
+	if !opts.External {
+		if !opts.Memory {
+			log.Printf("Internal snapshot of running VM '%s' includes memory state", vmName)
+		}
+		snapcfg.Memory.Snapshot = "internal"
+	} else if opts.Memory {
+		memoryFile, err := v.snapshotMemoryFile(vmName, snapshotName)
+		if err != nil {
+			return nil, err
+		}
+		snapcfg.Memory = &lx.DomainSnapshotMemory{Snapshot: "external", File: memoryFile}
+	}
+
+	return snapcfg, nil
+}
+
+// snapshotMemoryFile returns the path of the file that the memory state of an
+// external snapshot is stored in. It is placed next to the boot volume.
+func (v *Virter) snapshotMemoryFile(vmName, snapshotName string) (string, error) {
+	sp, err := v.libvirt.StoragePoolLookupByName(v.storagePoolName)
+	if err != nil {
+		return "", fmt.Errorf("could not get storage pool: %w", err)
+	}
+
+	bootVolume, err := v.libvirt.StorageVolLookupByName(sp, vmName)
+	if err != nil {
+		return "", fmt.Errorf("could not get boot volume: %w", err)
+	}
+
+	bootPath, err := v.libvirt.StorageVolGetPath(bootVolume)
+	if err != nil {
+		return "", fmt.Errorf("could not get boot volume path: %w", err)
+	}
+
+	return filepath.Join(filepath.Dir(bootPath), vmName+"."+snapshotName+".mem"), nil
+}
+
+// VMSnapshotList lists the snapshots of a VM, oldest first.
+func (v *Virter) VMSnapshotList(vmName string) ([]SnapshotInfo, error) {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get domain: %w", err)
+	}
+
+	snapshots, _, err := v.libvirt.DomainListAllSnapshots(domain, -1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list snapshots: %w", err)
+	}
+
+	result := []SnapshotInfo{}
+	for _, snapshot := range snapshots {
+		snapcfg, err := v.getSnapshotDescription(snapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		info := SnapshotInfo{
+			Name:     snapcfg.Name,
+			State:    snapcfg.State,
+			External: isExternalSnapshot(snapcfg),
+			Memory:   snapcfg.Memory != nil && snapcfg.Memory.Snapshot != "no",
+		}
+
+		if snapcfg.Parent != nil {
+			info.Parent = snapcfg.Parent.Name
+		}
+
+		if snapcfg.CreationTime != "" {
+			sec, err := strconv.ParseInt(snapcfg.CreationTime, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse creation time of snapshot '%s': %w", snapcfg.Name, err)
+			}
+			info.Created = time.Unix(sec, 0)
+		}
+
+		result = append(result, info)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+
+	return result, nil
+}
+
+// VMSnapshotRevert reverts a VM to a snapshot. Only internal snapshots can be
+// reverted to.
+func (v *Virter) VMSnapshotRevert(vmName, snapshotName string) error {
+	snapshot, snapcfg, err := v.lookupSnapshot(vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	if isExternalSnapshot(snapcfg) {
+		return fmt.Errorf("cannot revert to external snapshot '%s': not supported by libvirt", snapshotName)
+	}
+
+	log.Printf("Revert VM '%s' to snapshot '%s'", vmName, snapshotName)
+	err = v.libvirt.DomainRevertToSnapshot(snapshot, 0)
+	if err != nil {
+		return fmt.Errorf("could not revert to snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// VMSnapshotRm removes a snapshot of a VM. Only internal snapshots can be
+// removed; external snapshots are removed together with the VM.
+func (v *Virter) VMSnapshotRm(vmName, snapshotName string) error {
+	snapshot, snapcfg, err := v.lookupSnapshot(vmName, snapshotName)
+	if err != nil {
+		return err
+	}
+
+	if isExternalSnapshot(snapcfg) {
+		return fmt.Errorf("cannot remove external snapshot '%s': remove the VM instead", snapshotName)
+	}
+
+	log.Printf("Delete snapshot '%s' of VM '%s'", snapshotName, vmName)
+	err = v.libvirt.DomainSnapshotDelete(snapshot, 0)
+	if err != nil {
+		return fmt.Errorf("could not delete snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func (v *Virter) lookupSnapshot(vmName, snapshotName string) (libvirt.DomainSnapshot, *lx.DomainSnapshot, error) {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, nil, fmt.Errorf("could not get domain: %w", err)
+	}
+
+	snapshot, err := v.libvirt.DomainSnapshotLookupByName(domain, snapshotName, 0)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, nil, fmt.Errorf("could not get snapshot '%s': %w", snapshotName, err)
+	}
+
+	snapcfg, err := v.getSnapshotDescription(snapshot)
+	if err != nil {
+		return libvirt.DomainSnapshot{}, nil, err
+	}
+
+	return snapshot, snapcfg, nil
+}
+
+func (v *Virter) getSnapshotDescription(snapshot libvirt.DomainSnapshot) (*lx.DomainSnapshot, error) {
+	snapXML, err := v.libvirt.DomainSnapshotGetXMLDesc(snapshot, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not get snapshot XML: %w", err)
+	}
+
+	snapcfg := &lx.DomainSnapshot{}
+	err = snapcfg.Unmarshal(snapXML)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal snapshot XML: %w", err)
+	}
+
+	return snapcfg, nil
+}
+
+func isExternalSnapshot(snapcfg *lx.DomainSnapshot) bool {
+	if snapcfg.Memory != nil && snapcfg.Memory.Snapshot == "external" {
+		return true
+	}
+
+	if snapcfg.Disks != nil {
+		for _, disk := range snapcfg.Disks.Disks {
+			if disk.Snapshot == "external" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// externalSnapshotFiles returns the overlay and memory files created by an
+// external snapshot.
+func externalSnapshotFiles(snapcfg *lx.DomainSnapshot) []string {
+	var files []string
+
+	if snapcfg.Memory != nil && snapcfg.Memory.Snapshot == "external" && snapcfg.Memory.File != "" {
+		files = append(files, snapcfg.Memory.File)
+	}
+
+	if snapcfg.Disks != nil {
+		for _, disk := range snapcfg.Disks.Disks {
+			if disk.Snapshot == "external" && disk.Source != nil && disk.Source.File != nil {
+				files = append(files, disk.Source.File.File)
+			}
+		}
+	}
+
+	return files
+}
@@ -0,0 +1,193 @@
+package virter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+)
+
+func runSnapshotVM(t *testing.T, l *FakeLibvirtConnection) *virter.Virter {
+	shell := new(mocks.ShellClient)
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+		Disks:     []virter.Disk{testDisk{"data"}},
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	return v
+}
+
+func TestVMSnapshotCreate(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := runSnapshotVM(t, l)
+
+	err := v.VMSnapshotCreate(vmName, "internal", virter.SnapshotOptions{})
+	assert.NoError(t, err)
+
+	snapshot := l.domains[vmName].snapshots["internal"]
+	assert.Equal(t, "internal", snapshot.Memory.Snapshot)
+	assert.Equal(t, map[string]string{
+		"vda": "internal",
+		"hda": "no",
+		"vdb": "internal",
+	}, snapshotDiskModes(snapshot))
+
+	err = v.VMSnapshotCreate(vmName, "external", virter.SnapshotOptions{External: true})
+	assert.NoError(t, err)
+
+	snapshot = l.domains[vmName].snapshots["external"]
+	assert.Equal(t, "no", snapshot.Memory.Snapshot)
+	assert.Equal(t, "external", snapshot.Disks.Disks[0].Snapshot)
+
+	err = v.VMSnapshotCreate(vmName, "memory", virter.SnapshotOptions{External: true, Memory: true})
+	assert.NoError(t, err)
+
+	snapshot = l.domains[vmName].snapshots["memory"]
+	assert.Equal(t, "external", snapshot.Memory.Snapshot)
+	assert.Equal(t, "/some/some-vm.memory.mem", snapshot.Memory.File)
+
+	l.domains[vmName].active = false
+
+	err = v.VMSnapshotCreate(vmName, "stopped", virter.SnapshotOptions{})
+	assert.NoError(t, err)
+
+	snapshot = l.domains[vmName].snapshots["stopped"]
+	assert.Equal(t, "no", snapshot.Memory.Snapshot)
+
+	err = v.VMSnapshotCreate(vmName, "stopped-memory", virter.SnapshotOptions{Memory: true})
+	assert.Error(t, err)
+
+	err = v.VMSnapshotCreate("nonexistent", "internal", virter.SnapshotOptions{})
+	assert.Error(t, err)
+}
+
+func snapshotDiskModes(snapshot *libvirtxml.DomainSnapshot) map[string]string {
+	modes := make(map[string]string)
+	for _, disk := range snapshot.Disks.Disks {
+		modes[disk.Name] = disk.Snapshot
+	}
+	return modes
+}
+
+func TestVMSnapshotList(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := runSnapshotVM(t, l)
+
+	err := v.VMSnapshotCreate(vmName, "first", virter.SnapshotOptions{})
+	assert.NoError(t, err)
+
+	err = v.VMSnapshotCreate(vmName, "second", virter.SnapshotOptions{External: true})
+	assert.NoError(t, err)
+
+	snapshots, err := v.VMSnapshotList(vmName)
+	assert.NoError(t, err)
+	assert.Equal(t, []virter.SnapshotInfo{
+		{
+			Name:    "first",
+			Created: time.Unix(1, 0),
+			State:   "running",
+			Memory:  true,
+		},
+		{
+			Name:     "second",
+			Parent:   "first",
+			Created:  time.Unix(2, 0),
+			State:    "running",
+			External: true,
+		},
+	}, snapshots)
+}
+
+func TestVMSnapshotRevert(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := runSnapshotVM(t, l)
+
+	l.domains[vmName].active = false
+
+	err := v.VMSnapshotCreate(vmName, "internal", virter.SnapshotOptions{})
+	assert.NoError(t, err)
+
+	err = v.VMSnapshotCreate(vmName, "external", virter.SnapshotOptions{External: true})
+	assert.NoError(t, err)
+
+	err = v.VMSnapshotRevert(vmName, "internal")
+	assert.NoError(t, err)
+	assert.Equal(t, "internal", l.domains[vmName].current)
+
+	err = v.VMSnapshotRevert(vmName, "external")
+	assert.Error(t, err)
+
+	err = v.VMSnapshotRevert(vmName, "nonexistent")
+	assert.Error(t, err)
+}
+
+func TestVMSnapshotRm(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := runSnapshotVM(t, l)
+
+	err := v.VMSnapshotCreate(vmName, "internal", virter.SnapshotOptions{})
+	assert.NoError(t, err)
+
+	err = v.VMSnapshotCreate(vmName, "external", virter.SnapshotOptions{External: true})
+	assert.NoError(t, err)
+
+	err = v.VMSnapshotRm(vmName, "internal")
+	assert.NoError(t, err)
+	assert.NotContains(t, l.domains[vmName].snapshots, "internal")
+
+	err = v.VMSnapshotRm(vmName, "external")
+	assert.Error(t, err)
+	assert.Contains(t, l.domains[vmName].snapshots, "external")
+}
+
+func TestVMRmExternalSnapshot(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := runSnapshotVM(t, l)
+
+	err := v.VMSnapshotCreate(vmName, "external", virter.SnapshotOptions{External: true})
+	assert.NoError(t, err)
+
+	overlay := vmName + ".external"
+	l.vols[overlay] = &FakeLibvirtStorageVol{
+		description: &libvirtxml.StorageVolume{
+			Target: &libvirtxml.StorageVolumeTarget{Path: backingPath + ".external"},
+		},
+	}
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+
+	assert.Len(t, l.vols, 1)
+	assert.Contains(t, l.vols, imageName)
+	assert.Empty(t, l.domains)
+}
+
+func TestVMCommitExternalSnapshot(t *testing.T) {
+	l := newFakeLibvirtConnection()
+	v := runSnapshotVM(t, l)
+
+	l.domains[vmName].active = false
+
+	err := v.VMSnapshotCreate(vmName, "external", virter.SnapshotOptions{External: true})
+	assert.NoError(t, err)
+
+	err = v.VMCommit(nil, vmName, false, time.Second)
+	assert.Error(t, err)
+	assert.Contains(t, l.domains, vmName)
+}
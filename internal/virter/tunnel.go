@@ -0,0 +1,15 @@
+package virter
+
+// Tunnel makes ports of VMs reachable from the machine virter runs on. This
+// is required when the VMs are not directly reachable, for instance because
+// they run on a remote libvirt host.
+type Tunnel interface {
+	// Forward returns a local address which is forwarded to the given
+	// address as seen from the libvirt host.
+	Forward(hostPort string) (string, error)
+}
+
+// SetTunnel configures virter to reach the VMs through a tunnel.
+func (v *Virter) SetTunnel(tunnel Tunnel) {
+	v.tunnel = tunnel
+}
@@ -0,0 +1,133 @@
+package virter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	libvirt "github.com/digitalocean/go-libvirt"
+	lx "github.com/libvirt/libvirt-go-xml"
+)
+
+// userNetworkIP is the address under which the forwarded ports of VMs
+// attached with user-mode networking are reachable.
+const userNetworkIP = "127.0.0.1"
+
+// maxUserNetworkID is the highest ID assigned to VMs with user-mode
+// networking, like in a /24 libvirt network.
+const maxUserNetworkID = 254
+
+// UseUserNetwork configures virter to attach VMs using QEMU user-mode
+// networking instead of the libvirt network. This is required for
+// unprivileged qemu:///session connections, which cannot manage DHCP
+// reservations. The SSH port of each VM is forwarded to 127.0.0.1 on port
+// sshPortBase + ID.
+func (v *Virter) UseUserNetwork(sshPortBase uint) {
+	v.userNetworkSSHPortBase = sshPortBase
+}
+
+func (v *Virter) userNetwork() bool {
+	return v.userNetworkSSHPortBase != 0
+}
+
+func (v *Virter) userNetworkSSHPort(id uint) uint {
+	return v.userNetworkSSHPortBase + id
+}
+
+// userNetworkCommandline returns the QEMU arguments which attach a network
+// device with user-mode networking and forward the SSH port. libvirt only
+// supports port forwarding for user-mode networking with the passt backend,
+// so the device is added to the QEMU command line directly.
+func (v *Virter) userNetworkCommandline(id uint) *lx.DomainQEMUCommandline {
+	netdev := fmt.Sprintf("user,id=virter0,hostfwd=tcp:%s:%d-:22", userNetworkIP, v.userNetworkSSHPort(id))
+	return &lx.DomainQEMUCommandline{
+		Args: []lx.DomainQEMUCommandlineArg{
+			{Value: "-netdev"},
+			{Value: netdev},
+			{Value: "-device"},
+			{Value: "virtio-net-pci,netdev=virter0"},
+		},
+	}
+}
+
+// getUserNetworkVMID returns wantedID if it is not 0 and not used by another
+// VM. Otherwise it returns the highest unused ID. The IDs in use are taken
+// from the virter metadata of the existing domains.
+func (v *Virter) getUserNetworkVMID(wantedID uint) (uint, error) {
+	if v.userNetworkSSHPort(wantedID) > 65535 {
+		return 0, fmt.Errorf("SSH port for ID '%d' is out of range", wantedID)
+	}
+
+	usedIDs, err := v.getMetadataIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	if wantedID != 0 {
+		if usedIDs[wantedID] {
+			return 0, fmt.Errorf("preset ID '%d' already used", wantedID)
+		}
+		return wantedID, nil
+	}
+
+	return v.freeID(usedIDs, maxUserNetworkID)
+}
+
+// sshAddress returns the address under which the SSH port of the VM with the
+// given IP and ID can be reached.
+func (v *Virter) sshAddress(ip string, id uint) (string, error) {
+	if v.userNetwork() {
+		return net.JoinHostPort(userNetworkIP, strconv.Itoa(int(v.userNetworkSSHPort(id)))), nil
+	}
+
+	hostPort := net.JoinHostPort(ip, "22")
+	if v.tunnel == nil {
+		return hostPort, nil
+	}
+
+	return v.tunnel.Forward(hostPort)
+}
+
+// getSSHAddress returns the address under which the SSH port of a running VM
+// can be reached.
+func (v *Virter) getSSHAddress(vmName string, network *libvirt.Network) (string, error) {
+	ip, err := v.getIP(vmName, network)
+	if err != nil {
+		return "", err
+	}
+
+	var id uint
+	if v.userNetwork() {
+		meta, err := v.VMInspect(vmName)
+		if err != nil {
+			return "", err
+		}
+		id = meta.ID
+	}
+
+	return v.sshAddress(ip, id)
+}
+
+// getSSHAddresses returns the addresses under which the SSH ports of some
+// running VMs can be reached.
+func (v *Virter) getSSHAddresses(vmNames []string) ([]string, error) {
+	var network *libvirt.Network
+	if v.usesLibvirtNetwork() {
+		lookup, err := v.libvirt.NetworkLookupByName(v.networkName)
+		if err != nil {
+			return nil, fmt.Errorf("could not get network: %w", err)
+		}
+		network = &lookup
+	}
+
+	hostPorts := make([]string, len(vmNames))
+	for i, vmName := range vmNames {
+		hostPort, err := v.getSSHAddress(vmName, network)
+		if err != nil {
+			return nil, err
+		}
+		hostPorts[i] = hostPort
+	}
+
+	return hostPorts, nil
+}
@@ -0,0 +1,101 @@
+package virter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/LINBIT/virter/internal/virter"
+	"github.com/LINBIT/virter/internal/virter/mocks"
+	"github.com/LINBIT/virter/pkg/netcopy"
+)
+
+const sshPortBase = 22000
+
+func userNetworkVMConfig(name string, id uint) virter.VMConfig {
+	return virter.VMConfig{
+		ImageName:     imageName,
+		Name:          name,
+		ID:            id,
+		VCPUs:         1,
+		MemoryKiB:     1024,
+		SSHPublicKeys: []string{sshPublicKey},
+		SSHPrivateKey: []byte(sshPrivateKey),
+		WaitSSH:       true,
+		SSHPingCount:  1,
+		SSHPingPeriod: time.Second, // ignored
+	}
+}
+
+func TestVMRunUserNetwork(t *testing.T) {
+	shell := new(mocks.ShellClient)
+	shell.On("Dial").Return(nil)
+	shell.On("Close").Return(nil)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+	v.UseUserNetwork(sshPortBase)
+
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, userNetworkVMConfig(vmName, vmID))
+	assert.NoError(t, err)
+
+	assert.Empty(t, l.network.description.IPs[0].DHCP.Hosts)
+
+	domain := l.domains[vmName]
+	assert.True(t, domain.active)
+	assert.Empty(t, domain.description.Devices.Interfaces)
+	assert.Contains(t, domain.description.QEMUCommandline.Args[1].Value, "hostfwd=tcp:127.0.0.1:22042-:22")
+
+	// the ID of the existing VM must not be reused
+	err = v.VMRun(context.Background(), MockShellClientBuilder{shell}, userNetworkVMConfig("other-vm", vmID))
+	assert.Error(t, err)
+
+	err = v.VMRun(context.Background(), MockShellClientBuilder{shell}, userNetworkVMConfig("other-vm", 0))
+	assert.NoError(t, err)
+
+	meta, err := v.VMInspect("other-vm")
+	assert.NoError(t, err)
+	assert.Equal(t, uint(254), meta.ID)
+
+	vms, err := v.VMList()
+	assert.NoError(t, err)
+	assert.Len(t, vms, 2)
+	assert.Equal(t, "127.0.0.1", vms[1].IP)
+	assert.Equal(t, uint(22042), vms[1].SSHPort)
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+	assert.Empty(t, l.network.description.IPs[0].DHCP.Hosts)
+}
+
+func TestVMExecCopyUserNetwork(t *testing.T) {
+	shell := new(mocks.ShellClient)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+	v.UseUserNetwork(sshPortBase)
+
+	c := userNetworkVMConfig(vmName, vmID)
+	c.WaitSSH = false
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	copier := new(mocks.NetworkCopier)
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{Path: "/tmp/file1.txt"},
+	}, netcopy.HostPath{Path: "/tmp", Host: "127.0.0.1", Port: "22042"}).Return(nil)
+
+	err = v.VMExecCopy(context.Background(), copier, []string{"/tmp/file1.txt"}, vmName+":/tmp")
+	assert.NoError(t, err)
+
+	copier.AssertExpectations(t)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"text/template"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 // LibvirtConnection contains required libvirt connection methods.
 type LibvirtConnection interface {
 	StoragePoolLookupByName(Name string) (rPool libvirt.StoragePool, err error)
+	StoragePoolListAllVolumes(Pool libvirt.StoragePool, NeedResults int32, Flags uint32) (rVols []libvirt.StorageVol, rRet uint32, err error)
 	StorageVolCreateXML(Pool libvirt.StoragePool, XML string, Flags libvirt.StorageVolCreateFlags) (rVol libvirt.StorageVol, err error)
 	StorageVolDelete(Vol libvirt.StorageVol, Flags libvirt.StorageVolDeleteFlags) (err error)
 	StorageVolGetPath(Vol libvirt.StorageVol) (rName string, err error)
@@ -24,9 +26,19 @@ type LibvirtConnection interface {
 	StorageVolCreateXMLFrom(Pool libvirt.StoragePool, XML string, Clonevol libvirt.StorageVol, Flags libvirt.StorageVolCreateFlags) (rVol libvirt.StorageVol, err error)
 	StorageVolDownload(Vol libvirt.StorageVol, inStream io.Writer, Offset uint64, Length uint64, Flags libvirt.StorageVolDownloadFlags) (err error)
 	StorageVolGetInfo(Vol libvirt.StorageVol) (rType int8, rCapacity uint64, rAllocation uint64, err error)
+	StorageVolLookupByPath(Path string) (rVol libvirt.StorageVol, err error)
+	StoragePoolRefresh(Pool libvirt.StoragePool, Flags uint32) (err error)
 	NetworkLookupByName(Name string) (rNet libvirt.Network, err error)
 	NetworkGetXMLDesc(Net libvirt.Network, Flags uint32) (rXML string, err error)
 	NetworkUpdate(Net libvirt.Network, Command uint32, Section uint32, ParentIndex int32, XML string, Flags libvirt.NetworkUpdateFlags) (err error)
+	NetworkDefineXML(XML string) (rNet libvirt.Network, err error)
+	NetworkCreate(Net libvirt.Network) (err error)
+	NetworkSetAutostart(Net libvirt.Network, Autostart int32) (err error)
+	NetworkIsActive(Net libvirt.Network) (rActive int32, err error)
+	NetworkDestroy(Net libvirt.Network) (err error)
+	NetworkUndefine(Net libvirt.Network) (err error)
+	ConnectListAllNetworks(NeedResults int32, Flags libvirt.ConnectListAllNetworksFlags) (rNets []libvirt.Network, rRet uint32, err error)
+	ConnectListAllDomains(NeedResults int32, Flags libvirt.ConnectListAllDomainsFlags) (rDomains []libvirt.Domain, rRet uint32, err error)
 	DomainLookupByName(Name string) (rDom libvirt.Domain, err error)
 	DomainGetXMLDesc(Dom libvirt.Domain, Flags libvirt.DomainXMLFlags) (rXML string, err error)
 	DomainDefineXML(XML string) (rDom libvirt.Domain, err error)
@@ -35,9 +47,14 @@ type LibvirtConnection interface {
 	DomainIsPersistent(Dom libvirt.Domain) (rPersistent int32, err error)
 	DomainShutdown(Dom libvirt.Domain) (err error)
 	DomainDestroy(Dom libvirt.Domain) (err error)
+	DomainReboot(Dom libvirt.Domain, Flags libvirt.DomainRebootFlagValues) (err error)
 	DomainUndefine(Dom libvirt.Domain) (err error)
 	DomainListAllSnapshots(Dom libvirt.Domain, NeedResults int32, Flags uint32) (rSnapshots []libvirt.DomainSnapshot, rRet int32, err error)
 	DomainSnapshotDelete(Snap libvirt.DomainSnapshot, Flags libvirt.DomainSnapshotDeleteFlags) (err error)
+	DomainSnapshotCreateXML(Dom libvirt.Domain, XMLDesc string, Flags uint32) (rSnap libvirt.DomainSnapshot, err error)
+	DomainSnapshotLookupByName(Dom libvirt.Domain, Name string, Flags uint32) (rSnap libvirt.DomainSnapshot, err error)
+	DomainSnapshotGetXMLDesc(Snap libvirt.DomainSnapshot, Flags uint32) (rXML string, err error)
+	DomainRevertToSnapshot(Snap libvirt.DomainSnapshot, Flags uint32) (err error)
 	LifecycleEvents() (<-chan libvirt.DomainEventLifecycleMsg, error)
 	Disconnect() error
 }
@@ -47,6 +64,25 @@ type Virter struct {
 	libvirt         LibvirtConnection
 	storagePoolName string
 	networkName     string
+	tunnel          Tunnel
+	// userNetworkSSHPortBase is non-zero when VMs are attached using
+	// user-mode networking
+	userNetworkSSHPortBase uint
+	// dnsDomain is used when the network does not define a domain
+	dnsDomain string
+	// hostBridge is set when VMs are attached to an existing host bridge
+	// instead of the libvirt network
+	hostBridge *HostBridge
+	// macPrefix is the OUI of the MAC addresses derived from the VM IDs
+	macPrefix net.HardwareAddr
+	// dhcpRelease enables releasing DHCP leases with dhcp_release
+	dhcpRelease bool
+	// idRange limits the automatically chosen VM IDs
+	idRange *IDRange
+	// idLockFile serializes ID allocation between virter processes
+	idLockFile string
+	// guestAgent is used for commands to the guest agents of the VMs
+	guestAgent GuestAgentConnection
 }
 
 // New configures a new Virter.
@@ -62,7 +98,21 @@ func New(libvirtConnection LibvirtConnection,
 
 // Disconnect disconnects virter's connection to libvirt
 func (v *Virter) Disconnect() error {
-	return v.libvirt.Disconnect()
+	if closer, ok := v.guestAgent.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("failed to close guest agent connection: %v", err)
+		}
+	}
+
+	err := v.libvirt.Disconnect()
+
+	if closer, ok := v.tunnel.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("failed to close tunnel: %v", err)
+		}
+	}
+
+	return err
 }
 
 // ForceDisconnect disconnects virter's connection to libvirt
@@ -87,8 +137,10 @@ type Disk interface {
 
 // VMConfig contains the configuration for starting a VM
 type VMConfig struct {
-	ImageName       string
-	Name            string
+	ImageName string
+	Name      string
+	// NamePrefix is used to name the VM after its ID if Name is empty
+	NamePrefix      string
 	MemoryKiB       uint64
 	BootCapacityKiB uint64
 	VCPUs           uint
@@ -98,8 +150,26 @@ type VMConfig struct {
 	WaitSSH         bool
 	SSHPingCount    int
 	SSHPingPeriod   time.Duration
-	ConsolePath     string
-	Disks           []Disk
+	// WaitCloudInit waits until cloud-init has finished after SSH is
+	// reachable. It implies WaitSSH.
+	WaitCloudInit    bool
+	CloudInitTimeout time.Duration
+	ConsolePath      string
+	// GuestAgent adds a channel for the QEMU guest agent
+	GuestAgent bool
+	Disks      []Disk
+	ExtraNICs  []NIC
+	Labels     map[string]string
+	CloudInit  CloudInitData
+}
+
+// CloudInitData contains additional cloud-init data for a VM. UserData must
+// be a cloud-config document, which is merged with the cloud-config generated
+// by virter. VendorData and NetworkConfig are passed to cloud-init unchanged.
+type CloudInitData struct {
+	UserData      []byte
+	VendorData    []byte
+	NetworkConfig []byte
 }
 
 func checkDisks(vmConfig VMConfig) error {
@@ -127,6 +197,8 @@ func CheckVMConfig(vmConfig VMConfig) (VMConfig, error) {
 		return vmConfig, fmt.Errorf("cannot start a VM with reserved ID (i.e., IP) 'x.y.z.%d'", vmConfig.ID)
 	} else if err := checkDisks(vmConfig); err != nil {
 		return vmConfig, fmt.Errorf("cannot start VM: %w", err)
+	} else if err := checkNICs(vmConfig); err != nil {
+		return vmConfig, fmt.Errorf("cannot start VM: %w", err)
 	}
 
 	return vmConfig, nil
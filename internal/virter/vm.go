@@ -2,9 +2,12 @@ package virter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -14,7 +17,6 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/sync/errgroup"
 
 	sshclient "github.com/LINBIT/gosshclient"
 	"github.com/LINBIT/virter/pkg/actualtime"
@@ -60,16 +62,11 @@ func (v *Virter) anyImageExists(vmConfig VMConfig) (bool, error) {
 	return false, nil
 }
 
-// VMRun starts a VM.
-func (v *Virter) VMRun(shellClientBuilder ShellClientBuilder, vmConfig VMConfig) error {
-	// checks
-	vmConfig, err := CheckVMConfig(vmConfig)
-	if err != nil {
-		return err
-	}
-
+// checkVMNotExists checks that neither the domain nor any of the volumes of a
+// new VM exist yet.
+func (v *Virter) checkVMNotExists(vmConfig VMConfig) error {
 	vmName := vmConfig.Name
-	_, err = v.libvirt.DomainLookupByName(vmName)
+	_, err := v.libvirt.DomainLookupByName(vmName)
 	if !hasErrorCode(err, errNoDomain) {
 		if err != nil {
 			return fmt.Errorf("could not get domain: %w", err)
@@ -83,54 +80,180 @@ func (v *Virter) VMRun(shellClientBuilder ShellClientBuilder, vmConfig VMConfig)
 		return fmt.Errorf("one of the images already exists")
 	}
 
-	id, err := v.getVMID(vmConfig.ID)
+	return nil
+}
+
+// VMRun starts a VM. If the context is cancelled before the VM is up, the
+// resources created so far are removed again.
+func (v *Virter) VMRun(ctx context.Context, shellClientBuilder ShellClientBuilder, vmConfig VMConfig) error {
+	_, err := v.VMRunAutoName(ctx, shellClientBuilder, vmConfig)
+	return err
+}
+
+// VMRunAutoName starts a VM like VMRun and returns its name. If the name in
+// vmConfig is empty, the VM is named "<NamePrefix>-<ID>" once its ID has been
+// chosen.
+func (v *Virter) VMRunAutoName(ctx context.Context, shellClientBuilder ShellClientBuilder, vmConfig VMConfig) (string, error) {
+	// checks
+	vmConfig, err := CheckVMConfig(vmConfig)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if vmConfig.Name == "" && vmConfig.NamePrefix == "" {
+		return "", fmt.Errorf("cannot start a VM without a name")
+	} else if vmConfig.Name != "" {
+		if err := v.checkVMNotExists(vmConfig); err != nil {
+			return "", err
+		}
+	}
+
+	if err := v.checkNetworks(vmConfig); err != nil {
+		return "", err
 	}
-	vmConfig.ID = id
 	// end checks
 
 	sp, err := v.libvirt.StoragePoolLookupByName(v.storagePoolName)
 	if err != nil {
-		return fmt.Errorf("could not get storage pool: %w", err)
+		return "", fmt.Errorf("could not get storage pool: %w", err)
+	}
+
+	// remove everything that was created if any of the following steps
+	// fails, so that the VM can simply be run again
+	rb := &rollback{}
+	vmConfig, d, ip, err := v.reserveVM(sp, vmConfig, rb)
+	if err != nil {
+		return "", err
+	}
+	vmName := vmConfig.Name
+
+	err = v.vmRunCreate(ctx, shellClientBuilder, sp, vmConfig, d, ip, rb)
+	if err != nil {
+		log.Warnf("Failed to run VM '%s', removing created resources", vmName)
+		rb.run()
+		return "", err
+	}
+
+	return vmName, nil
+}
+
+// maxReserveAttempts limits how often reserveVM chooses another ID because
+// the chosen one was taken by another host.
+const maxReserveAttempts = 10
+
+// reserveVM chooses the ID of a new VM, then defines its domain and adds its
+// DHCP entries. No other virter process using the same ID lock file can
+// choose the same ID in the meantime. The lock is released before the
+// volumes are created, so that VMs can be created in parallel.
+//
+// Virter processes on other hosts may use the same libvirt daemon. If one of
+// them added a DHCP entry for the same ID in the meantime, the next free ID
+// is chosen, unless the ID was given explicitly.
+func (v *Virter) reserveVM(sp libvirt.StoragePool, vmConfig VMConfig, rb *rollback) (VMConfig, libvirt.Domain, net.IP, error) {
+	unlockIDs, err := v.lockIDs()
+	if err != nil {
+		return vmConfig, libvirt.Domain{}, nil, err
 	}
+	defer unlockIDs()
 
+	for attempt := 1; ; attempt++ {
+		config := vmConfig
+		id, err := v.getVMID(vmConfig.ID, v.vmNetworkNames(vmConfig))
+		if err != nil {
+			return config, libvirt.Domain{}, nil, err
+		}
+		config.ID = id
+
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("%s-%d", config.NamePrefix, id)
+			if err := v.checkVMNotExists(config); err != nil {
+				return config, libvirt.Domain{}, nil, err
+			}
+		}
+
+		attemptRb := &rollback{}
+		d, ip, err := v.defineVM(sp, config, attemptRb)
+		if err == nil {
+			rb.actions = append(rb.actions, attemptRb.actions...)
+			return config, d, ip, nil
+		}
+		attemptRb.run()
+
+		if vmConfig.ID != 0 || !hasErrorCode(err, errOperationInvalid) || attempt == maxReserveAttempts {
+			return config, libvirt.Domain{}, nil, err
+		}
+		log.Printf("ID %d was taken by another host, choosing another one", id)
+	}
+}
+
+func (v *Virter) vmRunCreate(ctx context.Context, shellClientBuilder ShellClientBuilder, sp libvirt.StoragePool, vmConfig VMConfig, d libvirt.Domain, ip net.IP, rb *rollback) error {
 	log.Print("Create boot volume")
-	err = v.createVMVolume(sp, vmConfig)
+	err := v.createVMVolume(sp, vmConfig, rb)
 	if err != nil {
 		return err
 	}
 
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	log.Print("Create cloud-init volume")
-	err = v.createCIData(sp, vmConfig)
+	err = v.createCIData(ctx, sp, vmConfig, rb)
 	if err != nil {
 		return err
 	}
 
 	for _, d := range vmConfig.Disks {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		log.Printf("Create volume '%s'", d.GetName())
-		err = v.createDiskVolume(sp, vmConfig.Name, d)
+		err = v.createDiskVolume(sp, vmConfig.Name, d, rb)
 		if err != nil {
 			return err
 		}
 	}
 
-	ip, err := v.createVM(sp, vmConfig)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err = v.startVM(d, rb)
 	if err != nil {
 		return err
 	}
 
-	if vmConfig.WaitSSH {
-		err := pingSSH(shellClientBuilder, vmConfig, ip)
+	if vmConfig.WaitSSH || vmConfig.WaitCloudInit {
+		hostPort, err := v.sshAddress(ip.String(), vmConfig.ID)
+		if err != nil {
+			return err
+		}
+
+		err = v.pingSSH(ctx, shellClientBuilder, vmConfig, hostPort)
 		if err != nil {
 			return err
 		}
+
+		if vmConfig.WaitCloudInit {
+			err = v.waitCloudInit(ctx, shellClientBuilder, vmConfig, hostPort)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-func (v *Virter) createVMVolume(sp libvirt.StoragePool, vmConfig VMConfig) error {
+// rollbackVolume records the removal of a newly created volume.
+func (v *Virter) rollbackVolume(rb *rollback, vol libvirt.StorageVol) {
+	rb.add(fmt.Sprintf("delete volume '%s'", vol.Name), func() error {
+		return v.libvirt.StorageVolDelete(vol, 0)
+	})
+}
+
+func (v *Virter) createVMVolume(sp libvirt.StoragePool, vmConfig VMConfig, rb *rollback) error {
 	imageName := vmConfig.ImageName
 	vmName := vmConfig.Name
 
@@ -161,24 +284,26 @@ func (v *Virter) createVMVolume(sp libvirt.StoragePool, vmConfig VMConfig) error
 		return err
 	}
 
-	_, err = v.libvirt.StorageVolCreateXML(sp, xml, 0)
+	vol, err := v.libvirt.StorageVolCreateXML(sp, xml, 0)
 	if err != nil {
 		return fmt.Errorf("could not create VM boot volume: %w", err)
 	}
+	v.rollbackVolume(rb, vol)
 
 	return nil
 }
 
-func (v *Virter) createDiskVolume(sp libvirt.StoragePool, vmName string, disk Disk) error {
+func (v *Virter) createDiskVolume(sp libvirt.StoragePool, vmName string, disk Disk, rb *rollback) error {
 	xml, err := v.diskVolumeXML(diskVolumeName(vmName, disk.GetName()), disk.GetSizeKiB(), "KiB", disk.GetFormat())
 	if err != nil {
 		return err
 	}
 
-	_, err = v.libvirt.StorageVolCreateXML(sp, xml, 0)
+	vol, err := v.libvirt.StorageVolCreateXML(sp, xml, 0)
 	if err != nil {
 		return fmt.Errorf("could not create scratch volume: %w", err)
 	}
+	v.rollbackVolume(rb, vol)
 
 	return nil
 }
@@ -187,10 +312,13 @@ func diskVolumeName(vmName string, diskName string) string {
 	return vmName + "-" + diskName
 }
 
-func (v *Virter) createVM(sp libvirt.StoragePool, vmConfig VMConfig) (net.IP, error) {
+// defineVM defines the domain of a VM and adds its DHCP entries. It returns
+// the IP which is used to reach the VM. The volumes of the domain only have
+// to exist once it is started.
+func (v *Virter) defineVM(sp libvirt.StoragePool, vmConfig VMConfig, rb *rollback) (libvirt.Domain, net.IP, error) {
 	xml, err := v.vmXML(sp.Name, vmConfig)
 	if err != nil {
-		return nil, err
+		return libvirt.Domain{}, nil, err
 	}
 
 	log.Debugf("Using domain XML: %s", xml)
@@ -198,44 +326,139 @@ func (v *Virter) createVM(sp libvirt.StoragePool, vmConfig VMConfig) (net.IP, er
 	log.Print("Define VM")
 	d, err := v.libvirt.DomainDefineXML(xml)
 	if err != nil {
-		return nil, fmt.Errorf("could not define domain: %w", err)
+		return libvirt.Domain{}, nil, fmt.Errorf("could not define domain: %w", err)
 	}
+	rb.add("undefine VM", func() error {
+		return v.libvirt.DomainUndefine(d)
+	})
 
-	domainXML, err := v.libvirt.DomainGetXMLDesc(d, 0)
+	// VMs with user-mode networking are reached through forwarded ports
+	// and do not need a DHCP entry
+	ip := net.ParseIP(userNetworkIP)
+	if !v.userNetwork() {
+		ip, err = v.addDomainDHCPEntries(d, vmConfig.ID, rb)
+		if err != nil {
+			return libvirt.Domain{}, nil, err
+		}
+	}
+
+	// VMs on a host bridge get their IP from the static lease for their
+	// MAC address
+	if v.hostBridge != nil {
+		lease, err := v.hostBridge.leaseForID(vmConfig.ID)
+		if err != nil {
+			return libvirt.Domain{}, nil, err
+		}
+		ip = lease.IP
+	}
+
+	return d, ip, nil
+}
+
+func (v *Virter) startVM(d libvirt.Domain, rb *rollback) error {
+	log.Print("Start VM")
+	err := v.libvirt.DomainCreate(d)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("could not create (start) domain: %w", err)
 	}
+	rb.add("stop VM", func() error {
+		return v.libvirt.DomainDestroy(d)
+	})
 
-	domcfg := &libvirtxml.Domain{}
-	err = domcfg.Unmarshal(domainXML)
+	return nil
+}
+
+// addDomainDHCPEntries adds the DHCP entries for all interfaces of a domain
+// and DNS entries for its name. It returns the IP of the first interface on
+// a libvirt network.
+func (v *Virter) addDomainDHCPEntries(d libvirt.Domain, id uint, rb *rollback) (net.IP, error) {
+	ifaces, err := v.getDomainNetworkInterfaces(d)
 	if err != nil {
 		return nil, err
 	}
+	if len(ifaces) < 1 && v.hostBridge == nil {
+		return nil, fmt.Errorf("no network interfaces in domain")
+	}
 
-	mac := domcfg.Devices.Interfaces[0].MAC.Address
+	var ip net.IP
+	for i, iface := range ifaces {
+		network, err := v.libvirt.NetworkLookupByName(iface.network)
+		if err != nil {
+			return nil, fmt.Errorf("could not get network '%s': %w", iface.network, err)
+		}
+
+		external, err := v.externalNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		if external {
+			// the VM could not be reached without a known IP
+			if i == 0 && v.usesLibvirtNetwork() {
+				return nil, fmt.Errorf("network '%s' is managed outside libvirt; use a host bridge with static leases instead", iface.network)
+			}
+			log.Printf("Network '%s' is managed outside libvirt, not adding DHCP entry", iface.network)
+			continue
+		}
+
+		ips, err := v.addInterfaceDHCPEntry(d.Name, network, iface.mac, id, rb)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			ip = ips[0]
+		}
+	}
 
+	return ip, nil
+}
+
+func (v *Virter) addInterfaceDHCPEntry(vmName string, network libvirt.Network, mac string, id uint, rb *rollback) ([]net.IP, error) {
 	// Add DHCP entry after defining the VM to ensure that it can be
 	// removed when removing the VM, but before starting it to ensure that
 	// it gets the correct IP address
-	ip, err := v.addDHCPEntry(mac, vmConfig.ID)
+	ips, err := v.addDHCPEntry(network, vmName, mac, id)
 	if err != nil {
 		return nil, err
 	}
+	rb.add("remove DHCP entry", func() error {
+		hosts, err := v.findDHCPHosts(network, vmName, mac)
+		if err != nil {
+			return err
+		}
 
-	log.Print("Start VM")
-	err = v.libvirt.DomainCreate(d)
-	if err != nil {
-		return nil, fmt.Errorf("could not create (start) domain: %w", err)
+		v.rmDHCPHosts(network, hosts)
+
+		ipStrings := make([]string, len(ips))
+		for i, ip := range ips {
+			ipStrings[i] = ip.String()
+		}
+
+		err = v.tryReleaseDHCP(mac, ipStrings, network)
+		if err != nil {
+			log.Debugf("Could not release DHCP lease: %v", err)
+		}
+
+		return nil
+	})
+
+	for _, ip := range ips {
+		ip := ip
+		err = v.addDNSHost(network, vmName, ip)
+		if err != nil {
+			return nil, err
+		}
+		rb.add("remove DNS entry", func() error {
+			return v.rmDNSHost(network, ip.String())
+		})
 	}
 
-	return ip, nil
+	return ips, nil
 }
 
-func pingSSH(shellClientBuilder ShellClientBuilder, vmConfig VMConfig, ip net.IP) error {
+func (v *Virter) pingSSH(ctx context.Context, shellClientBuilder ShellClientBuilder, vmConfig VMConfig, hostPort string) error {
 	log.Print("Wait for SSH port to open")
 
-	hostPort := net.JoinHostPort(ip.String(), "ssh")
-
 	sshConfig, err := getSSHClientConfig(vmConfig.SSHPrivateKey)
 	if err != nil {
 		return err
@@ -249,7 +472,7 @@ func pingSSH(shellClientBuilder ShellClientBuilder, vmConfig VMConfig, ip net.IP
 	// Using ActualTime breaks the expectation of the unit tests
 	// that this code does not sleep, but we work around that by
 	// always making the first ping successful in tests
-	if err := (actualtime.ActualTime{}.Ping(vmConfig.SSHPingCount, vmConfig.SSHPingPeriod, sshTry)); err != nil {
+	if err := (actualtime.ActualTime{}.Ping(ctx, vmConfig.SSHPingCount, vmConfig.SSHPingPeriod, sshTry)); err != nil {
 		return fmt.Errorf("unable to connect to SSH port: %w", err)
 	}
 
@@ -274,12 +497,12 @@ func (v *Virter) VMRm(vmName string) error {
 		return fmt.Errorf("could not get storage pool: %w", err)
 	}
 
-	err = v.vmRmExceptBoot(sp, vmName)
+	bootVolume, err := v.vmRmExceptBoot(sp, vmName)
 	if err != nil {
 		return err
 	}
 
-	err = v.rmVolume(sp, vmName, "boot")
+	err = v.rmVolume(sp, bootVolume, "boot")
 	if err != nil {
 		return err
 	}
@@ -287,80 +510,210 @@ func (v *Virter) VMRm(vmName string) error {
 	return nil
 }
 
-func (v *Virter) vmRmExceptBoot(sp libvirt.StoragePool, vmName string) error {
+// vmRmExceptBoot removes a VM and all its volumes except for the boot volume.
+// The volumes to remove are taken from the virter metadata of the domain.
+// It returns the name of the boot volume.
+//
+// If the domain does not exist, the volumes left over by a VM which failed to
+// be created are removed, with the names virter gives them.
+func (v *Virter) vmRmExceptBoot(sp libvirt.StoragePool, vmName string) (string, error) {
 	domain, err := v.libvirt.DomainLookupByName(vmName)
-	if !hasErrorCode(err, errNoDomain) {
+	if hasErrorCode(err, errNoDomain) {
+		log.Debugf("Domain '%s' does not exist, removing leftover volumes", vmName)
+		err = v.rmVolume(sp, ciDataVolumeName(vmName), "cloud-init")
 		if err != nil {
-			return fmt.Errorf("could not get domain: %w", err)
+			return "", err
 		}
 
+		volumes, err := v.leftoverDiskVolumes(sp, vmName)
+		if err != nil {
+			return "", err
+		}
+
+		for _, volume := range volumes {
+			err = v.rmVolume(sp, volume, "disk")
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return vmName, nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not get domain: %w", err)
+	}
+
+	meta, err := v.getVMMetadata(domain)
+	if err != nil {
+		return "", err
+	}
+
+	bootVolume := vmName
+	var volumes []string
+	if meta != nil {
+		bootVolume = meta.BootVolume
+		volumes = meta.Volumes()
+	} else {
+		// domains created by older versions of virter have no
+		// metadata; assume all attached volumes belong to the VM
+		log.Debugf("Domain '%s' has no virter metadata, removing all attached volumes", vmName)
 		disks, err := v.getDisksOfDomain(domain)
 		if err != nil {
-			return err
+			return "", err
+		}
+
+		for _, disk := range disks {
+			if disk != bootVolume {
+				volumes = append(volumes, disk)
+			}
 		}
+	}
+
+	snapshotFiles, err := v.rmSnapshots(domain)
+	if err != nil {
+		return "", err
+	}
 
-		err = v.rmSnapshots(domain)
+	active, err := v.libvirt.DomainIsActive(domain)
+	if err != nil {
+		return "", fmt.Errorf("could not check if domain is active: %w", err)
+	}
+
+	persistent, err := v.libvirt.DomainIsPersistent(domain)
+	if err != nil {
+		return "", fmt.Errorf("could not check if domain is persistent: %w", err)
+	}
+
+	if !v.userNetwork() {
+		err = v.rmDHCPEntry(domain)
 		if err != nil {
-			return err
+			return "", err
 		}
+	}
 
-		active, err := v.libvirt.DomainIsActive(domain)
+	if active != 0 {
+		log.Print("Stop VM")
+		err = v.libvirt.DomainDestroy(domain)
 		if err != nil {
-			return fmt.Errorf("could not check if domain is active: %w", err)
+			return "", fmt.Errorf("could not destroy domain: %w", err)
 		}
+	}
 
-		persistent, err := v.libvirt.DomainIsPersistent(domain)
+	if persistent != 0 {
+		log.Print("Undefine VM")
+		err = v.libvirt.DomainUndefine(domain)
 		if err != nil {
-			return fmt.Errorf("could not check if domain is persistent: %w", err)
+			return "", fmt.Errorf("could not undefine domain: %w", err)
 		}
+	}
 
-		err = v.rmDHCPEntry(domain)
+	err = v.rmSnapshotFiles(sp, snapshotFiles)
+	if err != nil {
+		return "", err
+	}
+
+	for _, volume := range volumes {
+		err = v.rmVolume(sp, volume, "disk")
 		if err != nil {
-			return err
+			return "", err
 		}
+	}
 
-		if active != 0 {
-			log.Print("Stop VM")
-			err = v.libvirt.DomainDestroy(domain)
-			if err != nil {
-				return fmt.Errorf("could not destroy domain: %w", err)
-			}
+	return bootVolume, nil
+}
+
+// leftoverDiskVolumes returns the disk volumes of a VM without a domain. As
+// there is no metadata, they are found by their name "<vm>-<disk>". Volumes
+// of existing domains and volumes named after another VM without a domain
+// are skipped.
+func (v *Virter) leftoverDiskVolumes(sp libvirt.StoragePool, vmName string) ([]string, error) {
+	vols, _, err := v.libvirt.StoragePoolListAllVolumes(sp, -1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list storage volumes: %w", err)
+	}
+
+	vmVolumes, domainNames, err := v.getVMVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	orphanVMs := append(findOrphanVMs(vols, domainNames), vmName)
+
+	var result []string
+	for _, vol := range vols {
+		if vol.Name == vmName {
+			continue
 		}
 
-		if persistent != 0 {
-			log.Print("Undefine VM")
-			err = v.libvirt.DomainUndefine(domain)
-			if err != nil {
-				return fmt.Errorf("could not undefine domain: %w", err)
-			}
+		if _, ok := vmVolumes[vol.Name]; ok {
+			continue
 		}
 
-		for _, disk := range disks {
-			if disk == vmName {
-				// do not delete boot volume
-				continue
-			}
-			err = v.rmVolume(sp, disk, "disk")
-			if err != nil {
-				return err
-			}
+		if orphanVMOfVolume(vol.Name, orphanVMs) == vmName {
+			result = append(result, vol.Name)
 		}
 	}
 
-	return nil
+	return result, nil
 }
 
-func (v *Virter) rmSnapshots(domain libvirt.Domain) error {
+// rmSnapshots removes all snapshots of a domain. libvirt cannot delete
+// external snapshots, so only their metadata is removed. The overlay and
+// memory files of these snapshots are returned so that they can be removed
+// once the domain no longer uses them.
+func (v *Virter) rmSnapshots(domain libvirt.Domain) ([]string, error) {
 	snapshots, _, err := v.libvirt.DomainListAllSnapshots(domain, -1, 0)
 	if err != nil {
-		return fmt.Errorf("could not list snapshots: %w", err)
+		return nil, fmt.Errorf("could not list snapshots: %w", err)
 	}
 
+	var files []string
 	for _, snapshot := range snapshots {
+		snapcfg, err := v.getSnapshotDescription(snapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		var flags libvirt.DomainSnapshotDeleteFlags
+		if isExternalSnapshot(snapcfg) {
+			files = append(files, externalSnapshotFiles(snapcfg)...)
+			flags = libvirt.DomainSnapshotDeleteMetadataOnly
+		}
+
 		log.Printf("Delete snapshot %v", snapshot.Name)
-		err = v.libvirt.DomainSnapshotDelete(snapshot, 0)
+		err = v.libvirt.DomainSnapshotDelete(snapshot, flags)
+		if err != nil {
+			return nil, fmt.Errorf("could not delete snapshot: %w", err)
+		}
+	}
+
+	return files, nil
+}
+
+// rmSnapshotFiles removes the files created by external snapshots. They are
+// not known to the storage pool until it has been refreshed.
+func (v *Virter) rmSnapshotFiles(sp libvirt.StoragePool, files []string) error {
+	if len(files) == 0 {
+		return nil
+	}
+
+	err := v.libvirt.StoragePoolRefresh(sp, 0)
+	if err != nil {
+		return fmt.Errorf("could not refresh storage pool: %w", err)
+	}
+
+	for _, file := range files {
+		volume, err := v.libvirt.StorageVolLookupByPath(file)
+		if hasErrorCode(err, errNoStorageVol) {
+			log.Warnf("Snapshot file '%s' is not in the storage pool, not removing it", file)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not get snapshot file '%s': %w", file, err)
+		}
+
+		log.Printf("Delete snapshot file %v", file)
+		err = v.libvirt.StorageVolDelete(volume, 0)
 		if err != nil {
-			return fmt.Errorf("could not delete snapshot: %w", err)
+			return fmt.Errorf("could not delete snapshot file '%s': %w", file, err)
 		}
 	}
 
@@ -393,6 +746,24 @@ func (v *Virter) VMCommit(afterNotifier AfterNotifier, vmName string, shutdown b
 		return fmt.Errorf("could not get domain: %w", err)
 	}
 
+	snapshots, _, err := v.libvirt.DomainListAllSnapshots(domain, -1, 0)
+	if err != nil {
+		return fmt.Errorf("could not list snapshots: %w", err)
+	}
+
+	for _, snapshot := range snapshots {
+		snapcfg, err := v.getSnapshotDescription(snapshot)
+		if err != nil {
+			return err
+		}
+
+		// the changes since an external snapshot are only in the
+		// overlay, not in the boot volume that would become the image
+		if isExternalSnapshot(snapcfg) {
+			return fmt.Errorf("cannot commit a VM with external snapshot '%s'", snapcfg.Name)
+		}
+	}
+
 	if shutdown {
 		err = v.vmShutdown(afterNotifier, shutdownTimeout, domain)
 		if err != nil {
@@ -414,7 +785,7 @@ func (v *Virter) VMCommit(afterNotifier AfterNotifier, vmName string, shutdown b
 		return fmt.Errorf("could not get storage pool: %w", err)
 	}
 
-	err = v.vmRmExceptBoot(sp, vmName)
+	_, err = v.vmRmExceptBoot(sp, vmName)
 	if err != nil {
 		return err
 	}
@@ -456,8 +827,155 @@ func (v *Virter) vmShutdown(afterNotifier AfterNotifier, shutdownTimeout time.Du
 				active = 0
 			}
 		case <-timeout:
-			return fmt.Errorf("timed out waiting for domain to stop")
+			return errShutdownTimeout
+		}
+	}
+
+	return nil
+}
+
+var errShutdownTimeout = errors.New("timed out waiting for domain to stop")
+
+// VMStop shuts a VM down gracefully. If it does not stop within
+// shutdownTimeout, it is destroyed.
+func (v *Virter) VMStop(afterNotifier AfterNotifier, vmName string, shutdownTimeout time.Duration) error {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return fmt.Errorf("could not get domain: %w", err)
+	}
+
+	err = v.vmShutdown(afterNotifier, shutdownTimeout, domain)
+	if errors.Is(err, errShutdownTimeout) {
+		log.Printf("VM '%s' did not stop within %v, destroying it", vmName, shutdownTimeout)
+		err = v.libvirt.DomainDestroy(domain)
+		if err != nil {
+			return fmt.Errorf("could not destroy domain: %w", err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// VMStart starts a stopped VM. The DHCP entry of the VM is added again if it
+// is missing. Only the name and the SSH related fields of vmConfig are used.
+func (v *Virter) VMStart(ctx context.Context, shellClientBuilder ShellClientBuilder, vmConfig VMConfig) error {
+	vmName := vmConfig.Name
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return fmt.Errorf("could not get domain: %w", err)
+	}
+
+	if !v.userNetwork() {
+		err = v.ensureDHCPEntry(domain)
+		if err != nil {
+			return err
+		}
+	}
+
+	active, err := v.libvirt.DomainIsActive(domain)
+	if err != nil {
+		return fmt.Errorf("could not check if domain is active: %w", err)
+	}
+
+	if active != 0 {
+		log.Printf("VM '%s' is already running", vmName)
+	} else {
+		log.Printf("Start VM '%s'", vmName)
+		err = v.libvirt.DomainCreate(domain)
+		if err != nil {
+			return fmt.Errorf("could not create (start) domain: %w", err)
+		}
+	}
+
+	if vmConfig.WaitSSH {
+		hostPort, err := v.getSSHAddress(vmName, nil)
+		if err != nil {
+			return err
+		}
+
+		err = v.pingSSH(ctx, shellClientBuilder, vmConfig, hostPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureDHCPEntry adds the DHCP entries of a domain again if they are
+// missing, using the ID from the virter metadata.
+func (v *Virter) ensureDHCPEntry(domain libvirt.Domain) error {
+	ifaces, err := v.getDomainNetworkInterfaces(domain)
+	if err != nil {
+		return err
+	}
+
+	var meta *VMMetadata
+	for _, iface := range ifaces {
+		network, err := v.libvirt.NetworkLookupByName(iface.network)
+		if err != nil {
+			return fmt.Errorf("could not get network '%s': %w", iface.network, err)
 		}
+
+		external, err := v.externalNetwork(network)
+		if err != nil {
+			return err
+		}
+		if external {
+			continue
+		}
+
+		ips, err := v.findIPs(network, domain.Name, iface.mac)
+		if err != nil {
+			return err
+		}
+
+		if len(ips) > 0 {
+			continue
+		}
+
+		if meta == nil {
+			meta, err = v.getVMMetadata(domain)
+			if err != nil {
+				return err
+			}
+
+			if meta == nil {
+				return fmt.Errorf("no DHCP entry for domain '%s' and no virter metadata to determine its ID", domain.Name)
+			}
+		}
+
+		_, err = v.addDHCPEntry(network, domain.Name, iface.mac, meta.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VMReboot reboots a running VM.
+func (v *Virter) VMReboot(vmName string) error {
+	domain, err := v.libvirt.DomainLookupByName(vmName)
+	if err != nil {
+		return fmt.Errorf("could not get domain: %w", err)
+	}
+
+	active, err := v.libvirt.DomainIsActive(domain)
+	if err != nil {
+		return fmt.Errorf("could not check if domain is active: %w", err)
+	}
+
+	if active == 0 {
+		return fmt.Errorf("cannot reboot VM '%s' that is not running", vmName)
+	}
+
+	log.Printf("Reboot VM '%s'", vmName)
+	err = v.libvirt.DomainReboot(domain, 0)
+	if err != nil {
+		return fmt.Errorf("could not reboot domain: %w", err)
 	}
 
 	return nil
@@ -478,6 +996,18 @@ func (v *Virter) getIP(vmName string, network *libvirt.Network) (string, error)
 		return "", fmt.Errorf("cannot exec against VM '%s' that is not running", vmName)
 	}
 
+	if v.userNetwork() {
+		return userNetworkIP, nil
+	}
+
+	if v.hostBridge != nil {
+		ip, err := v.getHostBridgeIP(domain)
+		if err != nil {
+			return "", fmt.Errorf("could not find IP for VM '%s': %w", vmName, err)
+		}
+		return ip, nil
+	}
+
 	if network == nil {
 		lookup, err := v.libvirt.NetworkLookupByName(v.networkName)
 		if err != nil {
@@ -497,13 +1027,17 @@ func (v *Virter) getIP(vmName string, network *libvirt.Network) (string, error)
 
 func (v *Virter) getIPs(vmNames []string) ([]string, error) {
 	var ips []string
-	network, err := v.libvirt.NetworkLookupByName(v.networkName)
-	if err != nil {
-		return ips, fmt.Errorf("could not get network: %w", err)
+	var network *libvirt.Network
+	if v.usesLibvirtNetwork() {
+		lookup, err := v.libvirt.NetworkLookupByName(v.networkName)
+		if err != nil {
+			return ips, fmt.Errorf("could not get network: %w", err)
+		}
+		network = &lookup
 	}
 
 	for _, vmName := range vmNames {
-		ip, err := v.getIP(vmName, &network)
+		ip, err := v.getIP(vmName, network)
 		if err != nil {
 			return nil, err
 		}
@@ -514,6 +1048,11 @@ func (v *Virter) getIPs(vmNames []string) ([]string, error) {
 
 // VMExecDocker runs a docker container against some VMs.
 func (v *Virter) VMExecDocker(ctx context.Context, docker DockerClient, vmNames []string, dockerContainerConfig DockerContainerConfig, sshPrivateKey []byte) error {
+	// the container connects to the VMs directly
+	if v.tunnel != nil || v.userNetwork() {
+		return fmt.Errorf("docker provisioning requires the VMs to be directly reachable")
+	}
+
 	ips, err := v.getIPs(vmNames)
 	if err != nil {
 		return err
@@ -541,20 +1080,16 @@ func getSSHClientConfig(sshPrivateKey []byte) (ssh.ClientConfig, error) {
 
 // VMSSHSession runs an interactive shell session in a VM
 func (v *Virter) VMSSHSession(ctx context.Context, vmName string, sshPrivateKey []byte) error {
-	ips, err := v.getIPs([]string{vmName})
+	hostPort, err := v.getSSHAddress(vmName, nil)
 	if err != nil {
 		return err
 	}
-	if len(ips) != 1 {
-		return fmt.Errorf("Expected a single IP")
-	}
 
 	sshConfig, err := getSSHClientConfig(sshPrivateKey)
 	if err != nil {
 		return err
 	}
 
-	hostPort := net.JoinHostPort(ips[0], "22")
 	sshClient := sshclient.NewSSHClient(hostPort, sshConfig)
 	if err := sshClient.Dial(); err != nil {
 		return err
@@ -566,7 +1101,7 @@ func (v *Virter) VMSSHSession(ctx context.Context, vmName string, sshPrivateKey
 
 // VMExecShell runs a simple shell command against some VMs.
 func (v *Virter) VMExecShell(ctx context.Context, vmNames []string, sshPrivateKey []byte, shellStep *ProvisionShellStep) error {
-	ips, err := v.getIPs(vmNames)
+	hostPorts, err := v.getSSHAddresses(vmNames)
 	if err != nil {
 		return err
 	}
@@ -576,13 +1111,20 @@ func (v *Virter) VMExecShell(ctx context.Context, vmNames []string, sshPrivateKe
 		return err
 	}
 
-	var g errgroup.Group
-	for i, ip := range ips {
-		ip := ip
+	steps, err := v.shellStepsForVMs(vmNames, shellStep)
+	if err != nil {
+		return err
+	}
+
+	var g vmGroup
+	for i, hostPort := range hostPorts {
 		vmName := vmNames[i]
-		log.Println("Provisioning via SSH:", shellStep.Script, "in", ip)
-		g.Go(func() error {
-			return runSSHCommand(ctx, &sshConfig, vmName, net.JoinHostPort(ip, "22"), shellStep.Script, EnvmapToSlice(shellStep.Env))
+		hostPort := hostPort
+		step := steps[i]
+
+		log.Println("Provisioning via SSH:", step.Script, "in", vmName)
+		g.Go(vmName, func() error {
+			return runSSHCommand(ctx, &sshConfig, vmName, hostPort, step.Script, EnvmapToSlice(step.Env))
 		})
 	}
 
@@ -590,50 +1132,120 @@ func (v *Virter) VMExecShell(ctx context.Context, vmNames []string, sshPrivateKe
 }
 
 func (v *Virter) VMExecRsync(ctx context.Context, copier netcopy.NetworkCopier, vmNames []string, rsyncStep *ProvisionRsyncStep) error {
-	files, err := filepath.Glob(rsyncStep.Source)
+	steps, err := v.rsyncStepsForVMs(vmNames, rsyncStep)
 	if err != nil {
-		return fmt.Errorf("failed to parse glob pattern: %w", err)
+		return err
 	}
 
-	g, ctx := errgroup.WithContext(ctx)
-	for _, vmName := range vmNames {
+	// expand the patterns for all VMs before copying to any of them
+	files := make([][]string, len(vmNames))
+	for i, step := range steps {
+		files[i], err = filepath.Glob(step.Source)
+		if err != nil {
+			return fmt.Errorf("failed to parse glob pattern: %w", err)
+		}
+	}
+
+	var g vmGroup
+	for i, vmName := range vmNames {
 		vmName := vmName
-		log.Printf(`Copying files via rsync: %s to %s on %s`, rsyncStep.Source, rsyncStep.Dest, vmNames)
-		g.Go(func() error {
-			dest := fmt.Sprintf("%s:%s", vmName, rsyncStep.Dest)
+		step := steps[i]
+		files := files[i]
+
+		log.Printf(`Copying files via rsync: %s to %s on %s`, step.Source, step.Dest, vmName)
+		g.Go(vmName, func() error {
+			dest := fmt.Sprintf("%s:%s", vmName, step.Dest)
 			return v.VMExecCopy(ctx, copier, files, dest)
 		})
 	}
 	return g.Wait()
 }
 
+// VMExecFetch copies files from some VMs to a subdirectory per VM in the
+// destination directory on the host.
+func (v *Virter) VMExecFetch(ctx context.Context, copier netcopy.NetworkCopier, vmNames []string, fetchStep *ProvisionFetchStep) error {
+	if fetchStep.Source == "" || fetchStep.Dest == "" {
+		return fmt.Errorf("fetch step requires a source and a destination")
+	}
+
+	steps, err := v.fetchStepsForVMs(vmNames, fetchStep)
+	if err != nil {
+		return err
+	}
+
+	var g vmGroup
+	for i, vmName := range vmNames {
+		vmName := vmName
+		step := steps[i]
+
+		destDir := filepath.Join(step.Dest, vmName)
+		log.Printf(`Fetching files via rsync: %s from %s to %s`, step.Source, vmName, destDir)
+		g.Go(vmName, func() error {
+			if err := os.MkdirAll(destDir, 0755); err != nil {
+				return fmt.Errorf("could not create directory for files from '%s': %w", vmName, err)
+			}
+
+			source := netcopy.HostPath{Host: vmName, Path: step.Source}
+			if err := v.resolveHostPath(&source); err != nil {
+				return err
+			}
+
+			// the trailing slash makes rsync copy into the directory
+			dest := netcopy.HostPath{Path: destDir + string(filepath.Separator)}
+			if err := copier.Copy(ctx, []netcopy.HostPath{source}, dest); err != nil {
+				return fmt.Errorf("could not fetch files from '%s': %w", vmName, err)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
 func (v *Virter) VMExecCopy(ctx context.Context, copier netcopy.NetworkCopier, sourceSpecs []string, destSpec string) error {
 	sources := make([]netcopy.HostPath, len(sourceSpecs))
 	for i, srcSpec := range sourceSpecs {
 		sources[i] = netcopy.ParseHostPath(srcSpec)
 
 		if !sources[i].Local() {
-			// Replace hostname with ip
-			ip, err := v.getIP(sources[i].Host, nil)
+			err := v.resolveHostPath(&sources[i])
 			if err != nil {
 				return err
 			}
-			sources[i].Host = ip
 		}
 	}
 
 	dest := netcopy.ParseHostPath(destSpec)
 	if !dest.Local() {
-		ip, err := v.getIP(dest.Host, nil)
+		err := v.resolveHostPath(&dest)
 		if err != nil {
 			return err
 		}
-		dest.Host = ip
 	}
 
 	return copier.Copy(ctx, sources, dest)
 }
 
+// resolveHostPath replaces the VM name in a HostPath with the address under
+// which the SSH port of the VM can be reached.
+func (v *Virter) resolveHostPath(hostPath *netcopy.HostPath) error {
+	hostPort, err := v.getSSHAddress(hostPath.Host, nil)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return fmt.Errorf("invalid SSH address '%s': %w", hostPort, err)
+	}
+
+	hostPath.Host = host
+	if port != "22" {
+		hostPath.Port = port
+	}
+
+	return nil
+}
+
 func runSSHCommand(ctx context.Context, config *ssh.ClientConfig, vmName, ipPort, script string, env []string) error {
 	script, err := sshclient.AddEnv(script, env)
 	if err != nil {
@@ -648,8 +1260,20 @@ func runSSHCommand(ctx context.Context, config *ssh.ClientConfig, vmName, ipPort
 	if err != nil {
 		return err
 	}
+
 	defer sshClient.Close()
 
+	// the client was dialed with the context, so it closes the connection
+	// when the context is done. sshd then hangs up on the script and the
+	// script returns, so that a retry of the step cannot overlap with it.
+	err = execSSHScript(sshClient, vmName, script)
+	if ctx.Err() != nil {
+		return fmt.Errorf("script in '%s' did not finish: %w", vmName, ctx.Err())
+	}
+	return err
+}
+
+func execSSHScript(sshClient *sshclient.SSHClient, vmName, script string) error {
 	outp, err := sshClient.StdoutPipe()
 	if err != nil {
 		return err
@@ -693,7 +1317,7 @@ func (v *Virter) findVMIP(network libvirt.Network, domain libvirt.Domain) (strin
 		return "", err
 	}
 
-	ips, err := v.findIPs(network, mac)
+	ips, err := v.findIPs(network, domain.Name, mac)
 	if err != nil {
 		return "", err
 	}
@@ -703,3 +1327,155 @@ func (v *Virter) findVMIP(network libvirt.Network, domain libvirt.Domain) (strin
 
 	return ips[0], nil
 }
+
+// VMInfo contains information about a VM managed by virter
+type VMInfo struct {
+	Name    string            `json:"name"`
+	ID      uint              `json:"id"`
+	IP      string            `json:"ip"`
+	Image   string            `json:"image"`
+	Running bool              `json:"running"`
+	Labels  map[string]string `json:"labels"`
+	// SSHPort is set when the SSH port of the VM is forwarded to IP
+	SSHPort uint `json:"ssh_port,omitempty"`
+	// IPs contains all addresses of the VM, starting with IP
+	IPs []string `json:"ips,omitempty"`
+}
+
+// VMList lists the VMs that were created by virter. A domain is considered
+// to be a virter VM if it contains virter metadata. For domains created by
+// older versions of virter, the existence of a boot volume of the same name
+// in the virter storage pool is checked instead.
+func (v *Virter) VMList() ([]VMInfo, error) {
+	domains, _, err := v.libvirt.ConnectListAllDomains(-1, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not list domains: %w", err)
+	}
+
+	sp, err := v.libvirt.StoragePoolLookupByName(v.storagePoolName)
+	if err != nil {
+		return nil, fmt.Errorf("could not get storage pool: %w", err)
+	}
+
+	var network libvirt.Network
+	var ipNet net.IPNet
+	if v.usesLibvirtNetwork() {
+		network, err = v.libvirt.NetworkLookupByName(v.networkName)
+		if err != nil {
+			return nil, fmt.Errorf("could not get network: %w", err)
+		}
+
+		ipNet, err = v.getIPNet(network)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	vms := []VMInfo{}
+	for _, domain := range domains {
+		info := VMInfo{Name: domain.Name, Labels: map[string]string{}}
+
+		meta, err := v.getVMMetadata(domain)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta != nil {
+			info.ID = meta.ID
+			info.Image = meta.ImageName
+			info.Labels = meta.Labels
+		} else {
+			bootVolume, err := v.libvirt.StorageVolLookupByName(sp, domain.Name)
+			if hasErrorCode(err, errNoStorageVol) {
+				log.Debugf("Skipping domain '%s' which was not created by virter", domain.Name)
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("could not get boot volume of '%s': %w", domain.Name, err)
+			}
+
+			info.Image, err = v.getBackingImage(bootVolume)
+			if err != nil {
+				return nil, fmt.Errorf("could not get image of '%s': %w", domain.Name, err)
+			}
+		}
+
+		active, err := v.libvirt.DomainIsActive(domain)
+		if err != nil {
+			return nil, fmt.Errorf("could not check if domain '%s' is active: %w", domain.Name, err)
+		}
+		info.Running = active != 0
+
+		if v.userNetwork() {
+			// the SSH port can only be determined from the ID
+			if meta != nil {
+				info.IP = userNetworkIP
+				info.SSHPort = v.userNetworkSSHPort(meta.ID)
+			}
+			vms = append(vms, info)
+			continue
+		}
+
+		if v.hostBridge != nil {
+			// VMs created before the host bridge was configured have no
+			// static lease
+			if ip, err := v.getHostBridgeIP(domain); err == nil {
+				info.IP = ip
+				info.IPs = []string{ip}
+			}
+			vms = append(vms, info)
+			continue
+		}
+
+		mac, err := v.getMAC(domain)
+		if err != nil {
+			return nil, fmt.Errorf("could not get MAC of '%s': %w", domain.Name, err)
+		}
+
+		ips, err := v.findIPs(network, domain.Name, mac)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) > 0 {
+			info.IP = ips[0]
+			info.IPs = ips
+		}
+		if meta == nil && info.IP != "" {
+			info.ID, err = ipToID(ipNet, net.ParseIP(info.IP))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		vms = append(vms, info)
+	}
+
+	sort.Slice(vms, func(i, j int) bool { return vms[i].Name < vms[j].Name })
+
+	return vms, nil
+}
+
+// getBackingImage returns the name of the image backing a volume, or the empty
+// string if the volume has no backing store.
+func (v *Virter) getBackingImage(volume libvirt.StorageVol) (string, error) {
+	volumeXML, err := v.libvirt.StorageVolGetXMLDesc(volume, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not get volume XML: %w", err)
+	}
+
+	volcfg := &libvirtxml.StorageVolume{}
+	err = volcfg.Unmarshal(volumeXML)
+	if err != nil {
+		return "", fmt.Errorf("could not unmarshal volume XML: %w", err)
+	}
+
+	if volcfg.BackingStore == nil || volcfg.BackingStore.Path == "" {
+		return "", nil
+	}
+
+	backingVolume, err := v.libvirt.StorageVolLookupByPath(volcfg.BackingStore.Path)
+	if err != nil {
+		return "", fmt.Errorf("could not get backing volume: %w", err)
+	}
+
+	return backingVolume.Name, nil
+}
@@ -2,6 +2,8 @@ package virter_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -65,7 +67,7 @@ func TestVMRun(t *testing.T) {
 		SSHPingCount:  1,
 		SSHPingPeriod: time.Second, // ignored
 	}
-	err := v.VMRun(MockShellClientBuilder{shell}, c)
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
 	assert.NoError(t, err)
 
 	assert.Empty(t, l.vols[vmName].content)
@@ -80,6 +82,435 @@ func TestVMRun(t *testing.T) {
 	shell.AssertExpectations(t)
 }
 
+func TestVMRunIDRange(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+	err := v.SetIDRange(virter.IDRange{First: 10, Last: 11})
+	assert.NoError(t, err)
+
+	for _, name := range []string{"vm-1", "vm-2", "vm-3"} {
+		c := virter.VMConfig{
+			ImageName: imageName,
+			Name:      name,
+			VCPUs:     1,
+			MemoryKiB: 1024,
+		}
+		err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+		if name == "vm-3" {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	hosts := l.network.description.IPs[0].DHCP.Hosts
+	if assert.Len(t, hosts, 2) {
+		assert.Equal(t, "192.168.122.11", hosts[0].IP)
+		assert.Equal(t, "192.168.122.10", hosts[1].IP)
+	}
+}
+
+// TestVMRunAutoName runs VMs like "vm run --count 2" without "--id"
+func TestVMRunAutoName(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+	err := v.SetIDRange(virter.IDRange{First: 10, Last: 11})
+	assert.NoError(t, err)
+
+	var names []string
+	for i := 0; i < 2; i++ {
+		c := virter.VMConfig{
+			ImageName:  imageName,
+			NamePrefix: "vm",
+			VCPUs:      1,
+			MemoryKiB:  1024,
+		}
+		name, err := v.VMRunAutoName(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+		assert.NoError(t, err)
+		names = append(names, name)
+	}
+
+	assert.Equal(t, []string{"vm-11", "vm-10"}, names)
+	assert.Contains(t, l.domains, "vm-11")
+	assert.Contains(t, l.domains, "vm-10")
+
+	_, err = v.VMRunAutoName(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, virter.VMConfig{
+		ImageName: imageName,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	})
+	assert.Error(t, err)
+}
+
+// otherHostLibvirtConnection simulates a virter process on another host which
+// adds a DHCP entry for the same IP right before the first one is added.
+type otherHostLibvirtConnection struct {
+	*FakeLibvirtConnection
+	ip    string
+	added bool
+}
+
+func (l *otherHostLibvirtConnection) NetworkUpdate(Net libvirt.Network, Command uint32, Section uint32, ParentIndex int32, XML string, Flags libvirt.NetworkUpdateFlags) (err error) {
+	if !l.added {
+		fakeNetworkAddHost(l.network, "52:54:00:00:00:01", l.ip)
+		l.added = true
+	}
+	return l.FakeLibvirtConnection.NetworkUpdate(Net, Command, Section, ParentIndex, XML, Flags)
+}
+
+func TestVMRunIDTakenByOtherHost(t *testing.T) {
+	l := &otherHostLibvirtConnection{FakeLibvirtConnection: newFakeLibvirtConnection(), ip: "192.168.122.11"}
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+	err := v.SetIDRange(virter.IDRange{First: 10, Last: 11})
+	assert.NoError(t, err)
+
+	c := virter.VMConfig{
+		ImageName:  imageName,
+		NamePrefix: "vm",
+		VCPUs:      1,
+		MemoryKiB:  1024,
+	}
+	name, err := v.VMRunAutoName(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+	assert.Equal(t, "vm-10", name)
+	assert.Len(t, l.domains, 1)
+	assert.Len(t, l.network.description.IPs[0].DHCP.Hosts, 2)
+}
+
+func TestVMRunPresetIDTakenByOtherHost(t *testing.T) {
+	l := &otherHostLibvirtConnection{FakeLibvirtConnection: newFakeLibvirtConnection(), ip: vmIP}
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.Error(t, err)
+	assert.Empty(t, l.domains)
+	assert.Len(t, l.network.description.IPs[0].DHCP.Hosts, 1)
+}
+
+func TestVMRunDNS(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+	l.network.description.Domain = &libvirtxml.NetworkDomain{Name: "lab"}
+
+	v := virter.New(l, poolName, networkName)
+	v.SetDNSDomain("test")
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	hosts := l.network.description.DNS.Host
+	if assert.Len(t, hosts, 1) {
+		assert.Equal(t, vmIP, hosts[0].IP)
+		assert.Equal(t, []libvirtxml.NetworkDNSHostHostname{
+			{Hostname: vmName},
+			{Hostname: vmName + ".lab"},
+		}, hosts[0].Hostnames)
+	}
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+	assert.Empty(t, l.network.description.DNS.Host)
+
+	// fall back to the configured domain
+	l.network.description.Domain = nil
+
+	err = v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	hosts = l.network.description.DNS.Host
+	if assert.Len(t, hosts, 1) {
+		assert.Equal(t, vmName+".test", hosts[0].Hostnames[1].Hostname)
+	}
+}
+
+func TestVMRunDualStack(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	// the IPv6 range comes first to check that IPv4 is still preferred
+	l.network.description.IPs = append([]libvirtxml.NetworkIP{{
+		Family:  "ipv6",
+		Address: "fd00:1::1",
+		Prefix:  64,
+		DHCP:    &libvirtxml.NetworkDHCP{},
+	}}, l.network.description.IPs...)
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{new(mocks.ShellClient)}, c)
+	assert.NoError(t, err)
+
+	// the ID is limited by the smaller IPv4 range
+	v6Hosts := l.network.description.IPs[0].DHCP.Hosts
+	if assert.Len(t, v6Hosts, 1) {
+		assert.Equal(t, vmName, v6Hosts[0].Name)
+		assert.Equal(t, "fd00:1::fe", v6Hosts[0].IP)
+		assert.Empty(t, v6Hosts[0].MAC)
+	}
+	assert.Equal(t, "192.168.122.254", l.network.description.IPs[1].DHCP.Hosts[0].IP)
+	assert.Len(t, l.network.description.DNS.Host, 2)
+
+	vms, err := v.VMList()
+	assert.NoError(t, err)
+	if assert.Len(t, vms, 1) {
+		assert.Equal(t, uint(254), vms[0].ID)
+		assert.Equal(t, "192.168.122.254", vms[0].IP)
+		assert.Equal(t, []string{"192.168.122.254", "fd00:1::fe"}, vms[0].IPs)
+	}
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+	assert.Empty(t, l.network.description.IPs[0].DHCP.Hosts)
+	assert.Empty(t, l.network.description.IPs[1].DHCP.Hosts)
+	assert.Empty(t, l.network.description.DNS.Host)
+}
+
+func TestVMRunRollback(t *testing.T) {
+	shell := new(mocks.ShellClient)
+	shell.On("Dial").Return(errors.New("connection refused"))
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	// resources of another VM must not be touched
+	otherVolume := "other-vm"
+	l.vols[otherVolume] = &FakeLibvirtStorageVol{}
+	l.domains[otherVolume] = newFakeLibvirtDomain("01:23:45:67:89:ac")
+	fakeNetworkAddHost(l.network, "01:23:45:67:89:ac", "192.168.122.43")
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName:     imageName,
+		Name:          vmName,
+		ID:            vmID,
+		VCPUs:         1,
+		MemoryKiB:     1024,
+		SSHPublicKeys: []string{sshPublicKey},
+		SSHPrivateKey: []byte(sshPrivateKey),
+		WaitSSH:       true,
+		SSHPingCount:  1,
+		SSHPingPeriod: time.Second, // ignored
+		Disks:         []virter.Disk{testDisk{"data"}},
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.Error(t, err)
+
+	assert.Len(t, l.vols, 2)
+	assert.Contains(t, l.vols, imageName)
+	assert.Contains(t, l.vols, otherVolume)
+	assert.Len(t, l.domains, 1)
+	assert.Contains(t, l.domains, otherVolume)
+	assert.Len(t, l.network.description.IPs[0].DHCP.Hosts, 1)
+
+	// the VM can be run again once the problem is gone
+	shell = new(mocks.ShellClient)
+	shell.On("Dial").Return(nil)
+	shell.On("Close").Return(nil)
+
+	err = v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+}
+
+func TestVMRunCancel(t *testing.T) {
+	shell := new(mocks.ShellClient)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := v.VMRun(ctx, MockShellClientBuilder{shell}, c)
+	assert.True(t, errors.Is(err, context.Canceled))
+
+	assert.Len(t, l.vols, 1)
+	assert.Contains(t, l.vols, imageName)
+	assert.Empty(t, l.domains)
+	assert.Empty(t, l.network.description.IPs[0].DHCP.Hosts)
+}
+
+func TestVMList(t *testing.T) {
+	shell := new(mocks.ShellClient)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	// a domain that was not created by virter
+	l.domains["foreign"] = newFakeLibvirtDomain(vmMAC)
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+		Labels:    map[string]string{"role": "controller"},
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	vms, err := v.VMList()
+	assert.NoError(t, err)
+	assert.Equal(t, []virter.VMInfo{
+		{
+			Name:    vmName,
+			ID:      vmID,
+			IP:      vmIP,
+			Image:   imageName,
+			Running: true,
+			Labels:  map[string]string{"role": "controller"},
+			IPs:     []string{vmIP},
+		},
+	}, vms)
+
+	selector, err := virter.ParseLabelSelector("role=controller")
+	assert.NoError(t, err)
+	names, err := v.VMSelect(selector)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{vmName}, names)
+
+	selector, err = virter.ParseLabelSelector("role=satellite")
+	assert.NoError(t, err)
+	names, err = v.VMSelect(selector)
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+type testDisk struct {
+	name string
+}
+
+func (d testDisk) GetName() string    { return d.name }
+func (d testDisk) GetSizeKiB() uint64 { return 1024 }
+func (d testDisk) GetFormat() string  { return "qcow2" }
+func (d testDisk) GetBus() string     { return "virtio" }
+
+func TestVMInspect(t *testing.T) {
+	shell := new(mocks.ShellClient)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	l.domains["foreign"] = newFakeLibvirtDomain(vmMAC)
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+		Disks:     []virter.Disk{testDisk{"data"}},
+		Labels:    map[string]string{"role": "controller"},
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	meta, err := v.VMInspect(vmName)
+	assert.NoError(t, err)
+	assert.Equal(t, imageName, meta.ImageName)
+	assert.Equal(t, uint(vmID), meta.ID)
+	assert.Equal(t, vmName, meta.BootVolume)
+	assert.Equal(t, ciDataVolumeName, meta.CIDataVolume)
+	assert.Equal(t, []virter.VMMetadataDisk{{Name: "data", Volume: vmName + "-data"}}, meta.Disks)
+	assert.Equal(t, map[string]string{"role": "controller"}, meta.Labels)
+	assert.Equal(t, virter.Version, meta.Version)
+	assert.False(t, meta.Created.IsZero())
+
+	_, err = v.VMInspect("foreign")
+	assert.Error(t, err)
+
+	_, err = v.VMInspect("nonexistent")
+	assert.Error(t, err)
+}
+
+func TestVMRmMetadata(t *testing.T) {
+	shell := new(mocks.ShellClient)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+		Disks:     []virter.Disk{testDisk{"data"}},
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	// a volume that was attached to the VM, but not created by virter
+	otherVolume := "some-other-volume"
+	l.vols[otherVolume] = &FakeLibvirtStorageVol{}
+	addDisk(l, vmName, otherVolume)
+
+	err = v.VMRm(vmName)
+	assert.NoError(t, err)
+
+	assert.Len(t, l.vols, 2)
+	assert.Contains(t, l.vols, imageName)
+	assert.Contains(t, l.vols, otherVolume)
+	assert.Empty(t, l.network.description.IPs[0].DHCP.Hosts)
+	assert.Empty(t, l.domains)
+}
+
 const (
 	ciDataVolume     = "ciDataVolume"
 	bootVolume       = "bootVolume"
@@ -89,6 +520,14 @@ const (
 
 var vmRmTests = []map[string]bool{
 	{},
+	// left over by a VM which failed to be created
+	{
+		bootVolume: true,
+	},
+	{
+		ciDataVolume: true,
+		bootVolume:   true,
+	},
 	{
 		ciDataVolume:  true,
 		domainCreated: true,
@@ -151,7 +590,9 @@ func TestVMRm(t *testing.T) {
 
 		if r[ciDataVolume] {
 			l.vols[ciDataVolumeName] = &FakeLibvirtStorageVol{}
-			addDisk(l, vmName, ciDataVolumeName)
+			if l.domains[vmName] != nil {
+				addDisk(l, vmName, ciDataVolumeName)
+			}
 		}
 
 		v := virter.New(l, poolName, networkName)
@@ -165,6 +606,31 @@ func TestVMRm(t *testing.T) {
 	}
 }
 
+func TestVMRmLeftoverDisks(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	// volumes of the VM whose domain is gone
+	l.vols[vmName] = &FakeLibvirtStorageVol{}
+	l.vols[ciDataVolumeName] = &FakeLibvirtStorageVol{}
+	l.vols[vmName+"-data"] = &FakeLibvirtStorageVol{}
+
+	// another VM without a domain whose name starts with the same prefix
+	l.vols[vmName+"-2"] = &FakeLibvirtStorageVol{}
+	l.vols[vmName+"-2-cidata"] = &FakeLibvirtStorageVol{}
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.VMRm(vmName)
+	assert.NoError(t, err)
+
+	assert.Len(t, l.vols, 3)
+	assert.Contains(t, l.vols, vmName+"-2")
+	assert.Contains(t, l.vols, vmName+"-2-cidata")
+	assert.Contains(t, l.vols, imageName)
+}
+
 const (
 	commitDomainActive    = "domainActive"
 	commitShutdown        = "shutdown"
@@ -244,6 +710,102 @@ func TestVMCommit(t *testing.T) {
 	}
 }
 
+func TestVMStop(t *testing.T) {
+	for _, timedOut := range []bool{false, true} {
+		l := newFakeLibvirtConnection()
+
+		domain := newFakeLibvirtDomain(vmMAC)
+		domain.persistent = true
+		domain.active = true
+		l.domains[vmName] = domain
+
+		an := new(mocks.AfterNotifier)
+
+		if timedOut {
+			l.lifecycleEvents = make(chan libvirt.DomainEventLifecycleMsg)
+			timeout := make(chan time.Time, 1)
+			timeout <- time.Unix(0, 0)
+			mockAfter(an, timeout)
+		} else {
+			l.lifecycleEvents = makeShutdownEvents()
+			mockAfter(an, make(chan time.Time))
+		}
+
+		v := virter.New(l, poolName, networkName)
+
+		err := v.VMStop(an, vmName, shutdownTimeout)
+		assert.NoError(t, err)
+		assert.False(t, domain.active)
+		assert.Contains(t, l.domains, vmName)
+
+		an.AssertExpectations(t)
+	}
+}
+
+func TestVMStart(t *testing.T) {
+	shell := new(mocks.ShellClient)
+	shell.On("Dial").Return(nil)
+	shell.On("Close").Return(nil)
+
+	l := newFakeLibvirtConnection()
+
+	l.vols[imageName] = &FakeLibvirtStorageVol{}
+
+	v := virter.New(l, poolName, networkName)
+
+	c := virter.VMConfig{
+		ImageName: imageName,
+		Name:      vmName,
+		ID:        vmID,
+		VCPUs:     1,
+		MemoryKiB: 1024,
+	}
+	err := v.VMRun(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	// lose the DHCP entry while the VM is stopped
+	l.domains[vmName].active = false
+	l.network.description.IPs[0].DHCP.Hosts = nil
+
+	c.WaitSSH = true
+	c.SSHPrivateKey = []byte(sshPrivateKey)
+	c.SSHPingCount = 1
+	c.SSHPingPeriod = time.Second
+	err = v.VMStart(context.Background(), MockShellClientBuilder{shell}, c)
+	assert.NoError(t, err)
+
+	assert.True(t, l.domains[vmName].active)
+	hosts := l.network.description.IPs[0].DHCP.Hosts
+	if assert.Len(t, hosts, 1) {
+		assert.Equal(t, vmIP, hosts[0].IP)
+	}
+
+	shell.AssertExpectations(t)
+
+	err = v.VMStart(context.Background(), MockShellClientBuilder{shell}, virter.VMConfig{Name: "nonexistent"})
+	assert.Error(t, err)
+}
+
+func TestVMReboot(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	domain := newFakeLibvirtDomain(vmMAC)
+	domain.persistent = true
+	l.domains[vmName] = domain
+
+	v := virter.New(l, poolName, networkName)
+
+	err := v.VMReboot(vmName)
+	assert.Error(t, err)
+	assert.False(t, domain.rebooted)
+
+	domain.active = true
+
+	err = v.VMReboot(vmName)
+	assert.NoError(t, err)
+	assert.True(t, domain.rebooted)
+}
+
 func makeShutdownEvents() chan libvirt.DomainEventLifecycleMsg {
 	events := make(chan libvirt.DomainEventLifecycleMsg, 1)
 	events <- libvirt.DomainEventLifecycleMsg{
@@ -340,6 +902,187 @@ func TestVMExecRsync(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestVMExecFetch(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	domain := newFakeLibvirtDomain(vmMAC)
+	domain.persistent = true
+	domain.active = true
+	l.domains[vmName] = domain
+
+	fakeNetworkAddHost(l.network, vmMAC, vmIP)
+
+	v := virter.New(l, poolName, networkName)
+
+	dir, err := ioutil.TempDir("", "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	step := &virter.ProvisionFetchStep{
+		Source: "/var/log/*.log",
+		Dest:   filepath.Join(dir, "logs"),
+	}
+
+	copier := new(mocks.NetworkCopier)
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{Path: "/var/log/*.log", Host: "192.168.122.42"},
+	}, netcopy.HostPath{Path: filepath.Join(dir, "logs", vmName) + "/"}).Return(nil)
+
+	err = v.VMExecFetch(context.Background(), copier, []string{vmName}, step)
+	assert.NoError(t, err)
+	copier.AssertExpectations(t)
+	assert.DirExists(t, filepath.Join(dir, "logs", vmName))
+
+	err = v.VMExecFetch(context.Background(), copier, []string{"NoVm"}, step)
+	assert.Error(t, err)
+
+	err = v.VMExecFetch(context.Background(), copier, []string{vmName}, &virter.ProvisionFetchStep{Source: "/tmp"})
+	assert.Error(t, err)
+}
+
+// newTestVirterWithVMs returns a Virter with a running domain for each of the
+// given names. The first VM has the MAC vmMAC and the IP vmIP, the following
+// ones the next MACs and IPs.
+func newTestVirterWithVMs(t *testing.T, names ...string) (*virter.Virter, *FakeLibvirtConnection) {
+	t.Helper()
+
+	l := newFakeLibvirtConnection()
+
+	for i, name := range names {
+		mac := fmt.Sprintf("01:23:45:67:89:%02x", 0xab+i)
+		domain := newFakeLibvirtDomain(mac)
+		domain.persistent = true
+		domain.active = true
+		l.domains[name] = domain
+
+		fakeNetworkAddHost(l.network, mac, fmt.Sprintf("192.168.122.%d", 42+i))
+	}
+
+	return virter.New(l, poolName, networkName), l
+}
+
+func TestVMExecFetchPartialFailure(t *testing.T) {
+	v, _ := newTestVirterWithVMs(t, vmName, "other-vm")
+
+	dir, err := ioutil.TempDir("", "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	step := &virter.ProvisionFetchStep{
+		Source: "/var/crash/*",
+		Dest:   dir,
+	}
+
+	// the copy from the other VM continues after the first one failed,
+	// it must not be cancelled by that failure
+	failed := make(chan struct{})
+	cancelled := false
+	copier := new(mocks.NetworkCopier)
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{Path: "/var/crash/*", Host: "192.168.122.42"},
+	}, mock.Anything).Return(errors.New("no such file")).Run(func(mock.Arguments) {
+		close(failed)
+	})
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{Path: "/var/crash/*", Host: "192.168.122.43"},
+	}, netcopy.HostPath{Path: filepath.Join(dir, "other-vm") + "/"}).Return(nil).Run(func(args mock.Arguments) {
+		<-failed
+		select {
+		case <-args.Get(0).(context.Context).Done():
+			cancelled = true
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	err = v.VMExecFetch(context.Background(), copier, []string{vmName, "other-vm"}, step)
+	assert.Error(t, err)
+	assert.False(t, cancelled)
+	copier.AssertExpectations(t)
+	assert.DirExists(t, filepath.Join(dir, "other-vm"))
+}
+
+func TestVMExecFetchPerVM(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	domain := newFakeLibvirtDomain(vmMAC)
+	domain.persistent = true
+	domain.active = true
+	l.domains[vmName] = domain
+
+	fakeNetworkAddHost(l.network, vmMAC, vmIP)
+
+	v := virter.New(l, poolName, networkName)
+
+	dir, err := ioutil.TempDir("", "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pc, err := virter.NewProvisionConfig(virter.ProvisionOption{
+		Overrides: []string{
+			"steps[0].fetch.source=/var/log/{{.VM.Name}}-{{.VM.IP}}.log",
+			"steps[0].fetch.dest=" + filepath.Join(dir, "{{.VM.Index}}"),
+		},
+	})
+	assert.NoError(t, err)
+
+	copier := new(mocks.NetworkCopier)
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{Path: "/var/log/some-vm-192.168.122.42.log", Host: "192.168.122.42"},
+	}, netcopy.HostPath{Path: filepath.Join(dir, "0", vmName) + "/"}).Return(nil)
+
+	err = v.VMExecFetch(context.Background(), copier, []string{vmName}, pc.Steps[0].Fetch)
+	assert.NoError(t, err)
+	copier.AssertExpectations(t)
+}
+
+func TestVMExecRsyncTemplateError(t *testing.T) {
+	v, _ := newTestVirterWithVMs(t, vmName, "other-vm")
+
+	pc, err := virter.NewProvisionConfig(virter.ProvisionOption{
+		Overrides: []string{
+			"steps[0].rsync.source=/tmp/{{if eq .VM.Index 1}}{{.Missing}}{{end}}",
+			"steps[0].rsync.dest=/tmp",
+		},
+	})
+	assert.NoError(t, err)
+
+	// the error for the second VM prevents copying to the first one
+	copier := new(mocks.NetworkCopier)
+	err = v.VMExecRsync(context.Background(), copier, []string{vmName, "other-vm"}, pc.Steps[0].Rsync)
+	assert.Error(t, err)
+	copier.AssertNotCalled(t, "Copy", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestProvisionTargetsTemplateData(t *testing.T) {
+	v, _ := newTestVirterWithVMs(t, vmName, "other-vm")
+
+	dir, err := ioutil.TempDir("", "virter-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pc, err := virter.NewProvisionConfig(virter.ProvisionOption{
+		Overrides: []string{
+			"steps[0].targets={index:1}",
+			"steps[0].fetch.source=/{{.VM.Index}}/{{range .VMs}}{{.IP}}_{{end}}",
+			"steps[0].fetch.dest=" + dir,
+		},
+	})
+	assert.NoError(t, err)
+
+	// the step only runs on the second VM, but sees both
+	copier := new(mocks.NetworkCopier)
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{Path: "/1/192.168.122.42_192.168.122.43_", Host: "192.168.122.43"},
+	}, netcopy.HostPath{Path: filepath.Join(dir, "other-vm") + "/"}).Return(nil)
+
+	err = v.Provision(context.Background(), pc, []string{vmName, "other-vm"}, func(ctx context.Context, s virter.ProvisionStep, vmNames []string) error {
+		assert.Equal(t, []string{"other-vm"}, vmNames)
+		return v.VMExecFetch(ctx, copier, vmNames, s.Fetch)
+	})
+	assert.NoError(t, err)
+	copier.AssertExpectations(t)
+}
+
 func TestVMExecCopy(t *testing.T) {
 	l := newFakeLibvirtConnection()
 
@@ -374,6 +1117,38 @@ func TestVMExecCopy(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+type fakeTunnel struct {
+	forwards map[string]string
+}
+
+func (t fakeTunnel) Forward(hostPort string) (string, error) {
+	return t.forwards[hostPort], nil
+}
+
+func TestVMExecCopyTunnel(t *testing.T) {
+	l := newFakeLibvirtConnection()
+
+	domain := newFakeLibvirtDomain(vmMAC)
+	domain.persistent = true
+	domain.active = true
+	l.domains[vmName] = domain
+
+	fakeNetworkAddHost(l.network, vmMAC, vmIP)
+
+	v := virter.New(l, poolName, networkName)
+	v.SetTunnel(fakeTunnel{map[string]string{vmIP + ":22": "127.0.0.1:34567"}})
+
+	copier := new(mocks.NetworkCopier)
+	copier.On("Copy", mock.Anything, []netcopy.HostPath{
+		{Path: "/tmp/file1.txt"},
+	}, netcopy.HostPath{Path: "/tmp", Host: "127.0.0.1", Port: "34567"}).Return(nil)
+
+	err := v.VMExecCopy(context.Background(), copier, []string{"/tmp/file1.txt"}, vmName+":/tmp")
+	assert.NoError(t, err)
+
+	copier.AssertExpectations(t)
+}
+
 func createFakeDirectory() (string, error) {
 	dir, err := ioutil.TempDir("/tmp", "virter-test")
 	if err != nil {
@@ -0,0 +1,88 @@
+package virter
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// VMError is an error which occurred on a specific VM.
+type VMError struct {
+	VMName string
+	Err    error
+}
+
+func (e *VMError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *VMError) Unwrap() error {
+	return e.Err
+}
+
+// vmGroup runs functions for several VMs concurrently. Unlike an errgroup, it
+// keeps the errors of all VMs, so that it is known which of them failed.
+type vmGroup struct {
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+}
+
+func (g *vmGroup) Go(vmName string, f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(); err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, &VMError{VMName: vmName, Err: err})
+			g.mu.Unlock()
+		}
+	}()
+}
+
+// Wait waits for all functions to return. A single error is returned as is,
+// several are combined in a multierror.
+func (g *vmGroup) Wait() error {
+	g.wg.Wait()
+
+	switch len(g.errs) {
+	case 0:
+		return nil
+	case 1:
+		return g.errs[0]
+	default:
+		return multierror.Append(nil, g.errs...)
+	}
+}
+
+// failedVMs returns the names of the VMs an error occurred on. Errors which
+// do not refer to specific VMs are attributed to all of vmNames.
+func failedVMs(err error, vmNames []string) []string {
+	// the errors may be wrapped, for example if a step timed out
+	var errs []error
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		errs = merr.Errors
+	} else {
+		errs = []error{err}
+	}
+
+	failed := map[string]bool{}
+	for _, e := range errs {
+		var vmErr *VMError
+		if !errors.As(e, &vmErr) {
+			return vmNames
+		}
+		failed[vmErr.VMName] = true
+	}
+
+	// keep the order of vmNames, the errors are in the order the VMs failed
+	names := []string{}
+	for _, vmName := range vmNames {
+		if failed[vmName] {
+			names = append(names, vmName)
+		}
+	}
+	return names
+}
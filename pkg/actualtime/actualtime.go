@@ -1,6 +1,7 @@
 package actualtime
 
 import (
+	"context"
 	"time"
 )
 
@@ -8,19 +9,28 @@ import (
 type ActualTime struct {
 }
 
-// Ping repeats an action at regular intervals
-func (t ActualTime) Ping(count int, period time.Duration, f func() error) error {
+// Ping repeats an action at regular intervals until it succeeds, count
+// attempts have been made or the context is done
+func (t ActualTime) Ping(ctx context.Context, count int, period time.Duration, f func() error) error {
 	ticker := time.NewTicker(period)
 	defer ticker.Stop()
 
 	var lastErr error
 	for i := 0; i < count; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		err := f()
 		if err == nil {
 			return nil
 		}
 		if i < count-1 {
-			<-ticker.C
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 		lastErr = err
 	}
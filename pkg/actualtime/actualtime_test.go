@@ -0,0 +1,46 @@
+package actualtime_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/LINBIT/virter/pkg/actualtime"
+)
+
+func TestPing(t *testing.T) {
+	calls := 0
+	err := actualtime.ActualTime{}.Ping(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	calls = 0
+	err = actualtime.ActualTime{}.Ping(context.Background(), 3, time.Millisecond, func() error {
+		calls++
+		return errors.New("never")
+	})
+	assert.EqualError(t, err, "never")
+	assert.Equal(t, 3, calls)
+}
+
+func TestPingCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	err := actualtime.ActualTime{}.Ping(ctx, 60, time.Hour, func() error {
+		calls++
+		cancel()
+		return errors.New("not yet")
+	})
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 1, calls)
+}
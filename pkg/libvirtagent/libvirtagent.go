@@ -0,0 +1,271 @@
+// Package libvirtagent sends commands to QEMU guest agents via the libvirt
+// daemon.
+//
+// The libvirt RPC client in use does not implement the QEMU program of the
+// libvirt protocol, so this package speaks just enough of the protocol to
+// open a connection and call virDomainQemuAgentCommand. See
+// https://libvirt.org/kbase/internals/rpc.html for the wire format.
+package libvirtagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+const (
+	programRemote   = 0x20008086
+	programQEMU     = 0x20008087
+	protocolVersion = 1
+
+	procConnectOpen  = 1
+	procConnectClose = 2
+	procAuthList     = 66
+
+	procQEMUDomainAgentCommand = 3
+
+	typeCall  = 0
+	typeReply = 1
+
+	statusOK    = 0
+	statusError = 1
+
+	// the packet length and the header consist of 4 byte fields
+	headerSize = 7 * 4
+	// maxPacketSize is the limit of libvirt for a single packet
+	maxPacketSize = 32 * 1024 * 1024
+)
+
+// ErrNoResult is returned when the guest agent does not return a result.
+var ErrNoResult = errors.New("guest agent returned no result")
+
+// Client is a connection to the libvirt daemon which is used for guest agent
+// commands.
+type Client struct {
+	mu     sync.Mutex
+	conn   net.Conn
+	serial uint32
+}
+
+// Connect opens the libvirt connection given by uri, e.g. "qemu:///system",
+// over conn.
+func Connect(conn net.Conn, uri string) (*Client, error) {
+	c := &Client{conn: conn}
+
+	// libvirt requires listing the authentication methods before opening
+	// the connection, even when no authentication is used
+	if _, err := c.call(programRemote, procAuthList, nil); err != nil {
+		return nil, fmt.Errorf("could not list authentication methods: %w", err)
+	}
+
+	var args encoder
+	args.optString(&uri)
+	args.uint32(0)
+	if _, err := c.call(programRemote, procConnectOpen, args.Bytes()); err != nil {
+		return nil, fmt.Errorf("could not open connection: %w", err)
+	}
+
+	return c, nil
+}
+
+// Close closes the libvirt connection.
+func (c *Client) Close() error {
+	_, err := c.call(programRemote, procConnectClose, nil)
+	closeErr := c.conn.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// QEMUDomainAgentCommand sends a command to the guest agent of a domain and
+// returns its response. The timeout is in seconds; libvirt interprets -1 as
+// its default timeout, -2 as blocking and 0 as not waiting at all.
+func (c *Client) QEMUDomainAgentCommand(dom libvirt.Domain, cmd string, timeout int32, flags uint32) (string, error) {
+	var args encoder
+	args.string(dom.Name)
+	args.Write(dom.UUID[:])
+	args.int32(dom.ID)
+	args.string(cmd)
+	args.int32(timeout)
+	args.uint32(flags)
+
+	ret, err := c.call(programQEMU, procQEMUDomainAgentCommand, args.Bytes())
+	if err != nil {
+		return "", err
+	}
+
+	d := decoder{r: bytes.NewReader(ret)}
+	result, err := d.optString()
+	if err != nil {
+		return "", fmt.Errorf("could not decode guest agent result: %w", err)
+	}
+	if result == nil {
+		return "", ErrNoResult
+	}
+
+	return *result, nil
+}
+
+// call sends a request and waits for the reply. The connection is not used
+// for events or streams, so replies arrive in the order of the requests.
+func (c *Client) call(program, procedure uint32, args []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.serial++
+	serial := c.serial
+
+	var packet encoder
+	packet.uint32(uint32(headerSize + len(args)))
+	packet.uint32(program)
+	packet.uint32(protocolVersion)
+	packet.uint32(procedure)
+	packet.uint32(typeCall)
+	packet.uint32(serial)
+	packet.uint32(statusOK)
+	packet.Write(args)
+
+	if _, err := c.conn.Write(packet.Bytes()); err != nil {
+		return nil, fmt.Errorf("could not send request: %w", err)
+	}
+
+	var header [headerSize]byte
+	if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+		return nil, fmt.Errorf("could not read reply: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(header[0:])
+	if length < headerSize || length > maxPacketSize {
+		return nil, fmt.Errorf("invalid reply length %d", length)
+	}
+
+	payload := make([]byte, length-headerSize)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return nil, fmt.Errorf("could not read reply: %w", err)
+	}
+
+	replyType := binary.BigEndian.Uint32(header[16:])
+	replySerial := binary.BigEndian.Uint32(header[20:])
+	if replyType != typeReply || replySerial != serial {
+		return nil, fmt.Errorf("unexpected reply of type %d for request %d", replyType, replySerial)
+	}
+
+	switch binary.BigEndian.Uint32(header[24:]) {
+	case statusOK:
+		return payload, nil
+	case statusError:
+		return nil, decodeError(payload)
+	default:
+		return nil, fmt.Errorf("unexpected reply status %d", binary.BigEndian.Uint32(header[24:]))
+	}
+}
+
+// decodeError extracts the message from a remote_error structure.
+func decodeError(payload []byte) error {
+	d := decoder{r: bytes.NewReader(payload)}
+
+	// skip the error code and domain
+	if _, err := d.uint32(); err != nil {
+		return fmt.Errorf("could not decode error: %w", err)
+	}
+	if _, err := d.uint32(); err != nil {
+		return fmt.Errorf("could not decode error: %w", err)
+	}
+
+	message, err := d.optString()
+	if err != nil {
+		return fmt.Errorf("could not decode error: %w", err)
+	}
+	if message == nil {
+		return errors.New("unknown libvirt error")
+	}
+
+	return errors.New(*message)
+}
+
+// encoder writes XDR encoded values.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) int32(v int32) {
+	e.uint32(uint32(v))
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.WriteString(s)
+	e.Write(make([]byte, padding(len(s))))
+}
+
+func (e *encoder) optString(s *string) {
+	if s == nil {
+		e.uint32(0)
+		return
+	}
+	e.uint32(1)
+	e.string(*s)
+}
+
+// decoder reads XDR encoded values.
+type decoder struct {
+	r io.Reader
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(d.r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func (d *decoder) string() (string, error) {
+	length, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if length > maxPacketSize {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+
+	b := make([]byte, int(length)+padding(int(length)))
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return "", err
+	}
+	return string(b[:length]), nil
+}
+
+func (d *decoder) optString() (*string, error) {
+	present, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if present == 0 {
+		return nil, nil
+	}
+
+	s, err := d.string()
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// padding returns the number of bytes needed to align n to 4 bytes.
+func padding(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,143 @@
+package libvirtagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCall struct {
+	program   uint32
+	procedure uint32
+	args      []byte
+}
+
+// fakeServer answers requests with the given replies and records the calls.
+func fakeServer(t *testing.T, conn net.Conn, replies []func(e *encoder) uint32) <-chan []fakeCall {
+	done := make(chan []fakeCall, 1)
+	go func() {
+		var calls []fakeCall
+		defer func() { done <- calls }()
+
+		for _, reply := range replies {
+			var header [headerSize]byte
+			if _, err := io.ReadFull(conn, header[:]); err != nil {
+				t.Errorf("could not read request: %v", err)
+				return
+			}
+
+			args := make([]byte, binary.BigEndian.Uint32(header[0:])-headerSize)
+			if _, err := io.ReadFull(conn, args); err != nil {
+				t.Errorf("could not read request: %v", err)
+				return
+			}
+
+			calls = append(calls, fakeCall{
+				program:   binary.BigEndian.Uint32(header[4:]),
+				procedure: binary.BigEndian.Uint32(header[12:]),
+				args:      args,
+			})
+
+			var payload encoder
+			status := reply(&payload)
+
+			var packet encoder
+			packet.uint32(uint32(headerSize + payload.Len()))
+			packet.Write(header[4:16])
+			packet.uint32(typeReply)
+			packet.Write(header[20:24])
+			packet.uint32(status)
+			packet.Write(payload.Bytes())
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				t.Errorf("could not send reply: %v", err)
+				return
+			}
+		}
+	}()
+	return done
+}
+
+func okReply(e *encoder) uint32 {
+	return statusOK
+}
+
+func TestQEMUDomainAgentCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	response := `{"return":{}}`
+	done := fakeServer(t, server, []func(e *encoder) uint32{
+		okReply,
+		okReply,
+		func(e *encoder) uint32 {
+			e.optString(&response)
+			return statusOK
+		},
+	})
+
+	c, err := Connect(client, "qemu:///system")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dom := libvirt.Domain{Name: "some-vm", ID: 3}
+	result, err := c.QEMUDomainAgentCommand(dom, `{"execute":"guest-ping"}`, -1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, response, result)
+
+	calls := <-done
+	if assert.Len(t, calls, 3) {
+		assert.Equal(t, uint32(procAuthList), calls[0].procedure)
+		assert.Equal(t, uint32(procConnectOpen), calls[1].procedure)
+		assert.Equal(t, uint32(programQEMU), calls[2].program)
+		assert.Equal(t, uint32(procQEMUDomainAgentCommand), calls[2].procedure)
+
+		d := decoder{r: bytes.NewReader(calls[2].args)}
+		name, err := d.string()
+		assert.NoError(t, err)
+		assert.Equal(t, "some-vm", name)
+	}
+}
+
+func TestQEMUDomainAgentCommandError(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	message := "Guest agent is not responding"
+	done := fakeServer(t, server, []func(e *encoder) uint32{
+		okReply,
+		okReply,
+		func(e *encoder) uint32 {
+			e.uint32(86)
+			e.uint32(10)
+			e.optString(&message)
+			return statusError
+		},
+	})
+
+	c, err := Connect(client, "qemu:///system")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = c.QEMUDomainAgentCommand(libvirt.Domain{Name: "some-vm"}, `{"execute":"guest-ping"}`, -1, 0)
+	assert.EqualError(t, err, message)
+
+	<-done
+}
+
+func TestStringPadding(t *testing.T) {
+	var e encoder
+	e.string("abcde")
+	assert.Equal(t, 4+8, e.Len())
+
+	d := decoder{r: bytes.NewReader(e.Bytes())}
+	s, err := d.string()
+	assert.NoError(t, err)
+	assert.Equal(t, "abcde", s)
+}
@@ -25,6 +25,9 @@ type RsyncNetworkCopier struct {
 type HostPath struct {
 	Path string
 	Host string
+	// Port is the SSH port of the host. The default port is used if
+	// it is empty.
+	Port string
 }
 
 // Parse a host path from a string in '[HOST:]PATH' form.
@@ -75,11 +78,18 @@ func (r *RsyncNetworkCopier) Copy(ctx context.Context, sources []HostPath, dest
 
 	args = append(args, formatRsyncArg(dest))
 
+	rsh := fmt.Sprintf(`/usr/bin/ssh -i "%s" -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null`, r.sshPrivateKeyPath)
+
+	// rsync supports only one remote side, so there is at most one port
+	if port := remotePort(sources, dest); port != "" {
+		rsh += " -p " + port
+	}
+
 	cmd := exec.CommandContext(ctx, "rsync", args...)
 	cmd.Env = []string{
 		// TODO: we are ignoring the SSH host key here. ideally we would
 		// somehow get the host key beforehand and properly verify them.
-		fmt.Sprintf(`RSYNC_RSH=/usr/bin/ssh -i "%s" -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null`, r.sshPrivateKeyPath),
+		"RSYNC_RSH=" + rsh,
 	}
 
 	log.Debugf("executing rsync command:")
@@ -93,6 +103,20 @@ func (r *RsyncNetworkCopier) Copy(ctx context.Context, sources []HostPath, dest
 	return nil
 }
 
+func remotePort(sources []HostPath, dest HostPath) string {
+	if dest.Port != "" {
+		return dest.Port
+	}
+
+	for _, spec := range sources {
+		if spec.Port != "" {
+			return spec.Port
+		}
+	}
+
+	return ""
+}
+
 func formatRsyncArg(spec HostPath) string {
 	if spec.Host == "" {
 		return spec.Path